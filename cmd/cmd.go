@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"debug/elf"
 	"fmt"
 	"os"
 	"path"
@@ -8,6 +9,7 @@ import (
 	"github.com/ii64/golinker/conf"
 	"github.com/ii64/golinker/lib/link"
 	"github.com/ii64/golinker/lib/obj"
+	"github.com/ii64/golinker/lib/proc/cc"
 	"github.com/ii64/golinker/lib/proc/ld"
 )
 
@@ -41,6 +43,9 @@ func Main(cfg *conf.Config) (err error) {
 	if objFile, err = mergeToSingleObject(cfg, objFiles); err != nil {
 		return
 	}
+	if objFile, err = linkBuiltins(cfg, objFile); err != nil {
+		return
+	}
 
 	var o *obj.Object
 	o, err = obj.ReadFile(objFile)
@@ -48,23 +53,82 @@ func Main(cfg *conf.Config) (err error) {
 		return
 	}
 
+	if cfg.DWARFStub {
+		if err = writeDWARFStub(cfg, o); err != nil {
+			return
+		}
+	}
+
 	var st *link.LinkState
 	st, err = link.Link(cfg, o)
 	if err != nil {
 		return
 	}
 
-	_ = st
+	for _, w := range st.Warnings() {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
 	return
 }
 
 func mergeToSingleObject(cfg *conf.Config, objs []string) (objTemp string, err error) {
 	objTemp = path.Join(cfg.TempDir, "all.o")
-	var ins *ld.Ld
-	ins, err = ld.New([]string{
+	err = runLd([]string{
 		"--relocatable",
 		"-o", objTemp,
 	}, objs)
+	return
+}
+
+// linkBuiltins links the members of the compiler builtins archive that
+// define the symbols objFile leaves undefined, like __udivti3.
+func linkBuiltins(cfg *conf.Config, objFile string) (objTemp string, err error) {
+	objTemp = objFile
+	if cfg.NoBuiltins {
+		return
+	}
+	var f *elf.File
+	f, err = elf.Open(objFile)
+	if err != nil {
+		return
+	}
+	machine := f.Machine
+	syms, _ := f.Symbols()
+	f.Close()
+	var undefined bool
+	for _, sym := range syms {
+		if sym.Section == elf.SHN_UNDEF && sym.Name != "" {
+			undefined = true
+			break
+		}
+	}
+	if !undefined {
+		return
+	}
+
+	archive := cfg.BuiltinsArchive
+	if archive == "" {
+		archive, err = cc.BuiltinsArchive(machine)
+		if err != nil {
+			// no compiler, the builtins stay external.
+			fmt.Fprintf(os.Stderr, "warning: builtins: %s\n", err)
+			return objFile, nil
+		}
+		if archive == "" {
+			return
+		}
+	}
+	objTemp = path.Join(cfg.TempDir, "builtins.o")
+	err = runLd([]string{
+		"--relocatable",
+		"-o", objTemp,
+	}, []string{objFile, archive})
+	return
+}
+
+func runLd(args []string, files []string) (err error) {
+	var ins *ld.Ld
+	ins, err = ld.New(args, files)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ii64/golinker/conf"
+	"github.com/ii64/golinker/lib/cdecl"
+	"github.com/ii64/golinker/lib/obj"
+	"github.com/ii64/golinker/lib/stubgen"
+)
+
+// Stubgen writes the stub file for the prototypes of a C header.
+func Stubgen(cfg *conf.StubgenConfig) (err error) {
+	var bb []byte
+	bb, err = os.ReadFile(cfg.HeaderFile)
+	if err != nil {
+		return
+	}
+	var f *cdecl.File
+	f, err = cdecl.Parse(cfg.HeaderFile, string(bb), cfg.Arch)
+	if err != nil {
+		return
+	}
+	return writeStub(f, cfg.OutputFile, stubgen.Options{
+		Package: cfg.Package,
+		Source:  path.Base(cfg.HeaderFile),
+		Arch:    cfg.Arch,
+	})
+}
+
+// writeDWARFStub writes cfg.StubFile from the DWARF of the merged object.
+func writeDWARFStub(cfg *conf.Config, o *obj.Object) (err error) {
+	var arch string
+	switch o.Elf.Machine {
+	case elf.EM_X86_64:
+		arch = "amd64"
+	case elf.EM_AARCH64:
+		arch = "arm64"
+	default:
+		return fmt.Errorf("dwarfstub: arch is not supported: %s", o.Elf.Machine)
+	}
+	d, err := o.Elf.DWARF()
+	if err != nil {
+		return fmt.Errorf("dwarfstub: %w, build the objects with -g", err)
+	}
+	var names []string
+	for _, fn := range append(cfg.ObjFiles, cfg.ArFiles...) {
+		names = append(names, path.Base(fn))
+	}
+	// a stub written by hand is not overwritten, a generated one is.
+	if bb, errx := os.ReadFile(cfg.StubFile); errx == nil && !stubgen.IsGenerated(bb) {
+		return fmt.Errorf("dwarfstub: %s is not a generated stub, remove it or pass another -stub", cfg.StubFile)
+	}
+	var f *cdecl.File
+	f, err = cdecl.FromDWARF(d, strings.Join(names, ", "), arch)
+	if err != nil {
+		return
+	}
+	return writeStub(f, cfg.StubFile, stubgen.Options{
+		Package: conf.PackageName(cfg.OutputDir),
+		Source:  f.Name,
+		Arch:    arch,
+	})
+}
+
+// writeStub generates the stub of f to file, stdout if file is empty.
+func writeStub(f *cdecl.File, file string, opts stubgen.Options) (err error) {
+	var src []byte
+	var warnings []string
+	src, warnings, err = stubgen.Generate(f, opts)
+	if err != nil {
+		return
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+	if file == "" {
+		_, err = os.Stdout.Write(src)
+		return
+	}
+	err = os.WriteFile(file, src, 0644)
+	return
+}
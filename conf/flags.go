@@ -14,15 +14,23 @@ func (c *Config) FlagSet(name string, errorHandling flag.ErrorHandling) *flag.Fl
 	fs.StringVar(&c.StubFile, "stub", "", "Stub file holding func signature")
 
 	fs.StringVar(&c.ExtLD, "extld", getDefaultLD(), "External ld")
+	fs.StringVar(&c.CC, "cc", getDefaultCC(), "C compiler, asked for its builtins archive")
+	fs.StringVar(&c.BuiltinsArchive, "builtins", "", "Compiler builtins archive, found with -cc by default")
+	fs.BoolVar(&c.NoBuiltins, "nobuiltins", false, "Do not link the compiler builtins archive")
 
 	fs.StringVar(&c.NativeEntryName, "entryname", "__native_entry__", "Native entry name")
 
 	fs.BoolVar(&c.DropRawBytesX86, "rawbytes-x86", false, "Drop all x86 code as raw bytes")
 	fs.BoolVar(&c.RawBytesFallbackX86, "fallback-rawbytes-x86", false, "Drop raw bytes if instruction not found")
 	fs.BoolVar(&c.GenExternalSymStub, "extsymstub", false, "Generate external symbol stub")
+	fs.BoolVar(&c.DWARFStub, "dwarfstub", false, "Generate the stub file from DWARF debug info")
+	fs.Uint64Var(&c.NativeStackSize, "nativestack", DefaultNativeStackSize, "Stack size for //golinker:systemstack funcs")
+	fs.Uint64Var(&c.MallocArenaSize, "malloc", 0, "Arena size of the built-in malloc, 0 leaves malloc external")
+	fs.BoolVar(&c.DebugStdio, "debugstdio", false, "Link printf, puts and abort to Go, printing to stderr")
 
 	fs.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [flags] ...file.[ao]\n", name)
+		fmt.Fprintf(os.Stderr, "       %s stubgen [flags] file.h\n", name)
 	}
 	return fs
 }
@@ -34,3 +42,11 @@ func getDefaultLD() string {
 	}
 	return ld
 }
+
+func getDefaultCC() string {
+	cc := os.Getenv("CC")
+	if cc == "" {
+		return "cc"
+	}
+	return cc
+}
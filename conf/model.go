@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/ii64/golinker/lib/disasm2"
+	"github.com/ii64/golinker/lib/proc/cc"
 	"github.com/ii64/golinker/lib/proc/ld"
 )
 
@@ -21,6 +22,14 @@ type Config struct {
 	OutputDir    string
 
 	ExtLD string
+	// CC is the compiler asked for its builtins archive.
+	CC string
+
+	// BuiltinsArchive is the compiler builtins archive, libgcc or
+	// compiler-rt, found with CC when empty. Only the members defining
+	// undefined symbols are linked.
+	BuiltinsArchive string
+	NoBuiltins      bool
 
 	TempDir string
 
@@ -30,6 +39,21 @@ type Config struct {
 	RawBytesFallbackX86 bool
 	GenExternalSymStub  bool
 
+	// DWARFStub generates StubFile from the DWARF of the objects.
+	DWARFStub bool
+
+	// NativeStackSize is the size of the stacks //golinker:systemstack
+	// funcs run on.
+	NativeStackSize uint64
+
+	// MallocArenaSize is the size of the Go arena malloc, calloc,
+	// realloc and free are linked to, 0 leaves them external.
+	MallocArenaSize uint64
+
+	// DebugStdio links printf, puts, abort and friends to Go, printing
+	// to os.Stderr.
+	DebugStdio bool
+
 	fs *flag.FlagSet
 }
 
@@ -37,6 +61,17 @@ func Default() *Config {
 	return &Config{}
 }
 
+// DefaultNativeStackSize is the default NativeStackSize, the default
+// pthread stack size.
+const DefaultNativeStackSize = 8 << 20
+
+func (cfg *Config) GetNativeStackSize() uint64 {
+	if cfg.NativeStackSize == 0 {
+		return DefaultNativeStackSize
+	}
+	return cfg.NativeStackSize
+}
+
 func (cfg *Config) GetStubFileBasename() (basename string, ext string) {
 	stubFilename := path.Base(cfg.StubFile)
 	ext = path.Ext(stubFilename)
@@ -87,9 +122,22 @@ func (cfg *Config) Vaildate() error {
 		return fmt.Errorf("nothing to do")
 	}
 
+	if cfg.DWARFStub && cfg.StubFile == "" {
+		cfg.StubFile = path.Join(cfg.OutputDir, "stub.go")
+	}
+
 	if cfg.ExtLD != "" {
 		ld.DEFAULT_LD = cfg.ExtLD
 	}
+	if cfg.CC != "" {
+		cc.DEFAULT_CC = cfg.CC
+	}
+	if cfg.BuiltinsArchive != "" {
+		cfg.BuiltinsArchive = mustAbs(cfg.BuiltinsArchive)
+		if !validateFilePath(cfg.BuiltinsArchive) {
+			return fmt.Errorf("builtins archive %q is missing", cfg.BuiltinsArchive)
+		}
+	}
 
 	disasm2.X86JustWriteRawBytes = cfg.DropRawBytesX86
 	disasm2.X86RawBytesFallback = cfg.RawBytesFallbackX86
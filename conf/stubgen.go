@@ -0,0 +1,59 @@
+package conf
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+)
+
+// StubgenConfig is the config of the stubgen mode, generating the stub
+// file from a C header.
+type StubgenConfig struct {
+	HeaderFile string
+	// OutputFile is the stub file to write, stdout if empty.
+	OutputFile string
+	Package    string
+	Arch       string
+
+	fs *flag.FlagSet
+}
+
+func DefaultStubgen() *StubgenConfig {
+	return &StubgenConfig{}
+}
+
+func (c *StubgenConfig) FlagSet(name string, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, errorHandling)
+	c.fs = fs
+
+	fs.StringVar(&c.OutputFile, "out", "", "Output stub file, stdout if empty")
+	fs.StringVar(&c.Package, "pkg", "", "Go package name, the output directory name by default")
+	fs.StringVar(&c.Arch, "arch", "amd64", "Target arch, amd64 or arm64")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] file.h\n", name)
+	}
+	return fs
+}
+
+func (c *StubgenConfig) Vaildate() error {
+	args := c.fs.Args()
+	if len(args) != 1 {
+		return fmt.Errorf("want a single header file")
+	}
+	c.HeaderFile = args[0]
+	if !validateFilePath(mustAbs(c.HeaderFile)) {
+		return fmt.Errorf("file %q is missing", c.HeaderFile)
+	}
+	if c.Arch != "amd64" && c.Arch != "arm64" {
+		return fmt.Errorf("arch is not supported: %s", c.Arch)
+	}
+	if c.Package == "" {
+		c.Package = "stub"
+		if c.OutputFile != "" {
+			c.Package = PackageName(path.Dir(mustAbs(c.OutputFile)))
+		}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package conf
 import (
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 func mustAbs(p string) string {
@@ -23,3 +24,8 @@ func validateFilePath(p string) bool {
 	}
 	return true
 }
+
+// PackageName derives a Go package name from a directory.
+func PackageName(dir string) string {
+	return strings.NewReplacer("-", "_", ".", "_").Replace(filepath.Base(dir))
+}
@@ -2,14 +2,17 @@ module github.com/ii64/golinker
 
 go 1.18
 
+require (
+	github.com/knightsc/gapstone v4.0.1+incompatible
+	github.com/stretchr/testify v1.7.5
+	github.com/twitchyliquid64/golang-asm v0.15.1
+	golang.org/x/arch v0.0.0-20220412001346-fc48f9fe4c15
+	golang.org/x/exp v0.0.0-20220613132600-b0d781184e0d
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/knightsc/gapstone v4.0.1+incompatible // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.4.0 // indirect
-	github.com/stretchr/testify v1.7.5 // indirect
-	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
-	golang.org/x/arch v0.0.0-20220412001346-fc48f9fe4c15 // indirect
-	golang.org/x/exp v0.0.0-20220613132600-b0d781184e0d // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,118 @@
+package cdecl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDecls(t *testing.T) {
+	src := `#include <stdint.h>
+#define N 4
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+/* Vec holds N values.
+ * It is passed by pointer.
+ */
+struct vec {
+	char tag;
+	int64_t v[N * 2];
+	float f; // trailing
+} __attribute__((aligned(8)));
+
+typedef int (*cb_t)(void *ctx, const char *name);
+
+// sum adds up v.
+int64_t sum(const struct vec *v, unsigned n, cb_t cb);
+void fill(int rows[3][4], char *const argv[]);
+char *(*getter(void))(int);
+unsigned long long big(short s, long double d);
+int logf(const char *fmt, ...);
+static inline int one(void) { return 1; }
+
+#ifdef __cplusplus
+}
+#endif
+`
+	f, err := Parse("x.h", src, "amd64")
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.Len(t, f.Decls, 7) {
+		return
+	}
+
+	vec := f.Decls[0].(*TagDecl)
+	assert.Equal(t, []string{"Vec holds N values.", "It is passed by pointer."}, vec.Doc)
+	s := vec.Type.(*Struct)
+	assert.Equal(t, int64(80), s.Size())
+	assert.Equal(t, int64(8), s.Fields[1].Offset)
+	assert.Equal(t, Array{Elem: &Named{Name: "int64_t", Type: Int{Bytes: 8, Signed: true}, Builtin: true}, Len: 8}, s.Fields[1].Type)
+	assert.Equal(t, int64(72), s.Fields[2].Offset)
+
+	cb := f.Decls[1].(*TypedefDecl)
+	fn := cb.Type.Type.(Pointer).Elem.(*Func)
+	assert.Len(t, fn.Params, 2)
+	assert.Equal(t, Int{Bytes: 4, Signed: true}, fn.Result)
+
+	sum := f.Decls[2].(*FuncDecl)
+	assert.Equal(t, "sum", sum.Name)
+	assert.Equal(t, []string{"sum adds up v."}, sum.Doc)
+	assert.Equal(t, Pointer{Elem: s}, sum.Type.Params[0].Type)
+	assert.Equal(t, Int{Bytes: 4}, sum.Type.Params[1].Type)
+	assert.Equal(t, Pos{File: "x.h", Line: 20, Col: 1}, sum.Pos)
+
+	// arrays decay to pointers.
+	fill := f.Decls[3].(*FuncDecl)
+	assert.Equal(t, Pointer{Elem: Array{Elem: Int{Bytes: 4, Signed: true}, Len: 4}}, fill.Type.Params[0].Type)
+	assert.Equal(t, Pointer{Elem: Pointer{Elem: Int{Bytes: 1, Signed: true, Char: true}}}, fill.Type.Params[1].Type)
+
+	getter := f.Decls[4].(*FuncDecl)
+	assert.Empty(t, getter.Type.Params)
+	ret := getter.Type.Result.(Pointer).Elem.(*Func)
+	assert.Equal(t, Pointer{Elem: Int{Bytes: 1, Signed: true, Char: true}}, ret.Result)
+
+	big := f.Decls[5].(*FuncDecl)
+	assert.Equal(t, Int{Bytes: 8}, big.Type.Result)
+	assert.Equal(t, Int{Bytes: 2, Signed: true}, big.Type.Params[0].Type)
+	assert.IsType(t, Unsupported{}, big.Type.Params[1].Type)
+
+	assert.True(t, f.Decls[6].(*FuncDecl).Type.Variadic)
+	assert.Len(t, f.Warnings, 1)
+}
+
+func TestParseEnum(t *testing.T) {
+	f, err := Parse("x.h", `
+enum flags { A = 1 << 2, B, C = A | B, D = 'a', E = sizeof(long) };
+typedef enum { NEG = -1 } sign;
+typedef union { int i; double d; char c[12]; } u;
+`, "arm64")
+	if !assert.NoError(t, err) {
+		return
+	}
+	e := f.Decls[0].(*TagDecl).Type.(*Enum)
+	assert.Equal(t, []Enumerator{{"A", 4}, {"B", 5}, {"C", 5}, {"D", 97}, {"E", 8}}, e.Enumerators)
+	assert.False(t, e.Signed)
+	assert.True(t, f.Decls[2].(*TypedefDecl).Type.Type.(*Enum).Signed)
+
+	un := f.Decls[3].(*TagDecl).Type.(*Struct)
+	assert.Equal(t, int64(16), un.Size())
+	assert.Equal(t, int64(8), un.Align())
+}
+
+func TestParseError(t *testing.T) {
+	_, err := Parse("x.h", "int f(int a;\n", "amd64")
+	assert.EqualError(t, err, `x.h:1:12: expected ")", found ";"`)
+
+	_, err = Parse("x.h", "struct s { int a; };\nstruct s { int b; };\n", "amd64")
+	assert.EqualError(t, err, "x.h:2:1: struct s redefined")
+
+	_, err = Parse("x.h", "/* open", "amd64")
+	assert.EqualError(t, err, "x.h:1:1: comment not terminated")
+
+	_, err = Parse("x.h", "", "mips")
+	assert.Error(t, err)
+}
@@ -0,0 +1,309 @@
+package cdecl
+
+import (
+	"debug/dwarf"
+	"fmt"
+	"strings"
+)
+
+type dwarfReader struct {
+	d    *dwarf.Data
+	name string
+
+	charSigned bool
+	builtins   map[string]*Named
+
+	types    map[dwarf.Type]Type
+	tags     map[string]Type
+	typedefs map[string]*Named
+
+	file *File
+}
+
+// FromDWARF builds the declarations of the external functions defined
+// in d, with the structs, enums and typedefs their signatures use.
+// name is the object file name, used in positions.
+func FromDWARF(d *dwarf.Data, name, arch string) (f *File, err error) {
+	r := &dwarfReader{
+		d:        d,
+		name:     name,
+		builtins: builtinTypedefs(),
+		types:    map[dwarf.Type]Type{},
+		tags:     map[string]Type{},
+		typedefs: map[string]*Named{},
+		file:     &File{Name: name},
+	}
+	switch arch {
+	case "amd64":
+		r.charSigned = true
+	case "arm64":
+		r.charSigned = false
+	default:
+		err = fmt.Errorf("arch is not supported: %s", arch)
+		return
+	}
+
+	seen := map[string]bool{}
+	rd := d.Reader()
+	for {
+		var e *dwarf.Entry
+		e, err = rd.Next()
+		if err != nil {
+			return
+		}
+		if e == nil {
+			break
+		}
+		if e.Tag != dwarf.TagSubprogram {
+			continue
+		}
+		var fn *FuncDecl
+		fn, err = r.subprogram(rd, e)
+		if err != nil {
+			return
+		}
+		if fn == nil || seen[fn.Name] {
+			continue
+		}
+		seen[fn.Name] = true
+		r.file.Decls = append(r.file.Decls, fn)
+	}
+	f = r.file
+	return
+}
+
+// subprogram reads a function definition and its params, fn is nil for
+// declarations, inlined and static functions.
+func (r *dwarfReader) subprogram(rd *dwarf.Reader, e *dwarf.Entry) (fn *FuncDecl, err error) {
+	name, _ := e.Val(dwarf.AttrName).(string)
+	external, _ := e.Val(dwarf.AttrExternal).(bool)
+	declaration, _ := e.Val(dwarf.AttrDeclaration).(bool)
+	_, hasPC := e.Val(dwarf.AttrLowpc).(uint64)
+	defined := external && !declaration && hasPC && name != ""
+
+	ft := &Func{Result: Void{}}
+	if off, ok := e.Val(dwarf.AttrType).(dwarf.Offset); ok && defined {
+		ft.Result, err = r.typeAt(off)
+		if err != nil {
+			return
+		}
+	}
+	if e.Children {
+		for {
+			var c *dwarf.Entry
+			c, err = rd.Next()
+			if err != nil {
+				return
+			}
+			if c == nil || c.Tag == 0 {
+				break
+			}
+			if !defined {
+				if c.Children {
+					rd.SkipChildren()
+				}
+				continue
+			}
+			switch c.Tag {
+			case dwarf.TagFormalParameter:
+				pname, _ := c.Val(dwarf.AttrName).(string)
+				off, _ := c.Val(dwarf.AttrType).(dwarf.Offset)
+				var pt Type
+				pt, err = r.typeAt(off)
+				if err != nil {
+					return
+				}
+				ft.Params = append(ft.Params, Param{Name: pname, Type: pt})
+			case dwarf.TagUnspecifiedParameters:
+				ft.Variadic = true
+			}
+			if c.Children {
+				rd.SkipChildren()
+			}
+		}
+	}
+	if !defined {
+		return
+	}
+	fn = &FuncDecl{Name: name, Type: ft, Pos: r.pos()}
+	return
+}
+
+func (r *dwarfReader) pos() Pos {
+	return Pos{File: r.name}
+}
+
+func (r *dwarfReader) typeAt(off dwarf.Offset) (Type, error) {
+	dt, err := r.d.Type(off)
+	if err != nil {
+		return nil, err
+	}
+	return r.convert(dt)
+}
+
+// convert maps a DWARF type to the declaration model, the struct,
+// enum and typedef declarations are added on first use.
+func (r *dwarfReader) convert(dt dwarf.Type) (t Type, err error) {
+	// dwarf.Data hands out one dwarf.Type per offset.
+	if t, ok := r.types[dt]; ok {
+		return t, nil
+	}
+	defer func() {
+		if err == nil {
+			r.types[dt] = t
+		}
+	}()
+
+	switch dt := dt.(type) {
+	case *dwarf.VoidType:
+		return Void{}, nil
+	case *dwarf.QualType:
+		return r.convert(dt.Type)
+	case *dwarf.BoolType:
+		return Bool{}, nil
+	case *dwarf.CharType:
+		return r.intType(dt.Name, dt.ByteSize, true), nil
+	case *dwarf.UcharType:
+		return r.intType(dt.Name, dt.ByteSize, false), nil
+	case *dwarf.IntType:
+		return r.intType(dt.Name, dt.ByteSize, true), nil
+	case *dwarf.UintType:
+		return r.intType(dt.Name, dt.ByteSize, false), nil
+	case *dwarf.FloatType:
+		if dt.ByteSize != 4 && dt.ByteSize != 8 {
+			return Unsupported{Name: dt.Name, size: dt.ByteSize, align: 16}, nil
+		}
+		return Float{Bytes: dt.ByteSize}, nil
+	case *dwarf.PtrType:
+		if dt.Type == nil {
+			return Pointer{Elem: Void{}}, nil
+		}
+		// recursive structs point back at themselves.
+		p := Pointer{}
+		p.Elem, err = r.convert(dt.Type)
+		return p, err
+	case *dwarf.ArrayType:
+		var elem Type
+		elem, err = r.convert(dt.Type)
+		if err != nil {
+			return
+		}
+		n := dt.Count
+		if n < 0 {
+			n = 0
+		}
+		return Array{Elem: elem, Len: n}, nil
+	case *dwarf.FuncType:
+		fn := &Func{Variadic: true}
+		return fn, nil
+	case *dwarf.TypedefType:
+		return r.typedef(dt)
+	case *dwarf.StructType:
+		return r.structType(dt)
+	case *dwarf.EnumType:
+		return r.enumType(dt)
+	}
+	return Unsupported{Name: dt.String(), size: dt.Size(), align: 1}, nil
+}
+
+func (r *dwarfReader) intType(name string, size int64, signed bool) Type {
+	if size != 1 && size != 2 && size != 4 && size != 8 {
+		return Unsupported{Name: name, size: size, align: size}
+	}
+	if name == "char" {
+		return Int{Bytes: 1, Signed: r.charSigned, Char: true}
+	}
+	return Int{Bytes: size, Signed: signed}
+}
+
+func (r *dwarfReader) typedef(dt *dwarf.TypedefType) (Type, error) {
+	if b, ok := r.builtins[dt.Name]; ok && b.Size() == dt.Size() {
+		return b, nil
+	}
+	under, err := r.convert(dt.Type)
+	if err != nil {
+		return nil, err
+	}
+	// the libc internals behind the stdint.h types.
+	if strings.HasPrefix(dt.Name, "__") {
+		return under, nil
+	}
+	if n, ok := r.typedefs[dt.Name]; ok {
+		return n, nil
+	}
+	n := &Named{Name: dt.Name, Type: under}
+	r.typedefs[dt.Name] = n
+	r.file.Decls = append(r.file.Decls, &TypedefDecl{Type: n, Pos: r.pos()})
+	return n, nil
+}
+
+func (r *dwarfReader) structType(dt *dwarf.StructType) (Type, error) {
+	var s *Struct
+	if dt.StructName != "" {
+		prev, ok := r.tags[dt.StructName]
+		if ok {
+			if s, ok = prev.(*Struct); !ok {
+				return nil, fmt.Errorf("%s %s is also an enum", dt.Kind, dt.StructName)
+			}
+			if s.Complete || dt.Incomplete {
+				return s, nil
+			}
+		}
+	}
+	if s == nil {
+		s = &Struct{Tag: dt.StructName, Union: dt.Kind == "union"}
+		if s.Tag != "" {
+			r.tags[s.Tag] = s
+		}
+	}
+	// set before the fields, they may point back at s.
+	r.types[dt] = s
+	if dt.Incomplete {
+		return s, nil
+	}
+
+	s.Fields = []Field{}
+	for _, f := range dt.Field {
+		ft, err := r.convert(f.Type)
+		if err != nil {
+			return nil, err
+		}
+		if f.BitSize > 0 {
+			ft = Unsupported{Name: "bit-field " + f.Name, size: ft.Size(), align: ft.Align()}
+		}
+		s.Fields = append(s.Fields, Field{Name: f.Name, Type: ft, Offset: f.ByteOffset})
+	}
+	s.align = 1
+	for _, f := range s.Fields {
+		if a := f.Type.Align(); a > s.align {
+			s.align = a
+		}
+	}
+	s.size = dt.ByteSize
+	s.Complete = true
+	r.file.Decls = append(r.file.Decls, &TagDecl{Type: s, Pos: r.pos()})
+	return s, nil
+}
+
+func (r *dwarfReader) enumType(dt *dwarf.EnumType) (Type, error) {
+	if dt.EnumName != "" {
+		if prev, ok := r.tags[dt.EnumName]; ok {
+			return prev, nil
+		}
+	}
+	if dt.ByteSize != 4 {
+		return Unsupported{Name: "enum " + dt.EnumName, size: dt.ByteSize, align: dt.ByteSize}, nil
+	}
+	e := &Enum{Tag: dt.EnumName, Enumerators: []Enumerator{}}
+	for _, v := range dt.Val {
+		e.Enumerators = append(e.Enumerators, Enumerator{Name: v.Name, Value: v.Val})
+		if v.Val < 0 {
+			e.Signed = true
+		}
+	}
+	if e.Tag != "" {
+		r.tags[e.Tag] = e
+	}
+	r.file.Decls = append(r.file.Decls, &TagDecl{Type: e, Pos: r.pos()})
+	return e, nil
+}
@@ -0,0 +1,76 @@
+package cdecl
+
+import (
+	"debug/elf"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromDWARF(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "x.c")
+	obj := filepath.Join(dir, "x.o")
+	err = os.WriteFile(src, []byte(`#include <stdint.h>
+typedef struct node { struct node *next; int32_t val; } node_t;
+typedef enum { LO = -1, HI = 1 } level;
+struct opaque;
+static int helper(int x) { return x; }
+int64_t sum(const node_t *n, level l, struct opaque *o) { return helper(n->val) + l; }
+void put(const char *s, double d, ...) {}
+`), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+	out, err := exec.Command(cc, "-g", "-O2", "-c", src, "-o", obj).CombinedOutput()
+	if !assert.NoError(t, err, string(out)) {
+		return
+	}
+	e, err := elf.Open(obj)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer e.Close()
+	d, err := e.DWARF()
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := FromDWARF(d, "x.o", "amd64")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	fns := map[string]*FuncDecl{}
+	for _, d := range f.Decls {
+		if fn, ok := d.(*FuncDecl); ok {
+			fns[fn.Name] = fn
+		}
+	}
+	assert.NotContains(t, fns, "helper")
+	sum := fns["sum"]
+	if !assert.NotNil(t, sum) {
+		return
+	}
+	assert.Equal(t, Int{Bytes: 8, Signed: true}, Underlying(sum.Type.Result))
+	assert.Equal(t, "n", sum.Type.Params[0].Name)
+
+	nodeT := sum.Type.Params[0].Type.(Pointer).Elem.(*Named)
+	assert.Equal(t, "node_t", nodeT.Name)
+	node := nodeT.Type.(*Struct)
+	assert.Equal(t, "node", node.Tag)
+	assert.Equal(t, Pointer{Elem: node}, node.Fields[0].Type)
+	assert.Equal(t, int64(8), node.Fields[1].Offset)
+	assert.Equal(t, int64(16), node.Size())
+
+	assert.True(t, Underlying(sum.Type.Params[1].Type).(*Enum).Signed)
+	assert.False(t, sum.Type.Params[2].Type.(Pointer).Elem.(*Struct).Complete)
+
+	assert.True(t, fns["put"].Type.Variadic)
+}
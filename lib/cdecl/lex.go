@@ -0,0 +1,255 @@
+package cdecl
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokKind uint8
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokChar
+	tokPunct
+)
+
+type token struct {
+	kind tokKind
+	text string
+	line int
+	col  int
+	// doc is the comment group right above the token.
+	doc []string
+}
+
+type lexer struct {
+	name string
+	src  string
+	off  int
+	line int
+	col  int
+
+	toks []token
+	// defines holds the object-like macros, for constant expressions.
+	defines map[string]string
+
+	// the comment group not attached to a token yet.
+	pending    []string
+	pendingEnd int
+}
+
+var puncts3 = []string{"...", "<<=", ">>="}
+var puncts2 = []string{"<<", ">>", "&&", "||", "==", "!=", "<=", ">=", "->", "++", "--"}
+
+func lex(name, src string) (toks []token, defines map[string]string, err error) {
+	l := &lexer{name: name, src: src, line: 1, col: 1, defines: map[string]string{}}
+	err = l.run()
+	toks = l.toks
+	defines = l.defines
+	return
+}
+
+// define records an object-like #define, function-like macros are
+// skipped.
+func (l *lexer) define(line string) {
+	line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+	if !strings.HasPrefix(line, "define") {
+		return
+	}
+	line = strings.TrimLeft(line[len("define"):], " \t")
+	n := 0
+	for n < len(line) && isIdentChar(line[n]) {
+		n++
+	}
+	if n == 0 || (n < len(line) && line[n] == '(') {
+		return
+	}
+	body := strings.ReplaceAll(line[n:], "\\\n", " ")
+	if i := strings.Index(body, "//"); i >= 0 {
+		body = body[:i]
+	}
+	l.defines[line[:n]] = strings.TrimSpace(body)
+}
+
+func (l *lexer) errorf(line, col int, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d:%d: %s", l.name, line, col, fmt.Sprintf(format, args...))
+}
+
+func (l *lexer) advance(n int) {
+	for i := 0; i < n; i++ {
+		if l.src[l.off] == '\n' {
+			l.line++
+			l.col = 1
+		} else {
+			l.col++
+		}
+		l.off++
+	}
+}
+
+func (l *lexer) addComment(text []string, startLine int) {
+	// a comment trailing a token documents that line, not the next one.
+	if n := len(l.toks); n > 0 && l.toks[n-1].line == startLine {
+		return
+	}
+	if l.pending != nil && startLine > l.pendingEnd+1 {
+		l.pending = nil
+	}
+	l.pending = append(l.pending, text...)
+	l.pendingEnd = l.line
+}
+
+func (l *lexer) emit(kind tokKind, text string, line, col int) {
+	t := token{kind: kind, text: text, line: line, col: col}
+	if l.pending != nil && l.pendingEnd >= line-1 {
+		t.doc = l.pending
+	}
+	l.pending = nil
+	l.toks = append(l.toks, t)
+}
+
+func (l *lexer) run() error {
+	atLineStart := true
+	for l.off < len(l.src) {
+		c := l.src[l.off]
+		rest := l.src[l.off:]
+		line, col := l.line, l.col
+		switch {
+		case c == '\n':
+			atLineStart = true
+			l.advance(1)
+			continue
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			l.advance(1)
+			continue
+		case c == '#' && atLineStart:
+			// preprocessor lines are skipped, with their continuations.
+			n := 0
+			for n < len(rest) && rest[n] != '\n' {
+				if rest[n] == '\\' && n+1 < len(rest) && rest[n+1] == '\n' {
+					n++
+				}
+				n++
+			}
+			l.define(rest[:n])
+			l.advance(n)
+			l.pending = nil
+			continue
+		case strings.HasPrefix(rest, "//"):
+			n := strings.IndexByte(rest, '\n')
+			if n < 0 {
+				n = len(rest)
+			}
+			text := strings.TrimPrefix(rest[2:n], " ")
+			l.advance(n)
+			l.addComment(commentLines(text), line)
+			continue
+		case strings.HasPrefix(rest, "/*"):
+			n := strings.Index(rest[2:], "*/")
+			if n < 0 {
+				return l.errorf(line, col, "comment not terminated")
+			}
+			text := rest[2 : n+2]
+			l.advance(n + 4)
+			l.addComment(blockCommentLines(text), line)
+			continue
+		}
+		atLineStart = false
+
+		switch {
+		case isIdentStart(c):
+			n := 1
+			for n < len(rest) && isIdentChar(rest[n]) {
+				n++
+			}
+			l.emit(tokIdent, rest[:n], line, col)
+			l.advance(n)
+		case isDigit(c) || (c == '.' && len(rest) > 1 && isDigit(rest[1])):
+			n := 1
+			for n < len(rest) && (isIdentChar(rest[n]) || rest[n] == '.') {
+				n++
+			}
+			l.emit(tokNumber, rest[:n], line, col)
+			l.advance(n)
+		case c == '"' || c == '\'':
+			n := 1
+			for n < len(rest) && rest[n] != c {
+				if rest[n] == '\\' {
+					n++
+				}
+				if n < len(rest) && rest[n] == '\n' {
+					return l.errorf(line, col, "literal not terminated")
+				}
+				n++
+			}
+			if n >= len(rest) {
+				return l.errorf(line, col, "literal not terminated")
+			}
+			kind := tokString
+			if c == '\'' {
+				kind = tokChar
+			}
+			l.emit(kind, rest[:n+1], line, col)
+			l.advance(n + 1)
+		default:
+			n := 1
+			for _, p := range puncts3 {
+				if strings.HasPrefix(rest, p) {
+					n = 3
+				}
+			}
+			if n == 1 {
+				for _, p := range puncts2 {
+					if strings.HasPrefix(rest, p) {
+						n = 2
+					}
+				}
+			}
+			l.emit(tokPunct, rest[:n], line, col)
+			l.advance(n)
+		}
+	}
+	l.emit(tokEOF, "", l.line, l.col)
+	return nil
+}
+
+func commentLines(text string) []string {
+	return []string{strings.TrimRight(text, " \t\r")}
+}
+
+// blockCommentLines strips the leading " * " of a block comment.
+func blockCommentLines(text string) (lines []string) {
+	for _, ln := range strings.Split(text, "\n") {
+		ln = strings.TrimRight(ln, " \t\r")
+		t := strings.TrimLeft(ln, " \t")
+		if strings.HasPrefix(t, "*") {
+			ln = strings.TrimPrefix(strings.TrimPrefix(t, "*"), " ")
+		} else {
+			ln = strings.TrimPrefix(ln, " ")
+		}
+		lines = append(lines, ln)
+	}
+	// drop the blank lines of /*\n ... \n */
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,797 @@
+package cdecl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Pos is a position in the parsed header.
+type Pos struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p Pos) String() string {
+	if p.Line == 0 {
+		return p.File
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+type Decl interface {
+	Position() Pos
+}
+
+// FuncDecl is a function prototype.
+type FuncDecl struct {
+	Name string
+	Type *Func
+	Doc  []string
+	Pos  Pos
+}
+
+// TypedefDecl declares Type.Name as Type.Type.
+type TypedefDecl struct {
+	Type *Named
+	Doc  []string
+	Pos  Pos
+}
+
+// TagDecl is a struct, union or enum definition, Type is a *Struct or
+// an *Enum.
+type TagDecl struct {
+	Type Type
+	Doc  []string
+	Pos  Pos
+}
+
+func (d *FuncDecl) Position() Pos    { return d.Pos }
+func (d *TypedefDecl) Position() Pos { return d.Pos }
+func (d *TagDecl) Position() Pos     { return d.Pos }
+
+// File is a parsed C header, the declarations are in source order.
+type File struct {
+	Name  string
+	Decls []Decl
+	// Warnings lists the declarations that were skipped.
+	Warnings []string
+}
+
+type parser struct {
+	name string
+	toks []token
+	pos  int
+
+	charSigned bool
+
+	typedefs map[string]*Named
+	tags     map[string]Type
+	consts   map[string]int64
+	defines  map[string]string
+	// macros being expanded, to stop self reference.
+	expanding map[string]bool
+
+	file *File
+}
+
+type parseError struct {
+	err error
+}
+
+// Parse parses the function prototypes and type declarations of a C
+// header. Preprocessor lines are ignored, the header is expected to
+// include only the standard headers for its types.
+func Parse(name, src, arch string) (f *File, err error) {
+	p := &parser{
+		name:     name,
+		typedefs: builtinTypedefs(),
+		tags:     map[string]Type{},
+		consts:   map[string]int64{},
+		file:     &File{Name: name},
+
+		expanding: map[string]bool{},
+	}
+	switch arch {
+	case "amd64":
+		p.charSigned = true
+	case "arm64":
+		p.charSigned = false
+	default:
+		err = fmt.Errorf("arch is not supported: %s", arch)
+		return
+	}
+	p.toks, p.defines, err = lex(name, src)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			pe, ok := r.(parseError)
+			if !ok {
+				panic(r)
+			}
+			err = pe.err
+		}
+	}()
+	for p.peek().kind != tokEOF {
+		p.parseTop()
+	}
+	f = p.file
+	return
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) peekN(n int) token {
+	if p.pos+n >= len(p.toks) {
+		return p.toks[len(p.toks)-1]
+	}
+	return p.toks[p.pos+n]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) position(t token) Pos {
+	return Pos{File: p.name, Line: t.line, Col: t.col}
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) {
+	panic(parseError{fmt.Errorf("%s: %s", p.position(t), fmt.Sprintf(format, args...))})
+}
+
+func (p *parser) warnf(t token, format string, args ...interface{}) {
+	p.file.Warnings = append(p.file.Warnings,
+		fmt.Sprintf("%s: %s", p.position(t), fmt.Sprintf(format, args...)))
+}
+
+func (p *parser) is(text string) bool {
+	t := p.peek()
+	return t.kind != tokString && t.kind != tokChar && t.text == text
+}
+
+func (p *parser) accept(text string) bool {
+	if p.is(text) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) {
+	if !p.accept(text) {
+		t := p.peek()
+		if t.kind == tokEOF {
+			p.errorf(t, "expected %q, found EOF", text)
+		}
+		p.errorf(t, "expected %q, found %q", text, t.text)
+	}
+}
+
+// skipBalanced skips a parenthesized or braced group, the opening
+// token must be the next one.
+func (p *parser) skipBalanced() {
+	open := p.next()
+	depth := 1
+	for depth > 0 {
+		t := p.next()
+		switch {
+		case t.kind == tokEOF:
+			p.errorf(open, "%q is not closed", open.text)
+		case t.kind != tokPunct:
+		case t.text == "(" || t.text == "{" || t.text == "[":
+			depth++
+		case t.text == ")" || t.text == "}" || t.text == "]":
+			depth--
+		}
+	}
+}
+
+var qualifiers = map[string]bool{
+	"const": true, "volatile": true, "restrict": true, "_Atomic": true,
+	"__const": true, "__volatile__": true, "__restrict": true, "__restrict__": true,
+	"_Noreturn": true, "__extension__": true, "_Nonnull": true, "_Nullable": true,
+}
+
+var attributes = map[string]bool{
+	"__attribute__": true, "__attribute": true, "__declspec": true,
+	"__asm__": true, "__asm": true, "asm": true, "_Alignas": true,
+}
+
+// skipQualifiers skips type qualifiers and attributes.
+func (p *parser) skipQualifiers() {
+	for {
+		t := p.peek()
+		switch {
+		case t.kind != tokIdent:
+			return
+		case qualifiers[t.text]:
+			p.next()
+		case attributes[t.text]:
+			p.next()
+			if p.is("(") {
+				p.skipBalanced()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// macros commonly found around declarations.
+var ignoredIdents = map[string]bool{
+	"__BEGIN_DECLS": true, "__END_DECLS": true,
+}
+
+func (p *parser) parseTop() {
+	switch t := p.peek(); {
+	case p.accept(";"), p.accept("}"):
+	case ignoredIdents[t.text] && t.kind == tokIdent:
+		p.next()
+	case t.text == "extern" && p.peekN(1).kind == tokString:
+		// extern "C" { ... }
+		p.next()
+		p.next()
+		p.accept("{")
+	default:
+		p.parseDecl()
+	}
+}
+
+type declSpec struct {
+	base    Type
+	typedef bool
+	static  bool
+	inline  bool
+	// defined is the struct, union or enum defined by the specifiers.
+	defined Type
+}
+
+var basicKeywords = map[string]bool{
+	"void": true, "char": true, "short": true, "int": true, "long": true,
+	"signed": true, "unsigned": true, "float": true, "double": true,
+	"_Bool": true, "__int128": true, "_Complex": true, "__signed__": true,
+}
+
+func (p *parser) isTypeName(t token) bool {
+	if t.kind != tokIdent {
+		return false
+	}
+	_, ok := p.typedefs[t.text]
+	return ok || basicKeywords[t.text] || qualifiers[t.text] ||
+		t.text == "struct" || t.text == "union" || t.text == "enum"
+}
+
+func (p *parser) declSpec() (s declSpec) {
+	start := p.peek()
+	kw := map[string]int{}
+	nkw := 0
+loop:
+	for {
+		t := p.peek()
+		if t.kind != tokIdent {
+			break
+		}
+		switch {
+		case t.text == "typedef":
+			s.typedef = true
+		case t.text == "static":
+			s.static = true
+		case t.text == "inline" || t.text == "__inline" || t.text == "__inline__":
+			s.inline = true
+		case t.text == "extern" || t.text == "register" || t.text == "auto" ||
+			t.text == "_Thread_local" || t.text == "__thread":
+		case qualifiers[t.text] || attributes[t.text]:
+			p.skipQualifiers()
+			continue
+		case basicKeywords[t.text]:
+			kw[t.text]++
+			nkw++
+		case t.text == "struct" || t.text == "union" || t.text == "enum":
+			if s.base != nil || nkw > 0 {
+				p.errorf(t, "unexpected %s", t.text)
+			}
+			s.base, s.defined = p.tagType()
+			continue
+		default:
+			n, ok := p.typedefs[t.text]
+			if !ok || s.base != nil || nkw > 0 {
+				break loop
+			}
+			s.base = n
+		}
+		p.next()
+	}
+	if nkw > 0 {
+		if s.base != nil {
+			p.errorf(start, "conflicting type specifiers")
+		}
+		s.base = p.basicType(kw)
+	}
+	if s.base == nil {
+		p.errorf(p.peek(), "expected a type, found %q", p.peek().text)
+	}
+	return
+}
+
+func (p *parser) basicType(kw map[string]int) Type {
+	signed := kw["unsigned"] == 0
+	switch {
+	case kw["void"] > 0:
+		return Void{}
+	case kw["_Bool"] > 0:
+		return Bool{}
+	case kw["_Complex"] > 0:
+		return Unsupported{Name: "_Complex", size: 16, align: 8}
+	case kw["__int128"] > 0:
+		return Unsupported{Name: "__int128", size: 16, align: 16}
+	case kw["float"] > 0:
+		return Float{Bytes: 4}
+	case kw["double"] > 0 && kw["long"] > 0:
+		return Unsupported{Name: "long double", size: 16, align: 16}
+	case kw["double"] > 0:
+		return Float{Bytes: 8}
+	case kw["char"] > 0:
+		if kw["signed"] == 0 && kw["__signed__"] == 0 && kw["unsigned"] == 0 {
+			return Int{Bytes: 1, Signed: p.charSigned, Char: true}
+		}
+		return Int{Bytes: 1, Signed: signed}
+	case kw["short"] > 0:
+		return Int{Bytes: 2, Signed: signed}
+	case kw["long"] > 0:
+		return Int{Bytes: 8, Signed: signed}
+	}
+	return Int{Bytes: 4, Signed: signed}
+}
+
+// tagType parses a struct, union or enum specifier, defined is set if
+// it has a body.
+func (p *parser) tagType() (t Type, defined Type) {
+	kwTok := p.next()
+	kw := kwTok.text
+	p.skipQualifiers()
+	tag := ""
+	if p.peek().kind == tokIdent {
+		tag = p.next().text
+	}
+	p.skipQualifiers()
+	hasBody := p.is("{")
+	if tag == "" && !hasBody {
+		p.errorf(kwTok, "%s without a tag or a body", kw)
+	}
+
+	if kw == "enum" {
+		var e *Enum
+		if prev, ok := p.tags[tag]; ok && tag != "" {
+			if e, ok = prev.(*Enum); !ok {
+				p.errorf(kwTok, "%s is not an enum", tag)
+			}
+		} else {
+			e = &Enum{Tag: tag}
+			if tag != "" {
+				p.tags[tag] = e
+			}
+		}
+		if hasBody {
+			if e.Enumerators != nil {
+				p.errorf(kwTok, "enum %s redefined", tag)
+			}
+			p.enumBody(e)
+			defined = e
+		}
+		t = e
+		return
+	}
+
+	var s *Struct
+	if prev, ok := p.tags[tag]; ok && tag != "" {
+		if s, ok = prev.(*Struct); !ok || s.Union != (kw == "union") {
+			p.errorf(kwTok, "%s is not a %s", tag, kw)
+		}
+	} else {
+		s = &Struct{Tag: tag, Union: kw == "union"}
+		if tag != "" {
+			p.tags[tag] = s
+		}
+	}
+	if hasBody {
+		if s.Complete {
+			p.errorf(kwTok, "%s %s redefined", kw, tag)
+		}
+		p.structBody(s)
+		defined = s
+	}
+	t = s
+	p.skipQualifiers()
+	return
+}
+
+func (p *parser) structBody(s *Struct) {
+	p.expect("{")
+	s.Fields = []Field{}
+	for !p.accept("}") {
+		spec := p.declSpec()
+		if p.accept(";") {
+			// anonymous struct or union member.
+			s.Fields = append(s.Fields, Field{Type: spec.base})
+			continue
+		}
+		for {
+			nameTok := p.peek()
+			name, wrap := p.declarator()
+			ft := wrap(spec.base)
+			if p.accept(":") {
+				p.constExpr()
+				ft = Unsupported{Name: "bit-field " + name, size: ft.Size(), align: ft.Align()}
+			}
+			if _, ok := ft.(*Func); ok {
+				p.errorf(nameTok, "field %s has a function type", name)
+			}
+			s.Fields = append(s.Fields, Field{Name: name, Type: ft})
+			if p.accept(",") {
+				continue
+			}
+			p.expect(";")
+			break
+		}
+	}
+	s.layout()
+}
+
+func (p *parser) enumBody(e *Enum) {
+	p.expect("{")
+	e.Enumerators = []Enumerator{}
+	var v int64
+	for !p.accept("}") {
+		t := p.next()
+		if t.kind != tokIdent {
+			p.errorf(t, "expected an enumerator, found %q", t.text)
+		}
+		p.skipQualifiers()
+		if p.accept("=") {
+			v = p.constExpr()
+		}
+		if v < 0 {
+			e.Signed = true
+		}
+		p.consts[t.text] = v
+		e.Enumerators = append(e.Enumerators, Enumerator{Name: t.text, Value: v})
+		v++
+		if !p.accept(",") {
+			p.expect("}")
+			break
+		}
+	}
+}
+
+// declarator parses a possibly abstract declarator, wrap builds the
+// declared type from the base type.
+func (p *parser) declarator() (name string, wrap func(Type) Type) {
+	nptr := 0
+	p.skipQualifiers()
+	for p.accept("*") {
+		nptr++
+		p.skipQualifiers()
+	}
+	inner := func(t Type) Type { return t }
+	switch t := p.peek(); {
+	case p.is("(") && p.nestedDeclarator():
+		p.next()
+		name, inner = p.declarator()
+		p.expect(")")
+	case t.kind == tokIdent && !p.isTypeName(t):
+		name = p.next().text
+	}
+	p.skipQualifiers()
+
+	var suffixes []func(Type) Type
+	for {
+		if p.accept("[") {
+			p.skipQualifiers()
+			p.accept("static")
+			var n int64
+			if !p.accept("]") {
+				n = p.constExpr()
+				p.expect("]")
+			}
+			suffixes = append(suffixes, func(t Type) Type {
+				return Array{Elem: t, Len: n}
+			})
+			continue
+		}
+		if p.accept("(") {
+			fn := p.params()
+			suffixes = append(suffixes, func(t Type) Type {
+				f := *fn
+				f.Result = t
+				return &f
+			})
+			continue
+		}
+		break
+	}
+	p.skipQualifiers()
+
+	wrap = func(t Type) Type {
+		for i := 0; i < nptr; i++ {
+			t = Pointer{Elem: t}
+		}
+		for i := len(suffixes) - 1; i >= 0; i-- {
+			t = suffixes[i](t)
+		}
+		return inner(t)
+	}
+	return
+}
+
+// nestedDeclarator reports whether the "(" ahead opens a nested
+// declarator rather than a parameter list.
+func (p *parser) nestedDeclarator() bool {
+	t := p.peekN(1)
+	switch {
+	case t.text == "*" || t.text == "^" || t.text == "(":
+		return true
+	case t.kind == tokIdent:
+		return !p.isTypeName(t) && !attributes[t.text]
+	}
+	return false
+}
+
+// params parses a parameter list, the "(" is already consumed.
+func (p *parser) params() *Func {
+	fn := &Func{}
+	if p.accept(")") {
+		return fn
+	}
+	if p.is("void") && p.peekN(1).text == ")" {
+		p.next()
+		p.next()
+		return fn
+	}
+	for {
+		if p.accept("...") {
+			fn.Variadic = true
+			p.expect(")")
+			return fn
+		}
+		spec := p.declSpec()
+		name, wrap := p.declarator()
+		t := wrap(spec.base)
+		// arrays and functions decay to pointers.
+		switch u := t.(type) {
+		case Array:
+			t = Pointer{Elem: u.Elem}
+		case *Func:
+			t = Pointer{Elem: u}
+		}
+		fn.Params = append(fn.Params, Param{Name: name, Type: t})
+		if p.accept(",") {
+			continue
+		}
+		p.expect(")")
+		return fn
+	}
+}
+
+func (p *parser) parseDecl() {
+	start := p.peek()
+	doc := start.doc
+	spec := p.declSpec()
+	pos := p.position(start)
+
+	if spec.defined != nil {
+		p.file.Decls = append(p.file.Decls, &TagDecl{Type: spec.defined, Doc: doc, Pos: pos})
+	}
+	if p.accept(";") {
+		return
+	}
+
+	for {
+		nameTok := p.peek()
+		name, wrap := p.declarator()
+		t := wrap(spec.base)
+		if name == "" {
+			p.errorf(nameTok, "expected a name, found %q", nameTok.text)
+		}
+		fn, isFunc := t.(*Func)
+		switch {
+		case spec.typedef:
+			n := &Named{Name: name, Type: t}
+			if prev, ok := p.typedefs[name]; ok && prev.Builtin {
+				// redeclared by the system headers, keep ours.
+				break
+			}
+			p.typedefs[name] = n
+			p.file.Decls = append(p.file.Decls, &TypedefDecl{Type: n, Doc: doc, Pos: pos})
+		case isFunc && (spec.static || spec.inline):
+			p.warnf(nameTok, "%s: static or inline function has no symbol, skipped", name)
+		case isFunc:
+			p.file.Decls = append(p.file.Decls, &FuncDecl{Name: name, Type: fn, Doc: doc, Pos: pos})
+		}
+		if p.is("=") {
+			p.errorf(p.peek(), "%s: initializers are not supported", name)
+		}
+		if p.accept(",") {
+			continue
+		}
+		if isFunc && p.is("{") {
+			p.skipBalanced()
+			return
+		}
+		p.expect(";")
+		return
+	}
+}
+
+// constExpr evaluates an integer constant expression.
+func (p *parser) constExpr() int64 {
+	return p.binaryExpr(0)
+}
+
+var binaryPrec = map[string]int{
+	"||": 1, "&&": 2, "|": 3, "^": 4, "&": 5,
+	"==": 6, "!=": 6, "<": 7, ">": 7, "<=": 7, ">=": 7,
+	"<<": 8, ">>": 8, "+": 9, "-": 9, "*": 10, "/": 10, "%": 10,
+}
+
+func (p *parser) binaryExpr(minPrec int) int64 {
+	x := p.unaryExpr()
+	for {
+		t := p.peek()
+		prec, ok := binaryPrec[t.text]
+		if t.kind != tokPunct || !ok || prec <= minPrec {
+			return x
+		}
+		p.next()
+		y := p.binaryExpr(prec)
+		b2i := func(b bool) int64 {
+			if b {
+				return 1
+			}
+			return 0
+		}
+		switch t.text {
+		case "||":
+			x = b2i(x != 0 || y != 0)
+		case "&&":
+			x = b2i(x != 0 && y != 0)
+		case "|":
+			x |= y
+		case "^":
+			x ^= y
+		case "&":
+			x &= y
+		case "==":
+			x = b2i(x == y)
+		case "!=":
+			x = b2i(x != y)
+		case "<":
+			x = b2i(x < y)
+		case ">":
+			x = b2i(x > y)
+		case "<=":
+			x = b2i(x <= y)
+		case ">=":
+			x = b2i(x >= y)
+		case "<<":
+			x <<= uint64(y)
+		case ">>":
+			x >>= uint64(y)
+		case "+":
+			x += y
+		case "-":
+			x -= y
+		case "*":
+			x *= y
+		case "/", "%":
+			if y == 0 {
+				p.errorf(t, "division by zero")
+			}
+			if t.text == "/" {
+				x /= y
+			} else {
+				x %= y
+			}
+		}
+	}
+}
+
+func (p *parser) unaryExpr() int64 {
+	t := p.next()
+	switch {
+	case t.text == "-" && t.kind == tokPunct:
+		return -p.unaryExpr()
+	case t.text == "+" && t.kind == tokPunct:
+		return p.unaryExpr()
+	case t.text == "~" && t.kind == tokPunct:
+		return ^p.unaryExpr()
+	case t.text == "!" && t.kind == tokPunct:
+		if p.unaryExpr() == 0 {
+			return 1
+		}
+		return 0
+	case t.text == "(" && t.kind == tokPunct:
+		if p.isTypeName(p.peek()) {
+			// a cast, the value is kept as is.
+			spec := p.declSpec()
+			_, wrap := p.declarator()
+			wrap(spec.base)
+			p.expect(")")
+			return p.unaryExpr()
+		}
+		v := p.constExpr()
+		p.expect(")")
+		return v
+	case t.text == "sizeof" && t.kind == tokIdent:
+		p.expect("(")
+		spec := p.declSpec()
+		_, wrap := p.declarator()
+		st := wrap(spec.base)
+		p.expect(")")
+		return st.Size()
+	case t.kind == tokNumber:
+		return p.number(t)
+	case t.kind == tokChar:
+		s, err := strconv.Unquote(t.text)
+		if err != nil || len(s) != 1 {
+			p.errorf(t, "invalid character constant %s", t.text)
+		}
+		return int64(s[0])
+	case t.kind == tokIdent:
+		if v, ok := p.consts[t.text]; ok {
+			return v
+		}
+		if body, ok := p.defines[t.text]; ok && !p.expanding[t.text] {
+			return p.macroValue(t, body)
+		}
+		p.errorf(t, "%s is not a constant", t.text)
+	}
+	p.errorf(t, "expected a constant, found %q", t.text)
+	return 0
+}
+
+func (p *parser) number(t token) int64 {
+	s := strings.TrimRight(t.text, "uUlL")
+	if len(s) > 1 && s[0] == '0' && s[1] >= '0' && s[1] <= '7' {
+		s = "0o" + s[1:]
+	}
+	v, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		p.errorf(t, "invalid integer constant %s", t.text)
+	}
+	return int64(v)
+}
+
+// macroValue evaluates the body of an object-like macro used in a
+// constant expression.
+func (p *parser) macroValue(t token, body string) int64 {
+	toks, _, err := lex(p.name, body)
+	if err != nil {
+		p.errorf(t, "%s: %s", t.text, err)
+	}
+	// report errors at the use.
+	for i := range toks {
+		toks[i].line, toks[i].col = t.line, t.col
+	}
+	saved, savedPos := p.toks, p.pos
+	p.toks, p.pos = toks, 0
+	p.expanding[t.text] = true
+	defer func() {
+		p.toks, p.pos = saved, savedPos
+		delete(p.expanding, t.text)
+	}()
+	v := p.constExpr()
+	if p.peek().kind != tokEOF {
+		p.errorf(t, "%s is not a constant", t.text)
+	}
+	return v
+}
@@ -0,0 +1,223 @@
+package cdecl
+
+import "fmt"
+
+// Type is a C type with its LP64 layout.
+type Type interface {
+	Size() int64
+	Align() int64
+	String() string
+}
+
+type Void struct{}
+
+func (Void) Size() int64    { return 0 }
+func (Void) Align() int64   { return 1 }
+func (Void) String() string { return "void" }
+
+type Bool struct{}
+
+func (Bool) Size() int64    { return 1 }
+func (Bool) Align() int64   { return 1 }
+func (Bool) String() string { return "_Bool" }
+
+// Int is an integer type, Char is set for plain char.
+type Int struct {
+	Bytes  int64
+	Signed bool
+	Char   bool
+}
+
+func (t Int) Size() int64  { return t.Bytes }
+func (t Int) Align() int64 { return t.Bytes }
+func (t Int) String() string {
+	s := "int"
+	if !t.Signed {
+		s = "uint"
+	}
+	return fmt.Sprintf("%s%d", s, t.Bytes*8)
+}
+
+type Float struct {
+	Bytes int64
+}
+
+func (t Float) Size() int64  { return t.Bytes }
+func (t Float) Align() int64 { return t.Bytes }
+func (t Float) String() string {
+	if t.Bytes == 4 {
+		return "float"
+	}
+	return "double"
+}
+
+type Pointer struct {
+	Elem Type
+}
+
+func (Pointer) Size() int64      { return 8 }
+func (Pointer) Align() int64     { return 8 }
+func (t Pointer) String() string { return t.Elem.String() + " *" }
+
+type Array struct {
+	Elem Type
+	Len  int64
+}
+
+func (t Array) Size() int64    { return t.Elem.Size() * t.Len }
+func (t Array) Align() int64   { return t.Elem.Align() }
+func (t Array) String() string { return fmt.Sprintf("%s [%d]", t.Elem, t.Len) }
+
+type Field struct {
+	Name   string
+	Type   Type
+	Offset int64
+}
+
+// Struct is a struct or union, Fields is nil until the definition is
+// seen.
+type Struct struct {
+	Tag      string
+	Union    bool
+	Complete bool
+	Fields   []Field
+
+	size, align int64
+}
+
+func (t *Struct) Size() int64 { return t.size }
+func (t *Struct) Align() int64 {
+	if t.align == 0 {
+		return 1
+	}
+	return t.align
+}
+func (t *Struct) String() string {
+	kw := "struct"
+	if t.Union {
+		kw = "union"
+	}
+	if t.Tag == "" {
+		return kw + " <anonymous>"
+	}
+	return kw + " " + t.Tag
+}
+
+// layout assigns the field offsets and the size of t.
+func (t *Struct) layout() {
+	var off int64
+	t.align = 1
+	for i := range t.Fields {
+		f := &t.Fields[i]
+		a := f.Type.Align()
+		if a > t.align {
+			t.align = a
+		}
+		if t.Union {
+			if f.Type.Size() > off {
+				off = f.Type.Size()
+			}
+			continue
+		}
+		off = alignUp(off, a)
+		f.Offset = off
+		off += f.Type.Size()
+	}
+	t.size = alignUp(off, t.align)
+	t.Complete = true
+}
+
+type Enumerator struct {
+	Name  string
+	Value int64
+}
+
+// Enum is an enum type, unsigned int unless an enumerator is negative,
+// as gcc and clang do.
+type Enum struct {
+	Tag         string
+	Enumerators []Enumerator
+	Signed      bool
+}
+
+func (t *Enum) Size() int64  { return 4 }
+func (t *Enum) Align() int64 { return 4 }
+func (t *Enum) String() string {
+	if t.Tag == "" {
+		return "enum <anonymous>"
+	}
+	return "enum " + t.Tag
+}
+
+type Param struct {
+	Name string
+	Type Type
+}
+
+type Func struct {
+	Params   []Param
+	Result   Type
+	Variadic bool
+}
+
+func (*Func) Size() int64    { return 1 }
+func (*Func) Align() int64   { return 1 }
+func (*Func) String() string { return "func" }
+
+// Named is a reference to a typedef.
+type Named struct {
+	Name string
+	Type Type
+	// Builtin is set for the stdint.h, stddef.h and stdbool.h types.
+	Builtin bool
+}
+
+func (t *Named) Size() int64    { return t.Type.Size() }
+func (t *Named) Align() int64   { return t.Type.Align() }
+func (t *Named) String() string { return t.Name }
+
+// Unsupported is a type golinker cannot pass, such as long double.
+type Unsupported struct {
+	Name        string
+	size, align int64
+}
+
+func (t Unsupported) Size() int64    { return t.size }
+func (t Unsupported) Align() int64   { return t.align }
+func (t Unsupported) String() string { return t.Name }
+
+// Underlying resolves typedefs.
+func Underlying(t Type) Type {
+	for {
+		n, ok := t.(*Named)
+		if !ok {
+			return t
+		}
+		t = n.Type
+	}
+}
+
+func alignUp(n, a int64) int64 {
+	return (n + a - 1) / a * a
+}
+
+func builtinTypedefs() map[string]*Named {
+	m := map[string]*Named{}
+	add := func(name string, t Type) {
+		m[name] = &Named{Name: name, Type: t, Builtin: true}
+	}
+	for _, n := range []int64{1, 2, 4, 8} {
+		add(fmt.Sprintf("int%d_t", n*8), Int{Bytes: n, Signed: true})
+		add(fmt.Sprintf("uint%d_t", n*8), Int{Bytes: n})
+	}
+	add("intptr_t", Int{Bytes: 8, Signed: true})
+	add("uintptr_t", Int{Bytes: 8})
+	add("intmax_t", Int{Bytes: 8, Signed: true})
+	add("uintmax_t", Int{Bytes: 8})
+	add("size_t", Int{Bytes: 8})
+	add("ssize_t", Int{Bytes: 8, Signed: true})
+	add("ptrdiff_t", Int{Bytes: 8, Signed: true})
+	add("off_t", Int{Bytes: 8, Signed: true})
+	add("bool", Bool{})
+	return m
+}
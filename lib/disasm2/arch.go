@@ -1,3 +1,18 @@
 package disasm2
 
 type SymLookup func(addr uint64) (name string, base uint64)
+
+// StackFrame is the stack use of one native function, its callees
+// excluded.
+type StackFrame struct {
+	// Size is the most SP goes below the entry SP, pushes and the red
+	// zone included, the return address of the caller excluded.
+	Size uint64
+	// Calls are the direct call targets.
+	Calls []uint64
+	// TailCalls are the targets of jumps out of the function.
+	TailCalls []uint64
+	// Unbounded tells why Size is not a bound, such as a dynamic SP
+	// decrement or a stack probe loop, empty if it is.
+	Unbounded string
+}
@@ -41,14 +41,19 @@ var (
 		"JNS": true,
 		"JB":  true,
 		"JCS": true,
+		"JO":  true,
+		"JNO": true,
+		"JP":  true,
+		"JNP": true,
+
+		"JCXZL": true,
+		"JCXZQ": true,
 
 		"CALL": true,
 	}
 	x86DisallowedInstruction = map[string]bool{
 		"SYSCALL": true,
 
-		"IMULQ": true,
-		"IMULL": true,
 		"PUSHQ": true,
 		"POPQ":  true,
 
@@ -57,18 +62,20 @@ var (
 		"ANDL": true,
 
 		"NOPW": true, "NOPL": true, "NOP": true,
+
+		// Go has no mnemonic for these.
+		"ENDBR64": true, "ENDBR32": true, "INT3": true,
+		"NOTRACK": true, "BND": true,
+	}
+	// x86StackPop are the mnemonics popping off the stack, popcnt and
+	// the like are not.
+	x86StackPop = map[string]bool{
+		"pop": true, "popw": true, "popl": true, "popq": true,
+		"popf": true, "popfw": true, "popfl": true, "popfq": true,
 	}
 	x86DisallowedRegisterOperand = map[string]bool{
 		"RIP": true, "EIP": true, "IP": true,
 	}
-
-	x86MnemonicReplace = map[string]string{
-		// "MOVZBL": "MOVBLZX",
-		// "MOVABSL": "",
-
-		"RETQ":  "RET",
-		"CALLQ": "CALL",
-	}
 )
 
 type archX86 struct {
@@ -143,127 +150,156 @@ func (m archX86) Nop(sz int) []byte {
 	return b
 }
 
-func (m archX86) StackSize(insts []gs.Instruction) uint64 {
-	switch m.mode {
-	case 64:
-		alloc, access := m.stackSizeAMD64(insts)
-		if alloc > access {
-			return alloc
+// StackFrame computes the stack use of a function. Every push and SP
+// decrement is counted, a pop or an add does not give the space back as
+// it may be on another path, so Size is a bound unless the function
+// loops over pushes. A register indirect jump is taken for a jump table.
+func (m archX86) StackFrame(insts []gs.Instruction) (f StackFrame) {
+	if len(insts) == 0 {
+		return
+	}
+	start := uint64(insts[0].Address)
+	last := insts[len(insts)-1]
+	end := uint64(last.Address) + uint64(last.Size)
+	word := uint64(m.mode / 8)
+
+	unbounded := func(inst gs.Instruction, why string) {
+		if f.Unbounded == "" {
+			f.Unbounded = fmt.Sprintf("%s at %#x: %s %s", why, inst.Address, inst.Mnemonic, inst.OpStr)
 		}
-		return access
 	}
-	panic("not implemented")
-}
-
-func (m archX86) stackSizeAMD64(insts []gs.Instruction) (alloc, access uint64) {
-	var allocMax uint64
-	var accessMax uint64
+	var grow, redZone uint64
 	for _, inst := range insts {
-		for _, opr := range inst.X86.Operands {
-
-			// count operation on SP/BP
-			if opr.Type == gs.X86_OP_REG {
-				reg := m.fmtRegToGroup(inst, opr.Reg)
-				mn := m.cvtMnemonic(inst.Mnemonic)
-				if reg != "SP" {
-					continue
-				}
-				// sub $imm, %rsp
-				if strings.HasPrefix(mn, "SUB") {
-					// find imm opr
-					for _, opr := range inst.X86.Operands {
-						if opr.Type == gs.X86_OP_IMM {
-							if opr.Imm > int64(allocMax) { // must be positive
-								allocMax = uint64(opr.Imm)
-							}
-						}
-					}
-				}
+		mn := strings.ToLower(inst.Mnemonic)
+		ops := inst.X86.Operands
+		switch {
+		case x86HasGroup(inst, gs.X86_GRP_CALL):
+			if target, ok := x86BranchTarget(inst); ok {
+				f.Calls = append(f.Calls, target)
+			} else {
+				unbounded(inst, "indirect call")
 			}
+			continue
+		case x86HasGroup(inst, gs.X86_GRP_JUMP):
+			target, ok := x86BranchTarget(inst)
+			switch {
+			case ok && (target < start || target >= end):
+				f.TailCalls = append(f.TailCalls, target)
+			case !ok && len(ops) > 0 && ops[0].Type == gs.X86_OP_MEM:
+				unbounded(inst, "indirect tail call")
+			}
+			continue
+		case x86HasGroup(inst, gs.X86_GRP_RET),
+			x86StackPop[mn], strings.HasPrefix(mn, "leave"):
+			continue
+		case strings.HasPrefix(mn, "push"):
+			grow += word
+			continue
+		}
 
-			// count memory access to SP/BP register
-			if opr.Type == gs.X86_OP_MEM {
-				reg := m.fmtRegToGroup(inst, opr.Mem.Base)
-				if reg != "SP" {
-					continue
+		for _, opr := range ops {
+			// red zone, below SP without moving it.
+			if opr.Type == gs.X86_OP_MEM && !strings.HasPrefix(mn, "lea") &&
+				m.regGroup(opr.Mem.Base) == "SP" &&
+				opr.Mem.Disp < 0 && uint64(-opr.Mem.Disp) > redZone {
+				redZone = uint64(-opr.Mem.Disp)
+			}
+			if opr.Type != gs.X86_OP_REG || m.regGroup(opr.Reg) != "SP" {
+				continue
+			}
+			if strings.HasPrefix(mn, "cmp") {
+				unbounded(inst, "stack probe loop")
+				continue
+			}
+			if opr.Access&gs.CS_AC_WRITE == 0 {
+				continue
+			}
+			imm, hasImm := x86ImmOperand(inst)
+			switch {
+			case strings.HasPrefix(mn, "sub") && hasImm:
+				if imm > 0 {
+					grow += uint64(imm)
+				}
+			case strings.HasPrefix(mn, "add"):
+				if hasImm && imm < 0 {
+					grow += uint64(-imm)
+				}
+			case strings.HasPrefix(mn, "and") && hasImm:
+				// realign, at most -imm bytes.
+				if imm < 0 {
+					grow += uint64(-imm)
 				}
-				if off := opr.Mem.Disp; off > int64(accessMax) { // must be positive
-					accessMax = uint64(off)
+			case strings.HasPrefix(mn, "lea"), strings.HasPrefix(mn, "mov"):
+				src := ops[0]
+				switch {
+				// frame pointer epilogue.
+				case src.Type == gs.X86_OP_REG && m.regGroup(src.Reg) == "BP",
+					src.Type == gs.X86_OP_MEM && m.regGroup(src.Mem.Base) == "BP":
+				case src.Type == gs.X86_OP_MEM && m.regGroup(src.Mem.Base) == "SP" &&
+					src.Mem.Index == gs.X86_REG_INVALID && strings.HasPrefix(mn, "lea"):
+					if src.Mem.Disp < 0 {
+						grow += uint64(-src.Mem.Disp)
+					}
+				default:
+					unbounded(inst, "dynamic stack allocation")
 				}
+			default:
+				unbounded(inst, "dynamic stack allocation")
 			}
+		}
+	}
+	f.Size = grow + redZone
+	return
+}
 
+func x86HasGroup(inst gs.Instruction, grp uint) bool {
+	for _, g := range inst.Groups {
+		if g == grp {
+			return true
 		}
 	}
-	return allocMax, accessMax
+	return false
 }
 
-// ref: https://github.com/chenzhuoyu/asm2asm/blob/5e85f0dbbd2eb4768d8413c326e5540612c86fae/asm2asm.py#L411-L431
-// convert capstone ATT mnemonic str
-/*
-__instr_map__ = {
-        'INT3'       : INT3,
-
-        'MOVQ'       : Special.MOVQ,
-        'CBTW'       : x86_64.CBW,
-        'CWTL'       : x86_64.CWDE,
-        'CLTQ'       : x86_64.CDQE,
-
-        'MOVZBW'     : x86_64.MOVZX,
-        'MOVZBL'     : x86_64.MOVZX,
-        'MOVZWL'     : x86_64.MOVZX,
-        'MOVZBQ'     : x86_64.MOVZX,
-        'MOVZWQ'     : x86_64.MOVZX,
-
-        'MOVSBW'     : x86_64.MOVSX,
-        'MOVSBL'     : x86_64.MOVSX,
-        'MOVSWL'     : x86_64.MOVSX,
-        'MOVSBQ'     : x86_64.MOVSX,
-        'MOVSWQ'     : x86_64.MOVSX,
-
-        'MOVSLQ'     : x86_64.MOVSXD,
-        'MOVABSQ'    : x86_64.MOV,
-
-        'VCMPEQPS'   : VCMPEQPS,
-        'VCMPTRUEPS' : VCMPTRUEPS,
-    }
-*/
-
-func (m archX86) cvtMnemonicInternal(mnemStr string) (string, bool) {
-	mnCap := strings.ToUpper(mnemStr)
-
-	mnRep, exist := x86MnemonicReplace[mnCap]
-	if exist {
-		mnCap = mnRep
-	}
-	// check if mnem on Go asm sets
-	_, exist = m._AC.Instructions[mnCap]
-	return mnCap, exist
+// x86BranchTarget is the target of a direct call or jump.
+func x86BranchTarget(inst gs.Instruction) (uint64, bool) {
+	ops := inst.X86.Operands
+	if len(ops) != 1 || ops[0].Type != gs.X86_OP_IMM {
+		return 0, false
+	}
+	return uint64(ops[0].Imm), true
 }
 
-func (m archX86) cvtMnemonic(mnemStr string) string {
-	mnCap, exist := m.cvtMnemonicInternal(mnemStr)
-	if !exist && !X86RawBytesFallback {
-		panic(fmt.Sprintf("mnemonic not defined: %s (%s)", mnCap, mnemStr))
+func x86ImmOperand(inst gs.Instruction) (int64, bool) {
+	for _, opr := range inst.X86.Operands {
+		if opr.Type == gs.X86_OP_IMM {
+			return opr.Imm, true
+		}
 	}
-	return mnCap
+	return 0, false
 }
 
 // convert capstone ATT operand str
-func (m archX86) cvtOprStr(inst gs.Instruction, symname SymLookup) string {
+func (m archX86) cvtOprStr(inst gs.Instruction, symname SymLookup) (string, error) {
 	var ops []string
 
-	switch mn := m.cvtMnemonic(inst.Mnemonic); mn {
-	default:
-		switch {
-		case strings.HasPrefix(mn, "CMP"):
-			inst.X86.Operands[0], inst.X86.Operands[1] = inst.X86.Operands[1], inst.X86.Operands[0]
-		}
+	_, att := x86Mnemonic(inst)
+	if x86StringInstruction[att] {
+		return "", nil
 	}
-
-	for _, op := range inst.X86.Operands {
-		ops = append(ops, m.fmtOperandGoSyntax(inst, op, symname))
+	// AT&T writes the predicate as the first operand.
+	if pred, ok := x86CmpPredicateOf(inst, att); ok {
+		ops = append(ops, "$"+m.fmtNum(pred.imm, true))
 	}
-	return strings.Join(ops, ", ")
+	for _, op := range m.evexOperands(inst) {
+		opStr, err := m.fmtOperandGoSyntax(inst, op, symname)
+		if err != nil {
+			return "", err
+		}
+		ops = append(ops, opStr)
+	}
+	mn, _ := m.cvtMnemonicInternal(inst)
+	return strings.Join(m.orderOperands(mn, ops), ", "), nil
 }
 
 func (m archX86) fmtNum(num int64, hex bool) string {
@@ -278,13 +314,20 @@ func (m archX86) fmtNum(num int64, hex bool) string {
 }
 
 func (m archX86) hasDisallowedInstruction(inst gs.Instruction) bool {
-	mn := m.cvtMnemonic(inst.Mnemonic)
-	doDisallow, disallowed := x86DisallowedInstruction[mn]
-	return disallowed && doDisallow
+	mn, _ := m.cvtMnemonicInternal(inst)
+	for _, part := range strings.Split(mn, "; ") {
+		if doDisallow, disallowed := x86DisallowedInstruction[part]; disallowed && doDisallow {
+			return true
+		}
+	}
+	return false
 }
 
-func (m archX86) hasDisallowedRegisterOperand(inst gs.Instruction) bool {
+func (m archX86) hasDisallowedRegisterOperand(inst gs.Instruction, symname SymLookup) bool {
 	for _, opr := range inst.X86.Operands {
+		if _, ok := m.ripSymbol(inst, opr, symname); ok {
+			continue
+		}
 		var regNms []string
 		switch opr.Type {
 		case gs.X86_OP_REG: // check Reg
@@ -323,10 +366,7 @@ func (m archX86) hasMemoryOperand(inst gs.Instruction) bool {
 	return false
 }
 
-func (m archX86) fmtReg(inst gs.Instruction, reg uint) string {
-	mnem := m.cvtMnemonic(inst.Mnemonic)
-	_ = mnem
-
+func (m archX86) fmtReg(inst gs.Instruction, reg uint) (string, error) {
 	// switch {
 	// case m.hasMemoryOperand(inst):
 	// 	// if inst don't have any MEM operand
@@ -337,59 +377,63 @@ func (m archX86) fmtReg(inst gs.Instruction, reg uint) string {
 	return m.fmtRegToGroup(inst, reg)
 }
 
-func (m archX86) fmtRegToGroup(insnt gs.Instruction, reg uint) string {
-	regS := getX86RegisterGoSyntax(reg)
+// regGroup is the group of reg, the analyses only look for SP and BP so
+// an unknown register is left empty.
+func (m archX86) regGroup(reg uint) string {
+	regS, _ := m.fmtRegToGroup(gs.Instruction{}, reg)
+	return regS
+}
 
+func (m archX86) fmtRegToGroup(insnt gs.Instruction, reg uint) (string, error) {
 	// -- GPR
 
 	switch reg {
 	case gs.X86_REG_RAX, gs.X86_REG_EAX,
 		gs.X86_REG_AX, gs.X86_REG_AH, gs.X86_REG_AL:
-		return "AX"
+		return "AX", nil
 	case gs.X86_REG_RBX, gs.X86_REG_EBX,
 		gs.X86_REG_BX, gs.X86_REG_BH, gs.X86_REG_BL:
-		return "BX"
+		return "BX", nil
 	case gs.X86_REG_RCX, gs.X86_REG_ECX,
 		gs.X86_REG_CX, gs.X86_REG_CH, gs.X86_REG_CL:
-		return "CX"
+		return "CX", nil
 	case gs.X86_REG_RDX, gs.X86_REG_EDX,
 		gs.X86_REG_DX, gs.X86_REG_DH, gs.X86_REG_DL:
-		return "DX"
+		return "DX", nil
 
 	case gs.X86_REG_RSP, gs.X86_REG_ESP, gs.X86_REG_SP, gs.X86_REG_SPL:
-		return "SP"
+		return "SP", nil
 	case gs.X86_REG_RBP, gs.X86_REG_EBP, gs.X86_REG_BP, gs.X86_REG_BPL:
-		return "BP"
+		return "BP", nil
 	case gs.X86_REG_RDI, gs.X86_REG_EDI, gs.X86_REG_DI, gs.X86_REG_DIL:
-		return "DI"
+		return "DI", nil
 	case gs.X86_REG_RSI, gs.X86_REG_ESI, gs.X86_REG_SI, gs.X86_REG_SIL:
-		return "SI"
+		return "SI", nil
 
 	case gs.X86_REG_R8, gs.X86_REG_R8D, gs.X86_REG_R8W, gs.X86_REG_R8B:
-		return "R8"
+		return "R8", nil
 	case gs.X86_REG_R9, gs.X86_REG_R9D, gs.X86_REG_R9W, gs.X86_REG_R9B:
-		return "R9"
+		return "R9", nil
 	case gs.X86_REG_R10, gs.X86_REG_R10D, gs.X86_REG_R10W, gs.X86_REG_R10B:
-		return "R10"
+		return "R10", nil
 	case gs.X86_REG_R11, gs.X86_REG_R11D, gs.X86_REG_R11W, gs.X86_REG_R11B:
-		return "R11"
+		return "R11", nil
 	case gs.X86_REG_R12, gs.X86_REG_R12D, gs.X86_REG_R12W, gs.X86_REG_R12B:
-		return "R12"
+		return "R12", nil
 	case gs.X86_REG_R13, gs.X86_REG_R13D, gs.X86_REG_R13W, gs.X86_REG_R13B:
-		return "R13"
+		return "R13", nil
 	case gs.X86_REG_R14, gs.X86_REG_R14D, gs.X86_REG_R14W, gs.X86_REG_R14B:
-		return "R14"
+		return "R14", nil
 	case gs.X86_REG_R15, gs.X86_REG_R15D, gs.X86_REG_R15W, gs.X86_REG_R15B:
-		return "R15"
+		return "R15", nil
 	}
 
-	return regS
+	return getX86RegisterGoSyntax(reg)
 }
 
 // Note that `symname` need to mention (SB) or label name explicitly
-func (m archX86) fmtOperandGoSyntax(inst gs.Instruction, op gs.X86Operand, symname SymLookup) string {
-	mnem := m.cvtMnemonic(inst.Mnemonic)
-	_ = mnem
+func (m archX86) fmtOperandGoSyntax(inst gs.Instruction, op gs.X86Operand, symname SymLookup) (string, error) {
+	mnem, _ := m.cvtMnemonicInternal(inst)
 	switch op.Type {
 	case gs.X86_OP_REG:
 		return m.fmtReg(inst, op.Reg)
@@ -408,17 +452,28 @@ func (m archX86) fmtOperandGoSyntax(inst gs.Instruction, op gs.X86Operand, symna
 			if uint64(op.Imm) != base {
 				suffix = fmt.Sprintf("%+d", inst.Address-uint(base))
 			}
-			return fmt.Sprintf("%s%s%s", prefix, name, suffix)
+			return fmt.Sprintf("%s%s%s", prefix, name, suffix), nil
 		}
 		if m.mode == 32 {
-			return fmt.Sprintf("%s%#x", prefix, uint32(inst.Address))
+			return fmt.Sprintf("%s%#x", prefix, uint32(inst.Address)), nil
 		}
 	normal:
-		return fmt.Sprintf("$%#x", op.Imm)
+		return fmt.Sprintf("$%#x", op.Imm), nil
 	case gs.X86_OP_MEM:
-		segReg := m.fmtReg(inst, op.Mem.Segment)
-		baseReg := m.fmtReg(inst, op.Mem.Base)
-		idxReg := m.fmtReg(inst, op.Mem.Index)
+		if name, ok := m.ripSymbol(inst, op, symname); ok {
+			return name, nil
+		}
+		var regs [3]string
+		for i, reg := range []uint{op.Mem.Segment, op.Mem.Base, op.Mem.Index} {
+			if reg == gs.X86_REG_INVALID {
+				continue
+			}
+			var err error
+			if regs[i], err = m.fmtReg(inst, reg); err != nil {
+				return "", err
+			}
+		}
+		segReg, baseReg, idxReg := regs[0], regs[1], regs[2]
 		scale := m.fmtNum(int64(op.Mem.Scale), false)
 		disp := m.fmtNum(op.Mem.Disp, true)
 
@@ -434,11 +489,26 @@ func (m archX86) fmtOperandGoSyntax(inst gs.Instruction, op gs.X86Operand, symna
 			opf = opf + "(" + idxReg + "*" + scale + ")"
 		}
 		if op.Mem.Disp == 0 {
-			return opf
+			return opf, nil
 		}
-		return disp + opf
+		return disp + opf, nil
+	}
+	return "", fmt.Errorf("unknown operand type %d", op.Type)
+}
+
+// ripSymbol returns the symbol a RIP relative operand addresses, when
+// symname knows it as name(SB). Other RIP relative operands stay raw
+// bytes, the data they address is laid down next to the code.
+func (m archX86) ripSymbol(inst gs.Instruction, op gs.X86Operand, symname SymLookup) (string, bool) {
+	if op.Type != gs.X86_OP_MEM || op.Mem.Base != gs.X86_REG_RIP || op.Mem.Index != 0 {
+		return "", false
+	}
+	target := uint64(inst.Address) + uint64(inst.Size) + uint64(op.Mem.Disp)
+	name, base := symname(target)
+	if base != target || !strings.HasSuffix(name, "(SB)") {
+		return "", false
 	}
-	panic("operand type unk")
+	return name, true
 }
 
 func (m archX86) fmtInstRawBytes(inst gs.Instruction) Text {
@@ -467,39 +537,49 @@ func (m archX86) EncodeRawBytes(b []byte) (ret []Text) {
 	return
 }
 
-func (m archX86) fmtInst(inst gs.Instruction, symname SymLookup) Text {
+func (m archX86) fmtInst(inst gs.Instruction, symname SymLookup) (Text, error) {
 	var asm string
-	var opStr string
-	isDisallowed := m.hasDisallowedInstruction(inst) || m.hasDisallowedRegisterOperand(inst) || X86JustWriteRawBytes
+	isDisallowed := m.hasDisallowedInstruction(inst) || m.hasDisallowedRegisterOperand(inst, symname) || X86JustWriteRawBytes
 
 	// format as raw bytes
 	rawInstruction := m.fmtInstRawBytes(inst)
-
-	mn, mnExist := m.cvtMnemonicInternal(inst.Mnemonic)
-	if !mnExist && X86RawBytesFallback {
-		isDisallowed = true
-		goto direct
+	rawInstruction.Verify = Fallback
+
+	mn, err := m.cvtMnemonic(inst)
+	if err == nil {
+		asm = mn + m.evexSuffix(inst)
+		var opStr string
+		if opStr, err = m.cvtOprStr(inst, symname); opStr != "" {
+			asm = asm + " " + opStr
+		}
 	}
-
-	opStr = m.cvtOprStr(inst, symname)
-	if opStr == "" && !isDisallowed {
-		asm = mn
-		return Text{Asm: asm}
+	switch {
+	case isDisallowed, err != nil && X86RawBytesFallback:
+		if asm != "" {
+			rawInstruction.Comments = append(rawInstruction.Comments, asm)
+		}
+		return rawInstruction, nil
+	case err != nil:
+		return Text{}, &InstError{
+			Addr:  uint64(inst.Address),
+			Bytes: inst.Bytes,
+			Inst:  strings.TrimSpace(inst.Mnemonic + " " + inst.OpStr),
+			Err:   err,
+		}
 	}
-	asm = mn + " " + opStr
 
-direct:
-	if isDisallowed {
+	verify := m.verifyInst(inst, asm, symname)
+	if verify == Fallback {
 		rawInstruction.Comments = append(rawInstruction.Comments, asm)
-		return rawInstruction
+		return rawInstruction, nil
 	}
-	return Text{Asm: asm}
+	return Text{Asm: asm, Verify: verify}, nil
 }
 
 // ----
 
 // GoSyntax of disasm2
-func (m archX86) GoSyntax(inst gs.Instruction, pc uint64, symname SymLookup, text io.ReaderAt) Text {
+func (m archX86) GoSyntax(inst gs.Instruction, pc uint64, symname SymLookup, text io.ReaderAt) (Text, error) {
 	if symname == nil {
 		symname = func(addr uint64) (name string, base uint64) {
 			return "", 0
@@ -510,15 +590,19 @@ func (m archX86) GoSyntax(inst gs.Instruction, pc uint64, symname SymLookup, tex
 	return m.fmtInst(inst, symname)
 }
 
-func (m archX86) GoSyntaxBlock(insts []gs.Instruction, pc uint64, symname SymLookup, text io.ReaderAt) []Text {
+// GoSyntaxBlock translates insts, stopping at the first instruction that
+// fails.
+func (m archX86) GoSyntaxBlock(insts []gs.Instruction, pc uint64, symname SymLookup, text io.ReaderAt) ([]Text, error) {
 	var fs []Text
 	for _, inst := range insts {
-		f := m.GoSyntax(inst, pc, symname, text)
+		f, err := m.GoSyntax(inst, pc, symname, text)
+		if err != nil {
+			return fs, err
+		}
 		pc = pc + uint64(inst.Size)
 		fs = append(fs, f)
 	}
-	return fs
-
+	return fs, nil
 }
 
 // -----
@@ -533,8 +617,24 @@ func (m archX86) Decode(code []byte) (inst gs.Instruction, err error) {
 	return
 }
 
+// DecodeBlock decodes the whole of code, capstone stops at the first
+// instruction it does not know, that is an error.
 func (m archX86) DecodeBlock(code []byte, pc uint64) (insts []gs.Instruction, err error) {
 	insts, err = m.e.Disasm(code, pc, 0)
+	if err != nil {
+		return
+	}
+	var off uint64
+	for _, inst := range insts {
+		off += uint64(inst.Size)
+	}
+	if off < uint64(len(code)) {
+		end := off + 15
+		if end > uint64(len(code)) {
+			end = uint64(len(code))
+		}
+		err = fmt.Errorf("%#x: %x: instruction not decoded", pc+off, code[off:end])
+	}
 	return
 }
 
@@ -545,21 +645,21 @@ func (m archX86) DecodeBlock(code []byte, pc uint64) (insts []gs.Instruction, er
 // https://quasilyte.dev/blog/post/go-asm-complementary-reference/
 
 // x86 register mapping
-func getX86RegisterGoSyntax(reg uint) string {
+func getX86RegisterGoSyntax(reg uint) (string, error) {
 	regNm, exist := x86RegisterMap[reg]
 	if !exist {
-		panic("x86 reg unk")
+		return "", fmt.Errorf("unknown register %d", reg)
 	}
 	// the reg id is ordered
 	switch {
 	case reg >= gs.X86_REG_XMM0 && reg <= gs.X86_REG_XMM31:
-		return "X" + regNm[3:]
+		return "X" + regNm[3:], nil
 	case reg >= gs.X86_REG_YMM0 && reg <= gs.X86_REG_YMM31:
-		return "Y" + regNm[3:]
+		return "Y" + regNm[3:], nil
 	case reg >= gs.X86_REG_ZMM0 && reg <= gs.X86_REG_ZMM31:
-		return "Z" + regNm[3:]
+		return "Z" + regNm[3:], nil
 	}
-	return regNm
+	return regNm, nil
 }
 
 var x86RegisterMap = map[uint]string{
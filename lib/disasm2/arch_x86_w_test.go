@@ -1,42 +1,65 @@
 package disasm2
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"strings"
 	"testing"
 
+	gs "github.com/knightsc/gapstone"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestStackSizeCountAMD64(t *testing.T) {
+func TestStackFrameAMD64(t *testing.T) {
 	type test struct {
-		exp uint64
-		b   []byte
+		name      string
+		b         []byte
+		size      uint64
+		calls     []uint64
+		tailCalls []uint64
+		unbounded string
 	}
 	prog := []test{
-		// sub    $0x10,%rsp
-		{0x18, []byte{0x48, 0x83, 0xec, 0x18}},
-		// lea    0x8(%rsp),%rbp
-		{0x8, []byte{0x48, 0x8d, 0x6c, 0x24, 0x08}},
-
-		// sub    $0x10,%rsp
-		// lea    0x8(%rsp),%rbp
-		{0x18, []byte{0x48, 0x83, 0xec, 0x18,
-			0x48, 0x8d, 0x6c, 0x24, 0x08}},
+		// push %rbp; push %rbx; sub $0x18,%rsp; call 0x0
+		// add $0x18,%rsp; pop %rbx; pop %rbp; ret
+		{"frame", []byte{0x55, 0x53, 0x48, 0x83, 0xec, 0x18, 0xe8, 0xf5, 0xff, 0xff, 0xff,
+			0x48, 0x83, 0xc4, 0x18, 0x5b, 0x5d, 0xc3}, 0x28, []uint64{0x0}, nil, ""},
+		// mov %edi,-0x14(%rsp); mov -0x14(%rsp),%eax; ret
+		{"red zone", []byte{0x89, 0x7c, 0x24, 0xec, 0x8b, 0x44, 0x24, 0xec, 0xc3},
+			0x14, nil, nil, ""},
+		// popcnt -0x20(%rsp),%rax; ret
+		{"popcnt", []byte{0xf3, 0x48, 0x0f, 0xb8, 0x44, 0x24, 0xe0, 0xc3},
+			0x20, nil, nil, ""},
+		// push %rbp; mov %rsp,%rbp; sub %rax,%rsp; leave; ret
+		{"alloca", []byte{0x55, 0x48, 0x89, 0xe5, 0x48, 0x29, 0xc4, 0xc9, 0xc3},
+			0x8, nil, nil, "dynamic stack allocation at 0x4: subq %rax, %rsp"},
+		// lea -0x4000(%rsp),%r11; sub $0x1000,%rsp; orq $0x0,(%rsp)
+		// cmp %r11,%rsp; jne -0x11; ret
+		{"probe", []byte{0x4c, 0x8d, 0x9c, 0x24, 0x00, 0xc0, 0xff, 0xff,
+			0x48, 0x81, 0xec, 0x00, 0x10, 0x00, 0x00, 0x48, 0x83, 0x0c, 0x24, 0x00,
+			0x4c, 0x39, 0xdc, 0x75, 0xef, 0xc3},
+			0x1000, nil, nil, "stack probe loop at 0x14: cmpq %r11, %rsp"},
+		// call *%rax; jmp *%rax; ret
+		{"indirect", []byte{0xff, 0xd0, 0xff, 0xe0, 0xc3},
+			0, nil, nil, "indirect call at 0x0: callq *%rax"},
+		// at 0x100: sub $0x8,%rsp; add $0x8,%rsp; jmp 0xbd
+		{"tail", []byte{0x48, 0x83, 0xec, 0x08, 0x48, 0x83, 0xc4, 0x08, 0xeb, 0xb3},
+			0x8, nil, []uint64{0xbd}, ""},
 	}
 	for _, tc := range prog {
-		insts, err := ArchAMD64.DecodeBlock(tc.b, 0x0)
-		assert.NoError(t, err)
-
-		fs := ArchAMD64.GoSyntaxBlock(insts, 0x0, nil, nil)
-		for _, f := range fs {
-			fmt.Println(f)
+		pc := uint64(0)
+		if tc.name == "tail" {
+			pc = 0x100
 		}
-		fmt.Println("----------")
+		insts, err := ArchAMD64.DecodeBlock(tc.b, pc)
+		assert.NoError(t, err)
 
-		act := ArchAMD64.StackSize(insts)
-		assert.Equal(t, tc.exp, act)
+		f := ArchAMD64.StackFrame(insts)
+		assert.Equal(t, tc.size, f.Size, tc.name)
+		assert.Equal(t, tc.calls, f.Calls, tc.name)
+		assert.Equal(t, tc.tailCalls, f.TailCalls, tc.name)
+		assert.Equal(t, tc.unbounded, f.Unbounded, tc.name)
 	}
 }
 
@@ -58,18 +81,19 @@ func TestDisasmBlockAMD64(t *testing.T) {
 			att = append(att, inst.Mnemonic+" "+inst.OpStr)
 		}
 
-		fs := ArchAMD64.GoSyntaxBlock(insts, 0x0, func(addr uint64) (name string, base uint64) {
+		fs, err := ArchAMD64.GoSyntaxBlock(insts, 0x0, func(addr uint64) (name string, base uint64) {
 			if addr == 0x9 {
 				return "anotherSubr", addr
 			}
 			return "", 0
 		}, nil)
+		assert.NoError(t, err)
 		var fss []string
 		for _, t := range fs {
 			fss = append(fss, t.String())
 		}
 
-		stackSize := ArchAMD64.StackSize(insts)
+		stackSize := ArchAMD64.StackFrame(insts).Size
 
 		fmt.Printf("------- stack size: %d\n%s\n----------\n%s\n",
 			stackSize,
@@ -79,6 +103,566 @@ func TestDisasmBlockAMD64(t *testing.T) {
 
 }
 
+func TestRIPSymbolAMD64(t *testing.T) {
+	// at 0x10: lea 0x20(%rip),%rax; lea 0x30(%rip),%rdi; lea 0x40(%rip),%rsi
+	code := []byte{0x48, 0x8d, 0x05, 0x20, 0x0, 0x0, 0x0,
+		0x48, 0x8d, 0x3d, 0x30, 0x0, 0x0, 0x0,
+		0x48, 0x8d, 0x35, 0x40, 0x0, 0x0, 0x0}
+	insts, err := ArchAMD64.DecodeBlock(code, 0x10)
+	assert.NoError(t, err)
+	fs, err := ArchAMD64.GoSyntaxBlock(insts, 0x10, func(addr uint64) (name string, base uint64) {
+		switch addr {
+		case 0x37:
+			return "stderr(SB)", addr
+		case 0x4e:
+			return "_lbl_4e", addr
+		}
+		return "", 0
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "LEAQ stderr(SB), AX", fs[0].Asm)
+	// a label or data next to the code stays raw bytes.
+	assert.Equal(t, "LONG $0x303d8d48; WORD $0x0; BYTE $0x0", fs[1].Asm)
+	assert.Equal(t, "LONG $0x40358d48; WORD $0x0; BYTE $0x0", fs[2].Asm)
+}
+
+func TestVerifyAMD64(t *testing.T) {
+	type test struct {
+		exp    string
+		verify Verify
+		code   []byte
+	}
+	prog := []test{
+		// cmpq %r12,0x10(%r14)
+		{"CMPQ 0x10(R14), R12", Verified, []byte{0x4d, 0x39, 0x66, 0x10}},
+		// mov %fs:0xfffffffffffffff8,%r14
+		{"MOVQ -0x8(FS), R14", Verified, []byte{0x64, 0x4c, 0x8b, 0x34, 0x25, 0xf8, 0xff, 0xff, 0xff}},
+		// vpaddq %xmm1,%xmm2,%xmm3
+		{"VPADDQ X1, X2, X3", Verified, []byte{0xc5, 0xe9, 0xd4, 0xd9}},
+		// vmovdqu (%rdi),%ymm0
+		{"VMOVDQU (DI), Y0", Verified, []byte{0xc5, 0xfe, 0x6f, 0x07}},
+		// call *%rax
+		{"CALL AX", Verified, []byte{0xff, 0xd0}},
+		{"RET", Verified, []byte{0xc3}},
+		// cmovle %rcx,%rax
+		{"CMOVQLE CX, AX", Verified, []byte{0x48, 0x0f, 0x4e, 0xc1}},
+		// test $0x1,%al, Go writes the short form for AL.
+		{"WORD $0x1a8", Fallback, []byte{0xa8, 0x01}},
+		// mov %ah,%al, AH has no group of its own.
+		{"WORD $0xe088", Fallback, []byte{0x88, 0xe0}},
+		// the branch target is known once linked.
+		{"JMP $0x2", Unverified, []byte{0xeb, 0x00}},
+	}
+	for _, tc := range prog {
+		inst, err := ArchAMD64.Decode(tc.code)
+		assert.NoError(t, err, tc.exp)
+		f, err := ArchAMD64.GoSyntax(inst, 0x0, nil, nil)
+		assert.NoError(t, err, tc.exp)
+		assert.Equal(t, tc.exp, f.Asm, tc.exp)
+		assert.Equal(t, tc.verify, f.Verify, tc.exp)
+	}
+}
+
+func TestInstErrorAMD64(t *testing.T) {
+	// at 0x20: fldl (%rdi), x87 is not in the mnemonic table.
+	inst, err := ArchAMD64.Decode([]byte{0xdd, 0x07})
+	assert.NoError(t, err)
+	_, err = ArchAMD64.GoSyntax(inst, 0x20, nil, nil)
+	var ierr *InstError
+	if assert.ErrorAs(t, err, &ierr) {
+		assert.Equal(t, uint64(0x20), ierr.Addr)
+		assert.Equal(t, []byte{0xdd, 0x07}, ierr.Bytes)
+	}
+	assert.EqualError(t, err, "0x20: dd07 (fldl (%rdi)): mnemonic not defined: FLDL")
+
+	X86RawBytesFallback = true
+	defer func() { X86RawBytesFallback = false }()
+	f, err := ArchAMD64.GoSyntax(inst, 0x20, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "WORD $0x7dd", f.Asm)
+	assert.Equal(t, Fallback, f.Verify)
+}
+
+func TestMnemonicTableAMD64(t *testing.T) {
+	known := func(mn string) {
+		_, ok := ArchAMD64._AC.Instructions[mn]
+		assert.True(t, ok, mn)
+	}
+	for _, mn := range x86MnemonicReplace {
+		known(mn)
+	}
+	for _, mns := range x86MnemonicBySize {
+		known(mns[0])
+		known(mns[1])
+	}
+	for _, pred := range x86CmpPredicates {
+		known(pred.base)
+	}
+	for _, mn := range x86Prefixes {
+		known(mn)
+	}
+	for mn := range x86StringInstruction {
+		known(mn)
+	}
+	for mn := range x86InstUseSymbol {
+		known(mn)
+	}
+}
+
+func TestMnemonicAMD64(t *testing.T) {
+	type test struct {
+		exp  string
+		code []byte
+	}
+	prog := []test{
+		// movzbl %dl,%edx
+		{"MOVBLZX DX, DX", []byte{0x0f, 0xb6, 0xd2}},
+		// movzbw %dl,%dx
+		{"MOVBWZX DX, DX", []byte{0x66, 0x0f, 0xb6, 0xd2}},
+		// movzbq %dl,%rdx
+		{"MOVBQZX DX, DX", []byte{0x48, 0x0f, 0xb6, 0xd2}},
+		// movzwl %dx,%edx
+		{"MOVWLZX DX, DX", []byte{0x0f, 0xb7, 0xd2}},
+		// movzwq %dx,%rdx
+		{"MOVWQZX DX, DX", []byte{0x48, 0x0f, 0xb7, 0xd2}},
+		// movsbl %dl,%edx
+		{"MOVBLSX DX, DX", []byte{0x0f, 0xbe, 0xd2}},
+		// movsbw %dl,%dx
+		{"MOVBWSX DX, DX", []byte{0x66, 0x0f, 0xbe, 0xd2}},
+		// movsbq %dl,%rdx
+		{"MOVBQSX DX, DX", []byte{0x48, 0x0f, 0xbe, 0xd2}},
+		// movswl %dx,%edx
+		{"MOVWLSX DX, DX", []byte{0x0f, 0xbf, 0xd2}},
+		// movswq %dx,%rdx
+		{"MOVWQSX DX, DX", []byte{0x48, 0x0f, 0xbf, 0xd2}},
+		// movslq 0x8(%rdi),%rdx
+		{"MOVLQSX 0x8(DI), DX", []byte{0x48, 0x63, 0x57, 0x08}},
+		// movabs $0x123456789abc,%rax
+		{"MOVQ $0x123456789abc, AX", []byte{0x48, 0xb8, 0xbc, 0x9a, 0x78, 0x56, 0x34, 0x12, 0x00, 0x00}},
+		// cbtw, cwtl, cltq, cwtd, cltd, cqto
+		{"CBW", []byte{0x66, 0x98}},
+		{"CWDE", []byte{0x98}},
+		{"CDQE", []byte{0x48, 0x98}},
+		{"CWD", []byte{0x66, 0x99}},
+		{"CDQ", []byte{0x99}},
+		{"CQO", []byte{0x48, 0x99}},
+		// cmove %ecx,%eax, CMOVL with the EQ condition.
+		{"CMOVLEQ CX, AX", []byte{0x0f, 0x44, 0xc1}},
+		// cmovl %cx,%ax
+		{"CMOVWLT CX, AX", []byte{0x66, 0x0f, 0x4c, 0xc1}},
+		// cmova %rcx,%rax
+		{"CMOVQHI CX, AX", []byte{0x48, 0x0f, 0x47, 0xc1}},
+		// cmovnp %rcx,%rax
+		{"CMOVQPC CX, AX", []byte{0x48, 0x0f, 0x4b, 0xc1}},
+		// sete %al
+		{"SETEQ AX", []byte{0x0f, 0x94, 0xc0}},
+		// setb %al
+		{"SETCS AX", []byte{0x0f, 0x92, 0xc0}},
+		// setge (%rdi)
+		{"SETGE (DI)", []byte{0x0f, 0x9d, 0x07}},
+		// sets %al
+		{"SETMI AX", []byte{0x0f, 0x98, 0xc0}},
+		// imul $0x1e,%rdi,%rdi
+		{"IMUL3Q $0x1e, DI, DI", []byte{0x48, 0x6b, 0xff, 0x1e}},
+		// imul $0x3,%di,%di
+		{"IMUL3W $0x3, DI, DI", []byte{0x66, 0x6b, 0xff, 0x03}},
+		// imul %rcx,%rax
+		{"IMULQ CX, AX", []byte{0x48, 0x0f, 0xaf, 0xc1}},
+		// imul (%rdi),%eax
+		{"IMULL (DI), AX", []byte{0x0f, 0xaf, 0x07}},
+		// shld $0x4,%rcx,%rax
+		{"SHLQ $0x4, CX, AX", []byte{0x48, 0x0f, 0xa4, 0xc8, 0x04}},
+		// shrd %cl,%rcx,%rax
+		{"SHRQ CX, CX, AX", []byte{0x48, 0x0f, 0xad, 0xc8}},
+		// cmpxchg %rcx,(%rdi), not an integer CMP.
+		{"CMPXCHGQ CX, (DI)", []byte{0x48, 0x0f, 0xb1, 0x0f}},
+		// lock cmpxchg %rcx,(%rdi)
+		{"LOCK; CMPXCHGQ CX, (DI)", []byte{0xf0, 0x48, 0x0f, 0xb1, 0x0f}},
+		// lock xadd %eax,(%rdi)
+		{"LOCK; XADDL AX, (DI)", []byte{0xf0, 0x0f, 0xc1, 0x07}},
+		// rep movsb %ds:(%rsi),%es:(%rdi)
+		{"REP; MOVSB", []byte{0xf3, 0xa4}},
+		// rep stos %rax,%es:(%rdi)
+		{"REP; STOSQ", []byte{0xf3, 0x48, 0xab}},
+		// repnz scas %es:(%rdi),%al
+		{"REPN; SCASB", []byte{0xf2, 0xae}},
+		// repz cmpsb %es:(%rdi),%ds:(%rsi)
+		{"REP; CMPSB", []byte{0xf3, 0xa6}},
+		// lods %ds:(%rsi),%al
+		{"LODSB", []byte{0xac}},
+		// leave
+		{"LEAVEQ", []byte{0xc9}},
+		// jmp *%rax
+		{"JMP AX", []byte{0xff, 0xe0}},
+		// jmp *(%rax,%rcx,8)
+		{"JMP (AX)(CX*8)", []byte{0xff, 0x24, 0xc8}},
+		// movd %eax,%xmm0
+		{"MOVL AX, X0", []byte{0x66, 0x0f, 0x6e, 0xc0}},
+		// movq %xmm0,%rax
+		{"MOVQ X0, AX", []byte{0x66, 0x48, 0x0f, 0x7e, 0xc0}},
+		// movdqa %xmm1,%xmm0
+		{"MOVO X1, X0", []byte{0x66, 0x0f, 0x6f, 0xc1}},
+		// movdqu %xmm0,(%rdi)
+		{"MOVOU X0, (DI)", []byte{0xf3, 0x0f, 0x7f, 0x07}},
+		// packssdw %xmm1,%xmm0
+		{"PACKSSLW X1, X0", []byte{0x66, 0x0f, 0x6b, 0xc1}},
+		// pcmpeqd %xmm1,%xmm0
+		{"PCMPEQL X1, X0", []byte{0x66, 0x0f, 0x76, 0xc1}},
+		// pmaddwd %xmm1,%xmm0
+		{"PMADDWL X1, X0", []byte{0x66, 0x0f, 0xf5, 0xc1}},
+		// pmuludq %xmm1,%xmm0
+		{"PMULULQ X1, X0", []byte{0x66, 0x0f, 0xf4, 0xc1}},
+		// psrad $0x4,%xmm0
+		{"PSRAL $0x4, X0", []byte{0x66, 0x0f, 0x72, 0xe0, 0x04}},
+		// punpckldq %xmm1,%xmm0
+		{"PUNPCKLLQ X1, X0", []byte{0x66, 0x0f, 0x62, 0xc1}},
+		// cvtdq2pd %xmm1,%xmm0
+		{"CVTPL2PD X1, X0", []byte{0xf3, 0x0f, 0xe6, 0xc1}},
+		// cvtdq2ps %xmm1,%xmm0
+		{"CVTPL2PS X1, X0", []byte{0x0f, 0x5b, 0xc1}},
+		// cvttps2dq %xmm1,%xmm0
+		{"CVTTPS2PL X1, X0", []byte{0xf3, 0x0f, 0x5b, 0xc1}},
+		// cvtsi2sd %rax,%xmm0
+		{"CVTSQ2SD AX, X0", []byte{0xf2, 0x48, 0x0f, 0x2a, 0xc0}},
+		// cvtsi2ss %eax,%xmm0
+		{"CVTSL2SS AX, X0", []byte{0xf3, 0x0f, 0x2a, 0xc0}},
+		// cvttsd2si %xmm0,%rax
+		{"CVTTSD2SQ X0, AX", []byte{0xf2, 0x48, 0x0f, 0x2c, 0xc0}},
+		// cvttss2si %xmm0,%eax
+		{"CVTTSS2SL X0, AX", []byte{0xf3, 0x0f, 0x2c, 0xc0}},
+		// cvtsd2si %xmm0,%rax
+		{"CVTSD2SQ X0, AX", []byte{0xf2, 0x48, 0x0f, 0x2d, 0xc0}},
+		// vcvttsd2si %xmm0,%rax
+		{"VCVTTSD2SIQ X0, AX", []byte{0xc4, 0xe1, 0xfb, 0x2c, 0xc0}},
+		// cmpltsd %xmm1,%xmm0
+		{"CMPSD X1, X0, $0x1", []byte{0xf2, 0x0f, 0xc2, 0xc1, 0x01}},
+		// cmpeqps %xmm1,%xmm0
+		{"CMPPS X1, X0, $0x0", []byte{0x0f, 0xc2, 0xc1, 0x00}},
+		// vcmpltpd %ymm2,%ymm1,%ymm0
+		{"VCMPPD $0x1, Y2, Y1, Y0", []byte{0xc5, 0xf5, 0xc2, 0xc2, 0x01}},
+		// vcmpltsd %xmm2,%xmm1,%xmm0
+		{"VCMPSD $0x1, X2, X1, X0", []byte{0xc5, 0xf3, 0xc2, 0xc2, 0x01}},
+	}
+	for _, tc := range prog {
+		inst, err := ArchAMD64.Decode(tc.code)
+		assert.NoError(t, err, tc.exp)
+		f, err := ArchAMD64.GoSyntax(inst, 0x0, nil, nil)
+		assert.NoError(t, err, tc.exp)
+		assert.Equal(t, tc.exp, f.Asm, tc.exp)
+		assert.Equal(t, Verified, f.Verify, tc.exp)
+	}
+
+	// Go has no mnemonic for these, they are written as raw bytes.
+	for _, code := range [][]byte{{0xf3, 0x0f, 0x1e, 0xfa}, {0xcc}, {0x3e, 0xff, 0xe0}} {
+		inst, err := ArchAMD64.Decode(code)
+		assert.NoError(t, err)
+		f, err := ArchAMD64.GoSyntax(inst, 0x0, nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, Fallback, f.Verify, inst.Mnemonic)
+	}
+}
+
+// TestMnemonicFamiliesAMD64 round trips every mapping of the generated
+// and the size dependent families, a mapping to a valid Go mnemonic of
+// the wrong instruction does not assemble back to the same bytes.
+func TestMnemonicFamiliesAMD64(t *testing.T) {
+	check := func(att, exp string, code []byte) {
+		inst, err := ArchAMD64.Decode(code)
+		if !assert.NoError(t, err, exp) {
+			return
+		}
+		if att != "" {
+			_, mn := x86Mnemonic(inst)
+			assert.Equal(t, att, mn, exp)
+		}
+		f, err := ArchAMD64.GoSyntax(inst, 0x0, nil, nil)
+		assert.NoError(t, err, exp)
+		assert.Equal(t, exp, f.Asm, att)
+		assert.Equal(t, Verified, f.Verify, exp)
+	}
+
+	// SETcc and CMOVcc, by the condition code in the opcode.
+	for i, cc := range []string{"OS", "OC", "CS", "CC", "EQ", "NE", "LS", "HI",
+		"MI", "PL", "PS", "PC", "LT", "GE", "LE", "GT"} {
+		check("", "SET"+cc+" AX", []byte{0x0f, 0x90 + byte(i), 0xc0})
+		check("", "CMOVW"+cc+" CX, AX", []byte{0x66, 0x0f, 0x40 + byte(i), 0xc1})
+		check("", "CMOVL"+cc+" CX, AX", []byte{0x0f, 0x40 + byte(i), 0xc1})
+		check("", "CMOVQ"+cc+" CX, AX", []byte{0x48, 0x0f, 0x40 + byte(i), 0xc1})
+	}
+
+	// the comparison predicates, SSE has 8, VEX 32 and VPCMP 8.
+	for i, typ := range []string{"PS", "PD", "SS", "SD"} {
+		prefix := []byte{0x0, 0x66, 0xf3, 0xf2}[i]
+		for imm := byte(0); imm < 32; imm++ {
+			if imm < 8 {
+				code := []byte{0x0f, 0xc2, 0xc1, imm}
+				if prefix != 0 {
+					code = append([]byte{prefix}, code...)
+				}
+				check("", fmt.Sprintf("CMP%s X1, X0, $%#x", typ, imm), code)
+			}
+			check("", fmt.Sprintf("VCMP%s $%#x, X2, X1, X0", typ, imm),
+				[]byte{0xc5, 0xf0 | byte(i), 0xc2, 0xc2, imm})
+		}
+	}
+	for _, typ := range []struct {
+		name  string
+		w, op byte
+	}{
+		{"B", 0x7d, 0x3f}, {"W", 0xfd, 0x3f}, {"D", 0x7d, 0x1f}, {"Q", 0xfd, 0x1f},
+		{"UB", 0x7d, 0x3e}, {"UW", 0xfd, 0x3e}, {"UD", 0x7d, 0x1e}, {"UQ", 0xfd, 0x1e},
+	} {
+		for imm := byte(0); imm < 8; imm++ {
+			exp := fmt.Sprintf("VPCMP%s $%#x, Z1, Z0, K1", typ.name, imm)
+			code := []byte{0x62, 0xf3, typ.w, 0x48, typ.op, 0xc9, imm}
+			last := typ.name[len(typ.name)-1]
+			if last != 'B' && last != 'W' {
+				check("", exp, code)
+				continue
+			}
+			// capstone 4 does not decode the byte and word forms, the
+			// dword form is patched into them.
+			inst, err := ArchAMD64.Decode([]byte{0x62, 0xf3, 0x7d, 0x48, typ.op - 0x20, 0xc9, imm})
+			if !assert.NoError(t, err, exp) {
+				continue
+			}
+			inst.Mnemonic = inst.Mnemonic[:len(inst.Mnemonic)-1] + strings.ToLower(string(last))
+			inst.Bytes = code
+			f, err := ArchAMD64.GoSyntax(inst, 0x0, nil, nil)
+			assert.NoError(t, err, exp)
+			assert.Equal(t, exp, f.Asm)
+			assert.Equal(t, Verified, f.Verify, exp)
+		}
+	}
+
+	// the extending moves, the conversions and the size dependent
+	// mnemonics, by AT&T mnemonic.
+	prog := []struct {
+		att, exp string
+		code     []byte
+	}{
+		{"MOVZBW", "MOVBWZX DX, DX", []byte{0x66, 0x0f, 0xb6, 0xd2}},
+		{"MOVZBL", "MOVBLZX DX, DX", []byte{0x0f, 0xb6, 0xd2}},
+		{"MOVZBQ", "MOVBQZX DX, DX", []byte{0x48, 0x0f, 0xb6, 0xd2}},
+		{"MOVZWL", "MOVWLZX DX, DX", []byte{0x0f, 0xb7, 0xd2}},
+		{"MOVZWQ", "MOVWQZX DX, DX", []byte{0x48, 0x0f, 0xb7, 0xd2}},
+		{"MOVSBW", "MOVBWSX DX, DX", []byte{0x66, 0x0f, 0xbe, 0xd2}},
+		{"MOVSBL", "MOVBLSX DX, DX", []byte{0x0f, 0xbe, 0xd2}},
+		{"MOVSBQ", "MOVBQSX DX, DX", []byte{0x48, 0x0f, 0xbe, 0xd2}},
+		{"MOVSWL", "MOVWLSX DX, DX", []byte{0x0f, 0xbf, 0xd2}},
+		{"MOVSWQ", "MOVWQSX DX, DX", []byte{0x48, 0x0f, 0xbf, 0xd2}},
+		{"MOVSLQ", "MOVLQSX DX, DX", []byte{0x48, 0x63, 0xd2}},
+
+		{"CVTDQ2PD", "CVTPL2PD X1, X0", []byte{0xf3, 0x0f, 0xe6, 0xc1}},
+		{"CVTDQ2PS", "CVTPL2PS X1, X0", []byte{0x0f, 0x5b, 0xc1}},
+		{"CVTPD2DQ", "CVTPD2PL X1, X0", []byte{0xf2, 0x0f, 0xe6, 0xc1}},
+		{"CVTPS2DQ", "CVTPS2PL X1, X0", []byte{0x66, 0x0f, 0x5b, 0xc1}},
+		{"CVTTPD2DQ", "CVTTPD2PL X1, X0", []byte{0x66, 0x0f, 0xe6, 0xc1}},
+		{"CVTTPS2DQ", "CVTTPS2PL X1, X0", []byte{0xf3, 0x0f, 0x5b, 0xc1}},
+		{"CVTSI2SDL", "CVTSL2SD (DI), X0", []byte{0xf2, 0x0f, 0x2a, 0x07}},
+		{"CVTSI2SDQ", "CVTSQ2SD (DI), X0", []byte{0xf2, 0x48, 0x0f, 0x2a, 0x07}},
+		{"CVTSI2SSL", "CVTSL2SS (DI), X0", []byte{0xf3, 0x0f, 0x2a, 0x07}},
+		{"CVTSI2SSQ", "CVTSQ2SS (DI), X0", []byte{0xf3, 0x48, 0x0f, 0x2a, 0x07}},
+
+		{"MOVD", "MOVL AX, X0", []byte{0x66, 0x0f, 0x6e, 0xc0}},
+		{"MOVD", "MOVL X0, AX", []byte{0x66, 0x0f, 0x7e, 0xc0}},
+		{"CVTSD2SI", "CVTSD2SL X0, AX", []byte{0xf2, 0x0f, 0x2d, 0xc0}},
+		{"CVTSD2SI", "CVTSD2SQ X0, AX", []byte{0xf2, 0x48, 0x0f, 0x2d, 0xc0}},
+		{"CVTSS2SI", "CVTSS2SL X0, AX", []byte{0xf3, 0x0f, 0x2d, 0xc0}},
+		{"CVTSS2SI", "CVTSS2SQ X0, AX", []byte{0xf3, 0x48, 0x0f, 0x2d, 0xc0}},
+		{"CVTTSD2SI", "CVTTSD2SL X0, AX", []byte{0xf2, 0x0f, 0x2c, 0xc0}},
+		{"CVTTSD2SI", "CVTTSD2SQ X0, AX", []byte{0xf2, 0x48, 0x0f, 0x2c, 0xc0}},
+		{"CVTTSS2SI", "CVTTSS2SL X0, AX", []byte{0xf3, 0x0f, 0x2c, 0xc0}},
+		{"CVTTSS2SI", "CVTTSS2SQ X0, AX", []byte{0xf3, 0x48, 0x0f, 0x2c, 0xc0}},
+		{"VCVTSD2SI", "VCVTSD2SI X0, AX", []byte{0xc5, 0xfb, 0x2d, 0xc0}},
+		{"VCVTSD2SI", "VCVTSD2SIQ X0, AX", []byte{0xc4, 0xe1, 0xfb, 0x2d, 0xc0}},
+		{"VCVTSS2SI", "VCVTSS2SI X0, AX", []byte{0xc5, 0xfa, 0x2d, 0xc0}},
+		{"VCVTSS2SI", "VCVTSS2SIQ X0, AX", []byte{0xc4, 0xe1, 0xfa, 0x2d, 0xc0}},
+		{"VCVTTSD2SI", "VCVTTSD2SI X0, AX", []byte{0xc5, 0xfb, 0x2c, 0xc0}},
+		{"VCVTTSD2SI", "VCVTTSD2SIQ X0, AX", []byte{0xc4, 0xe1, 0xfb, 0x2c, 0xc0}},
+		{"VCVTTSS2SI", "VCVTTSS2SI X0, AX", []byte{0xc5, 0xfa, 0x2c, 0xc0}},
+		{"VCVTTSS2SI", "VCVTTSS2SIQ X0, AX", []byte{0xc4, 0xe1, 0xfa, 0x2c, 0xc0}},
+	}
+	covered := map[string]bool{}
+	for _, tc := range prog {
+		check(tc.att, tc.exp, tc.code)
+		covered[tc.att] = true
+	}
+	for att := range x86MnemonicReplace {
+		if strings.HasPrefix(att, "MOVZ") || strings.HasPrefix(att, "MOVS") || strings.HasPrefix(att, "CVT") {
+			assert.True(t, covered[att], att)
+		}
+	}
+	for att := range x86MnemonicBySize {
+		assert.True(t, covered[att], att)
+	}
+}
+
+func TestOperandOrderAMD64(t *testing.T) {
+	for form, order := range x86OperandOrder {
+		_, ok := ArchAMD64._AC.Instructions[form.mn]
+		assert.True(t, ok, form.mn)
+		used := map[int]bool{}
+		for _, i := range order {
+			assert.True(t, i == x86ImpliedX0 || i >= 0 && i < form.n && !used[i], form.mn)
+			used[i] = true
+		}
+	}
+
+	type test struct {
+		exp, att string
+		code     []byte
+	}
+	prog := []test{
+		// cmp %rcx,%rax
+		{"CMPQ AX, CX", "CMPQ CX, AX", []byte{0x48, 0x39, 0xc8}},
+		// cmpl $0x5,(%rdi)
+		{"CMPL (DI), $0x5", "CMPL $0x5, (DI)", []byte{0x83, 0x3f, 0x05}},
+		// cmpb %al,0x8(%rdi)
+		{"CMPB 0x8(DI), AX", "CMPB AX, 0x8(DI)", []byte{0x38, 0x47, 0x08}},
+		// cmpps $0x9,%xmm1,%xmm0, no predicate alias past 7.
+		{"CMPPS X1, X0, $0x9", "CMPPS $0x9, X1, X0", []byte{0x0f, 0xc2, 0xc1, 0x09}},
+		// cmpltsd %xmm1,%xmm0
+		{"CMPSD X1, X0, $0x1", "CMPSD $0x1, X1, X0", []byte{0xf2, 0x0f, 0xc2, 0xc1, 0x01}},
+		// blendvps %xmm0,%xmm1,%xmm2
+		{"BLENDVPS X0, X1, X2", "BLENDVPS X1, X2", []byte{0x66, 0x0f, 0x38, 0x14, 0xd1}},
+		// pblendvb %xmm0,(%rdi),%xmm2
+		{"PBLENDVB X0, (DI), X2", "PBLENDVB (DI), X2", []byte{0x66, 0x0f, 0x38, 0x10, 0x17}},
+		// sha256rnds2 %xmm0,%xmm1,%xmm2
+		{"SHA256RNDS2 X0, X1, X2", "SHA256RNDS2 X1, X2", []byte{0x0f, 0x38, 0xcb, 0xd1}},
+	}
+	for _, tc := range prog {
+		inst, err := ArchAMD64.Decode(tc.code)
+		assert.NoError(t, err, tc.exp)
+		f, err := ArchAMD64.GoSyntax(inst, 0x0, nil, nil)
+		assert.NoError(t, err, tc.exp)
+		assert.Equal(t, tc.exp, f.Asm, tc.exp)
+		assert.Equal(t, Verified, f.Verify, tc.exp)
+		// the AT&T order does not round trip.
+		b, err := ArchAMD64.assemble(tc.att)
+		assert.True(t, err != nil || !bytes.Equal(b, tc.code), tc.att)
+	}
+
+	// these keep the AT&T order, immediates first.
+	keep := []test{
+		// shufps $0x1b,%xmm1,%xmm0
+		{"SHUFPS $0x1b, X1, X0", "", []byte{0x0f, 0xc6, 0xc1, 0x1b}},
+		// pshufd $0x4e,(%rdi),%xmm0
+		{"PSHUFD $0x4e, (DI), X0", "", []byte{0x66, 0x0f, 0x70, 0x07, 0x4e}},
+		// vperm2i128 $0x21,%ymm2,%ymm1,%ymm0
+		{"VPERM2I128 $0x21, Y2, Y1, Y0", "", []byte{0xc4, 0xe3, 0x75, 0x46, 0xc2, 0x21}},
+		// vshufpd $0x5,(%rdi),%ymm1,%ymm0
+		{"VSHUFPD $0x5, (DI), Y1, Y0", "", []byte{0xc5, 0xf5, 0xc6, 0x07, 0x05}},
+		// vcmpgt_oqps %ymm2,%ymm1,%ymm0
+		{"VCMPPS $0x1e, Y2, Y1, Y0", "", []byte{0xc5, 0xf4, 0xc2, 0xc2, 0x1e}},
+		// vblendvps %ymm3,%ymm2,%ymm1,%ymm0
+		{"VBLENDVPS Y3, Y2, Y1, Y0", "", []byte{0xc4, 0xe3, 0x75, 0x4a, 0xc2, 0x30}},
+		// vpgatherdd %ymm2,(%rax,%ymm1,4),%ymm0
+		{"VPGATHERDD Y2, (AX)(Y1*4), Y0", "", []byte{0xc4, 0xe2, 0x6d, 0x90, 0x04, 0x88}},
+		// vmaskmovps %ymm0,%ymm1,(%rdi)
+		{"VMASKMOVPS Y0, Y1, (DI)", "", []byte{0xc4, 0xe2, 0x75, 0x2e, 0x07}},
+		// shld $0x4,%rcx,(%rdi)
+		{"SHLQ $0x4, CX, (DI)", "", []byte{0x48, 0x0f, 0xa4, 0x0f, 0x04}},
+		// bextr %rcx,%rax,%rdx
+		{"BEXTRQ CX, AX, DX", "", []byte{0xc4, 0xe2, 0xf0, 0xf7, 0xd0}},
+	}
+	for _, tc := range keep {
+		inst, err := ArchAMD64.Decode(tc.code)
+		assert.NoError(t, err, tc.exp)
+		f, err := ArchAMD64.GoSyntax(inst, 0x0, nil, nil)
+		assert.NoError(t, err, tc.exp)
+		assert.Equal(t, tc.exp, f.Asm, tc.exp)
+		assert.Equal(t, Verified, f.Verify, tc.exp)
+	}
+}
+
+func TestEVEXAMD64(t *testing.T) {
+	type test struct {
+		exp  string
+		code []byte
+	}
+	prog := []test{
+		// vaddps %zmm2,%zmm1,%zmm0{%k1}
+		{"VADDPS Z2, Z1, K1, Z0", []byte{0x62, 0xf1, 0x74, 0x49, 0x58, 0xc2}},
+		// vaddps %zmm2,%zmm1,%zmm0{%k1}{z}
+		{"VADDPS.Z Z2, Z1, K1, Z0", []byte{0x62, 0xf1, 0x74, 0xc9, 0x58, 0xc2}},
+		// vaddps (%rdi){1to16},%zmm1,%zmm0
+		{"VADDPS.BCST (DI), Z1, Z0", []byte{0x62, 0xf1, 0x74, 0x58, 0x58, 0x07}},
+		// vaddpd 0x8(%rdi){1to8},%zmm1,%zmm0{%k2}{z}
+		{"VADDPD.BCST.Z 0x8(DI), Z1, K2, Z0", []byte{0x62, 0xf1, 0xf5, 0xda, 0x58, 0x47, 0x01}},
+		// vmovdqu64 %zmm0,(%rdi){%k1}
+		{"VMOVDQU64 Z0, K1, (DI)", []byte{0x62, 0xf1, 0xfe, 0x49, 0x7f, 0x07}},
+		// vmovdqu32 (%rdi),%zmm0{%k1}{z}
+		{"VMOVDQU32.Z (DI), K1, Z0", []byte{0x62, 0xf1, 0x7e, 0xc9, 0x6f, 0x07}},
+		// vpaddd 0x40(%rdi),%zmm1,%zmm0, the displacement is compressed.
+		{"VPADDD 0x40(DI), Z1, Z0", []byte{0x62, 0xf1, 0x75, 0x48, 0xfe, 0x47, 0x01}},
+		// vpaddq %ymm18,%ymm17,%ymm16
+		{"VPADDQ Y18, Y17, Y16", []byte{0x62, 0xa1, 0xf5, 0x20, 0xd4, 0xc2}},
+		// vpcmpeqd %zmm1,%zmm0,%k1
+		{"VPCMPEQD Z1, Z0, K1", []byte{0x62, 0xf1, 0x7d, 0x48, 0x76, 0xc9}},
+		// vpcmpd $0x0,%zmm1,%zmm0,%k1, capstone prints it vpcmpeqd too.
+		{"VPCMPD $0x0, Z1, Z0, K1", []byte{0x62, 0xf3, 0x7d, 0x48, 0x1f, 0xc9, 0x00}},
+		// vpcmpltd %zmm1,%zmm0,%k1{%k2}
+		{"VPCMPD $0x1, Z1, Z0, K2, K1", []byte{0x62, 0xf3, 0x7d, 0x4a, 0x1f, 0xc9, 0x01}},
+		// vpcmpnequq is vpcmpuq $0x4
+		{"VPCMPUQ $0x4, Z1, Z0, K1", []byte{0x62, 0xf3, 0xfd, 0x48, 0x1e, 0xc9, 0x04}},
+		// vcmpltps %zmm1,%zmm0,%k1
+		{"VCMPPS $0x1, Z1, Z0, K1", []byte{0x62, 0xf1, 0x7c, 0x48, 0xc2, 0xc9, 0x01}},
+		// kmovw %k1,%eax
+		{"KMOVW K1, AX", []byte{0xc5, 0xf8, 0x93, 0xc1}},
+		// vpbroadcastd %xmm1,%zmm0{%k1}{z}
+		{"VPBROADCASTD.Z X1, K1, Z0", []byte{0x62, 0xf2, 0x7d, 0xc9, 0x58, 0xc1}},
+		// vfmadd231ps (%rdi){1to16},%zmm1,%zmm0
+		{"VFMADD231PS.BCST (DI), Z1, Z0", []byte{0x62, 0xf2, 0x75, 0x58, 0xb8, 0x07}},
+		// vpcompressd %zmm0,(%rdi){%k1}
+		{"VPCOMPRESSD Z0, K1, (DI)", []byte{0x62, 0xf2, 0x7d, 0x49, 0x8b, 0x07}},
+		// vpandd (%rdi){1to16},%zmm1,%zmm0{%k1}
+		{"VPANDD.BCST (DI), Z1, K1, Z0", []byte{0x62, 0xf1, 0x75, 0x59, 0xdb, 0x07}},
+	}
+	for _, tc := range prog {
+		inst, err := ArchAMD64.Decode(tc.code)
+		assert.NoError(t, err, tc.exp)
+		f, err := ArchAMD64.GoSyntax(inst, 0x0, nil, nil)
+		assert.NoError(t, err, tc.exp)
+		assert.Equal(t, tc.exp, f.Asm, tc.exp)
+		assert.Equal(t, Verified, f.Verify, tc.exp)
+	}
+
+	// capstone 4 does not decode embedded rounding, the register form is
+	// given the rounding bits by hand.
+	type rtest struct {
+		exp      string
+		code, rc []byte
+		rm       uint
+		sae      bool
+	}
+	rprog := []rtest{
+		// vaddps {rn-sae},%zmm2,%zmm1,%zmm0
+		{"VADDPS.RN_SAE Z2, Z1, Z0",
+			[]byte{0x62, 0xf1, 0x74, 0x48, 0x58, 0xc2}, []byte{0x62, 0xf1, 0x74, 0x18, 0x58, 0xc2}, gs.X86_AVX_RM_RN, false},
+		// vaddps {rz-sae},%zmm2,%zmm1,%zmm0{%k1}
+		{"VADDPS.RZ_SAE Z2, Z1, K1, Z0",
+			[]byte{0x62, 0xf1, 0x74, 0x49, 0x58, 0xc2}, []byte{0x62, 0xf1, 0x74, 0x79, 0x58, 0xc2}, gs.X86_AVX_RM_RZ, false},
+		// vmaxps {sae},%zmm2,%zmm1,%zmm0 as Go encodes it, the vector
+		// length is ignored. gas clears it, that form stays raw bytes.
+		{"VMAXPS.SAE Z2, Z1, Z0",
+			[]byte{0x62, 0xf1, 0x74, 0x48, 0x5f, 0xc2}, []byte{0x62, 0xf1, 0x74, 0x58, 0x5f, 0xc2}, gs.X86_AVX_RM_INVALID, true},
+	}
+	for _, tc := range rprog {
+		inst, err := ArchAMD64.Decode(tc.code)
+		assert.NoError(t, err, tc.exp)
+		inst.Bytes, inst.X86.AvxRM, inst.X86.AvxSAE = tc.rc, tc.rm, tc.sae
+		f, err := ArchAMD64.GoSyntax(inst, 0x0, nil, nil)
+		assert.NoError(t, err, tc.exp)
+		assert.Equal(t, tc.exp, f.Asm, tc.exp)
+		assert.Equal(t, Verified, f.Verify, tc.exp)
+	}
+
+	// the code past an instruction capstone does not decode is not lost.
+	_, err := ArchAMD64.DecodeBlock([]byte{0xc3, 0x62, 0xf1, 0x74, 0x18, 0x58, 0xc2, 0xc3}, 0x10)
+	assert.EqualError(t, err, "0x11: 62f1741858c2c3: instruction not decoded")
+}
+
 func TestDisasmAMD64(t *testing.T) {
 	type tc struct {
 		exp  string
@@ -139,10 +723,11 @@ func TestDisasmAMD64(t *testing.T) {
 	for _, ts := range prog {
 		inst, err := ArchAMD64.Decode(ts.code)
 		assert.NoError(t, err, ts.exp)
-		f := ArchAMD64.GoSyntax(inst, 0xff00000000000000, func(addr uint64) (name string, base uint64) {
+		f, err := ArchAMD64.GoSyntax(inst, 0xff00000000000000, func(addr uint64) (name string, base uint64) {
 			// fmt.Printf("-- check sym addr %d\n", addr)
 			return "", 0
 		}, nil)
+		assert.NoError(t, err, ts.exp)
 		fmt.Println(f)
 		assert.Equal(t, ts.exp, f.Asm, ts.exp)
 	}
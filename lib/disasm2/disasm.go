@@ -2,13 +2,45 @@ package disasm2
 
 import (
 	"encoding/binary"
+	"fmt"
 	"strconv"
 	"strings"
 )
 
+// Verify tells how the translation of an instruction was checked.
+type Verify uint8
+
+const (
+	// Unverified instructions were not assembled back, their operands
+	// address symbols or labels.
+	Unverified Verify = iota
+	// Verified instructions assemble back to their original bytes.
+	Verified
+	// Fallback instructions are written as raw bytes.
+	Fallback
+)
+
 type Text struct {
 	Asm      string
 	Comments []string
+	Verify   Verify
+}
+
+// InstError is an instruction that could not be translated.
+type InstError struct {
+	Addr  uint64
+	Bytes []byte
+	// Inst is the instruction as disassembled.
+	Inst string
+	Err  error
+}
+
+func (e *InstError) Error() string {
+	return fmt.Sprintf("%#x: %x (%s): %s", e.Addr, e.Bytes, e.Inst, e.Err)
+}
+
+func (e *InstError) Unwrap() error {
+	return e.Err
 }
 
 func (t Text) Prev() Text {
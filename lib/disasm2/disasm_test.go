@@ -79,7 +79,10 @@ func TestInit(t *testing.T) {
 			pc++
 			continue
 		}
-		st := ArchAMD64.GoSyntax(inst, uint64(pc), nil, nil)
+		st, err := ArchAMD64.GoSyntax(inst, uint64(pc), nil, nil)
+		if err != nil {
+			log.Println(err)
+		}
 		log.Printf("%+#v\n%+#v\n%#x:\t%s\n\t%s\n\n", inst.X86, inst,
 			pc,
 			inst.Mnemonic+" "+inst.OpStr,
@@ -0,0 +1,66 @@
+package disasm2
+
+import (
+	"strings"
+
+	gs "github.com/knightsc/gapstone"
+)
+
+// x86Rounding maps the embedded rounding of an EVEX instruction to the
+// Go suffix.
+var x86Rounding = map[uint]string{
+	gs.X86_AVX_RM_RN: "RN_SAE",
+	gs.X86_AVX_RM_RD: "RD_SAE",
+	gs.X86_AVX_RM_RU: "RU_SAE",
+	gs.X86_AVX_RM_RZ: "RZ_SAE",
+}
+
+// writeMask returns the index of the {%k} write mask operand of inst,
+// capstone puts it last, after the destination.
+func (m archX86) writeMask(inst gs.Instruction) (int, bool) {
+	ops := inst.X86.Operands
+	if len(ops) < 2 || !strings.Contains(inst.OpStr, "{%k") {
+		return 0, false
+	}
+	last := ops[len(ops)-1]
+	if last.Type != gs.X86_OP_REG || last.Reg < gs.X86_REG_K0 || last.Reg > gs.X86_REG_K7 {
+		return 0, false
+	}
+	return len(ops) - 1, true
+}
+
+// evexOperands orders the operands of inst the way Go writes them, the
+// write mask goes right before the destination.
+func (m archX86) evexOperands(inst gs.Instruction) []gs.X86Operand {
+	ops := inst.X86.Operands
+	k, ok := m.writeMask(inst)
+	if !ok {
+		return ops
+	}
+	ret := make([]gs.X86Operand, 0, len(ops))
+	ret = append(ret, ops[:k-1]...)
+	return append(ret, ops[k], ops[k-1])
+}
+
+// evexSuffix is the Go suffix of the EVEX features of inst: broadcast,
+// embedded rounding or SAE, then zeroing.
+func (m archX86) evexSuffix(inst gs.Instruction) string {
+	var suffix []string
+	for _, op := range inst.X86.Operands {
+		if op.Type == gs.X86_OP_MEM && op.AvxBcast != gs.X86_AVX_BCAST_INVALID {
+			suffix = append(suffix, "BCST")
+		}
+	}
+	if rc, ok := x86Rounding[inst.X86.AvxRM]; ok {
+		suffix = append(suffix, rc)
+	} else if inst.X86.AvxSAE {
+		suffix = append(suffix, "SAE")
+	}
+	if k, ok := m.writeMask(inst); ok && inst.X86.Operands[k].AvxZeroOpmask {
+		suffix = append(suffix, "Z")
+	}
+	if len(suffix) == 0 {
+		return ""
+	}
+	return "." + strings.Join(suffix, ".")
+}
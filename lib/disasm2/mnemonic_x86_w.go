@@ -0,0 +1,239 @@
+package disasm2
+
+import (
+	"fmt"
+	"strings"
+
+	gs "github.com/knightsc/gapstone"
+)
+
+// ref: https://github.com/chenzhuoyu/asm2asm/blob/5e85f0dbbd2eb4768d8413c326e5540612c86fae/asm2asm.py#L411-L431
+
+var (
+	// x86MnemonicReplace maps the AT&T mnemonics capstone prints to the Go
+	// ones of another name, Go knows the rest as they are. The SETcc and
+	// CMOVcc families are added by init.
+	x86MnemonicReplace = map[string]string{
+		"RETQ":  "RET",
+		"CALLQ": "CALL",
+		"JMPQ":  "JMP",
+		"LEAVE": "LEAVEQ",
+		"JRCXZ": "JCXZQ",
+		"JECXZ": "JCXZL",
+
+		"MOVZBW": "MOVBWZX",
+		"MOVZBL": "MOVBLZX",
+		"MOVZBQ": "MOVBQZX",
+		"MOVZWL": "MOVWLZX",
+		"MOVZWQ": "MOVWQZX",
+		"MOVSBW": "MOVBWSX",
+		"MOVSBL": "MOVBLSX",
+		"MOVSBQ": "MOVBQSX",
+		"MOVSWL": "MOVWLSX",
+		"MOVSWQ": "MOVWQSX",
+		"MOVSLQ": "MOVLQSX",
+
+		"MOVABSQ": "MOVQ",
+
+		"CBTW": "CBW",
+		"CWTL": "CWDE",
+		"CLTQ": "CDQE",
+		"CWTD": "CWD",
+		"CLTD": "CDQ",
+		"CQTO": "CQO",
+
+		// the double precision shifts take the shifted in register as the
+		// middle operand.
+		"SHLDW": "SHLW",
+		"SHLDL": "SHLL",
+		"SHLDQ": "SHLQ",
+		"SHRDW": "SHRW",
+		"SHRDL": "SHRL",
+		"SHRDQ": "SHRQ",
+
+		// Go names a dword L and a dqword O.
+		"MOVDQA":    "MOVO",
+		"MOVDQU":    "MOVOU",
+		"PACKSSDW":  "PACKSSLW",
+		"PCMPEQD":   "PCMPEQL",
+		"PCMPGTD":   "PCMPGTL",
+		"PMADDWD":   "PMADDWL",
+		"PMULUDQ":   "PMULULQ",
+		"PSLLD":     "PSLLL",
+		"PSRAD":     "PSRAL",
+		"PSRLD":     "PSRLL",
+		"PSUBD":     "PSUBL",
+		"PUNPCKHDQ": "PUNPCKHLQ",
+		"PUNPCKHWD": "PUNPCKHWL",
+		"PUNPCKLDQ": "PUNPCKLLQ",
+		"PUNPCKLWD": "PUNPCKLWL",
+		"CVTDQ2PD":  "CVTPL2PD",
+		"CVTDQ2PS":  "CVTPL2PS",
+		"CVTPD2DQ":  "CVTPD2PL",
+		"CVTPS2DQ":  "CVTPS2PL",
+		"CVTTPD2DQ": "CVTTPD2PL",
+		"CVTTPS2DQ": "CVTTPS2PL",
+		"CVTSI2SDL": "CVTSL2SD",
+		"CVTSI2SDQ": "CVTSQ2SD",
+		"CVTSI2SSL": "CVTSL2SS",
+		"CVTSI2SSQ": "CVTSQ2SS",
+
+		"MOVBEW": "MOVBEWW",
+		"MOVBEL": "MOVBELL",
+		"MOVBEQ": "MOVBEQQ",
+	}
+
+	// x86MnemonicBySize maps the AT&T mnemonics that leave the size to
+	// the general purpose register, to the Go ones for 4 and 8 bytes.
+	x86MnemonicBySize = map[string][2]string{
+		"MOVD":       {"MOVL", "MOVQ"},
+		"CVTSD2SI":   {"CVTSD2SL", "CVTSD2SQ"},
+		"CVTSS2SI":   {"CVTSS2SL", "CVTSS2SQ"},
+		"CVTTSD2SI":  {"CVTTSD2SL", "CVTTSD2SQ"},
+		"CVTTSS2SI":  {"CVTTSS2SL", "CVTTSS2SQ"},
+		"VCVTSD2SI":  {"VCVTSD2SI", "VCVTSD2SIQ"},
+		"VCVTSS2SI":  {"VCVTSS2SI", "VCVTSS2SIQ"},
+		"VCVTTSD2SI": {"VCVTTSD2SI", "VCVTTSD2SIQ"},
+		"VCVTTSS2SI": {"VCVTTSS2SI", "VCVTTSS2SIQ"},
+	}
+
+	// x86ConditionCodes maps the AT&T condition codes to Go's.
+	x86ConditionCodes = map[string]string{
+		"E": "EQ", "NE": "NE",
+		"L": "LT", "LE": "LE", "G": "GT", "GE": "GE",
+		"B": "CS", "AE": "CC", "A": "HI", "BE": "LS",
+		"S": "MI", "NS": "PL",
+		"O": "OS", "NO": "OC",
+		"P": "PS", "NP": "PC",
+	}
+
+	// x86CmpPredicateNames are the predicates capstone folds into the
+	// CMPPS family of mnemonics, by immediate. SSE only has the first 8.
+	x86CmpPredicateNames = []string{
+		"EQ", "LT", "LE", "UNORD", "NEQ", "NLT", "NLE", "ORD",
+		"EQ_UQ", "NGE", "NGT", "FALSE", "NEQ_OQ", "GE", "GT", "TRUE",
+		"EQ_OS", "LT_OQ", "LE_OQ", "UNORD_S", "NEQ_US", "NLT_UQ", "NLE_UQ", "ORD_S",
+		"EQ_US", "NGE_UQ", "NGT_UQ", "FALSE_OS", "NEQ_OS", "GE_OQ", "GT_OQ", "TRUE_US",
+	}
+	x86CmpPredicates = map[string]x86CmpPredicate{}
+
+	// x86IntCmpPredicateNames are the predicates of the AVX-512 VPCMP
+	// family, by immediate.
+	x86IntCmpPredicateNames = []string{
+		"EQ", "LT", "LE", "FALSE", "NEQ", "NLT", "NLE", "TRUE",
+	}
+
+	// x86Prefixes maps the AT&T prefixes to Go, which writes them as a
+	// statement of their own.
+	x86Prefixes = map[string]string{
+		"LOCK":  "LOCK",
+		"REP":   "REP",
+		"REPE":  "REP",
+		"REPNE": "REPN",
+	}
+
+	// x86StringInstruction are the string instructions, their operands
+	// are implied.
+	x86StringInstruction = map[string]bool{
+		"MOVSB": true, "MOVSW": true, "MOVSL": true, "MOVSQ": true,
+		"STOSB": true, "STOSW": true, "STOSL": true, "STOSQ": true,
+		"LODSB": true, "LODSW": true, "LODSL": true, "LODSQ": true,
+		"SCASB": true, "SCASW": true, "SCASL": true, "SCASQ": true,
+		"CMPSB": true, "CMPSW": true, "CMPSL": true, "CMPSQ": true,
+	}
+)
+
+// x86CmpPredicate is a comparison predicate folded into a mnemonic,
+// Go writes the base mnemonic and the predicate as an immediate.
+type x86CmpPredicate struct {
+	base string
+	imm  int64
+	// ambiguous is the name of another instruction too, capstone only
+	// sets the condition code for the predicate one.
+	ambiguous bool
+}
+
+func init() {
+	for att, cc := range x86ConditionCodes {
+		x86MnemonicReplace["SET"+att] = "SET" + cc
+		for _, sz := range []string{"W", "L", "Q"} {
+			x86MnemonicReplace["CMOV"+att+sz] = "CMOV" + sz + cc
+		}
+	}
+	for _, typ := range []string{"SS", "SD", "PS", "PD"} {
+		for i, pred := range x86CmpPredicateNames {
+			if i < 8 {
+				x86CmpPredicates["CMP"+pred+typ] = x86CmpPredicate{"CMP" + typ, int64(i), false}
+			}
+			x86CmpPredicates["VCMP"+pred+typ] = x86CmpPredicate{"VCMP" + typ, int64(i), false}
+		}
+	}
+	for _, typ := range []string{"B", "W", "D", "Q", "UB", "UW", "UD", "UQ"} {
+		for i, pred := range x86IntCmpPredicateNames {
+			x86CmpPredicates["VPCMP"+pred+typ] = x86CmpPredicate{"VPCMP" + typ, int64(i),
+				// VPCMPEQB and friends are instructions of their own too.
+				pred == "EQ" && typ[0] != 'U'}
+		}
+	}
+}
+
+// x86CmpPredicateOf returns the comparison predicate folded into the
+// mnemonic mn of inst.
+func x86CmpPredicateOf(inst gs.Instruction, mn string) (x86CmpPredicate, bool) {
+	pred, ok := x86CmpPredicates[mn]
+	if pred.ambiguous && inst.X86.AvxCC == gs.X86_AVX_CC_INVALID {
+		return pred, false
+	}
+	return pred, ok
+}
+
+// x86Mnemonic splits the mnemonic capstone prints into its prefixes and
+// the instruction.
+func x86Mnemonic(inst gs.Instruction) (prefixes []string, mn string) {
+	words := strings.Fields(strings.ToUpper(inst.Mnemonic))
+	if len(words) == 0 {
+		return nil, ""
+	}
+	return words[:len(words)-1], words[len(words)-1]
+}
+
+// cvtMnemonicInternal converts the mnemonic of inst to Go, prefixes
+// first separated by "; ", and tells whether Go knows all of them.
+func (m archX86) cvtMnemonicInternal(inst gs.Instruction) (string, bool) {
+	prefixes, mnCap := x86Mnemonic(inst)
+	ops := inst.X86.Operands
+
+	if mnRep, ok := x86MnemonicReplace[mnCap]; ok {
+		mnCap = mnRep
+	} else if bySize, ok := x86MnemonicBySize[mnCap]; ok {
+		mnCap = bySize[0]
+		for _, op := range ops {
+			if op.Type == gs.X86_OP_REG && op.Size == 8 {
+				mnCap = bySize[1]
+			}
+		}
+	} else if pred, ok := x86CmpPredicateOf(inst, mnCap); ok {
+		mnCap = pred.base
+	} else if len(ops) == 3 && strings.HasPrefix(mnCap, "IMUL") {
+		mnCap = "IMUL3" + mnCap[len("IMUL"):]
+	}
+	// check if mnem on Go asm sets
+	_, exist := m._AC.Instructions[mnCap]
+
+	for i := len(prefixes) - 1; i >= 0; i-- {
+		prefix, ok := x86Prefixes[prefixes[i]]
+		if !ok {
+			prefix, exist = prefixes[i], false
+		}
+		mnCap = prefix + "; " + mnCap
+	}
+	return mnCap, exist
+}
+
+func (m archX86) cvtMnemonic(inst gs.Instruction) (string, error) {
+	mnCap, exist := m.cvtMnemonicInternal(inst)
+	if !exist {
+		return mnCap, fmt.Errorf("mnemonic not defined: %s", mnCap)
+	}
+	return mnCap, nil
+}
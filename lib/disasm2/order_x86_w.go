@@ -0,0 +1,56 @@
+package disasm2
+
+import "strings"
+
+// x86Form is an instruction form, a Go mnemonic and the number of
+// operands it has in AT&T syntax.
+type x86Form struct {
+	mn string
+	n  int
+}
+
+// x86ImpliedX0 stands for the X0 operand the SSE4.1 variable blends and
+// SHA256RNDS2 imply, AT&T leaves it out but Go writes it.
+const x86ImpliedX0 = -1
+
+// x86OperandOrder maps the forms Go writes in another order than AT&T,
+// to the AT&T index of each Go operand. Every other form keeps the AT&T
+// order, the round trip through the assembler tells when that is wrong.
+var x86OperandOrder = map[x86Form][]int{
+	{"CMPB", 2}: {1, 0},
+	{"CMPW", 2}: {1, 0},
+	{"CMPL", 2}: {1, 0},
+	{"CMPQ", 2}: {1, 0},
+
+	// the predicate goes last, VEX keeps it first.
+	{"CMPPS", 3}: {1, 2, 0},
+	{"CMPPD", 3}: {1, 2, 0},
+	{"CMPSS", 3}: {1, 2, 0},
+	{"CMPSD", 3}: {1, 2, 0},
+
+	{"BLENDVPS", 2}:    {x86ImpliedX0, 0, 1},
+	{"BLENDVPD", 2}:    {x86ImpliedX0, 0, 1},
+	{"PBLENDVB", 2}:    {x86ImpliedX0, 0, 1},
+	{"SHA256RNDS2", 2}: {x86ImpliedX0, 0, 1},
+}
+
+// orderOperands lays out ops, in AT&T order, the way Go writes the form
+// of mn. mn may carry prefixes.
+func (m archX86) orderOperands(mn string, ops []string) []string {
+	if i := strings.LastIndex(mn, "; "); i >= 0 {
+		mn = mn[i+2:]
+	}
+	order, ok := x86OperandOrder[x86Form{mn, len(ops)}]
+	if !ok {
+		return ops
+	}
+	ret := make([]string, 0, len(order))
+	for _, i := range order {
+		if i == x86ImpliedX0 {
+			ret = append(ret, "X0")
+			continue
+		}
+		ret = append(ret, ops[i])
+	}
+	return ret
+}
@@ -0,0 +1,171 @@
+package disasm2
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	gs "github.com/knightsc/gapstone"
+	"github.com/twitchyliquid64/golang-asm/obj"
+	"github.com/twitchyliquid64/golang-asm/obj/x86"
+	"github.com/twitchyliquid64/golang-asm/objabi"
+)
+
+// verifyInst assembles asm, a translation of inst, back with golang-asm
+// and tells whether it encodes to the bytes of inst. The label offsets
+// depend on every instruction keeping its size, so anything else is
+// written as raw bytes. Operands addressing a symbol or a branch target
+// are only known once linked, those instructions stay Unverified.
+func (m archX86) verifyInst(inst gs.Instruction, asm string, symname SymLookup) Verify {
+	for _, op := range inst.X86.Operands {
+		if _, ok := m.ripSymbol(inst, op, symname); ok {
+			return Unverified
+		}
+		if mn, _ := m.cvtMnemonicInternal(inst); op.Type == gs.X86_OP_IMM && m._AC.IsJump(mn) {
+			return Unverified
+		}
+	}
+	b, err := m.assemble(asm)
+	if err != nil || !bytes.Equal(b, inst.Bytes) {
+		return Fallback
+	}
+	return Verified
+}
+
+// assemble encodes one instruction written as fmtInst does, its
+// operands laid out the way the Go assembler parser does. The prefixes
+// before it are statements of their own. golang-asm panics on some
+// operand shapes it does not expect, that is an error too.
+func (m archX86) assemble(asm string) (b []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			b, err = nil, fmt.Errorf("assemble %s: %v", asm, r)
+		}
+	}()
+	ctxt := obj.Linknew(m._AC.LinkArch)
+	ctxt.Headtype = objabi.Hlinux
+	var diag []string
+	ctxt.DiagFunc = func(format string, args ...interface{}) {
+		diag = append(diag, fmt.Sprintf(format, args...))
+	}
+	m._AC.Init(ctxt)
+	newprog := func() *obj.Prog {
+		p := ctxt.NewProg()
+		p.Ctxt = ctxt
+		return p
+	}
+
+	var text, last *obj.Prog
+	for _, stmt := range strings.Split(asm, "; ") {
+		p, err := m.parseStatement(stmt, newprog)
+		if err != nil {
+			return nil, err
+		}
+		if text == nil {
+			text = p
+		} else {
+			last.Link = p
+		}
+		last = p
+	}
+	for p := text; p != nil; p = p.Link {
+		m._AC.Progedit(ctxt, p, newprog)
+	}
+	s := &obj.LSym{Func: &obj.FuncInfo{Text: text}}
+	m._AC.Assemble(ctxt, s, newprog)
+	if len(diag) > 0 {
+		return nil, fmt.Errorf("assemble %s: %s", asm, strings.Join(diag, "; "))
+	}
+	return s.P, nil
+}
+
+func (m archX86) parseStatement(stmt string, newprog obj.ProgAlloc) (*obj.Prog, error) {
+	mn, oprs, _ := strings.Cut(stmt, " ")
+	mn, suffix, _ := strings.Cut(mn, ".")
+	as, ok := m._AC.Instructions[mn]
+	if !ok {
+		return nil, fmt.Errorf("unknown instruction %s", mn)
+	}
+	var addrs []obj.Addr
+	if oprs != "" {
+		for _, opr := range strings.Split(oprs, ", ") {
+			a, err := m.parseOperand(opr)
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, a)
+		}
+	}
+
+	p := newprog()
+	p.As = as
+	if suffix != "" {
+		if err := x86.ParseSuffix(p, suffix); err != nil {
+			return nil, err
+		}
+	}
+	switch n := len(addrs); {
+	case n == 0:
+	case n == 1:
+		if m._AC.IsJump(mn) || m._AC.UnaryDst[as] || as == obj.ARET {
+			p.To = addrs[0]
+		} else {
+			p.From = addrs[0]
+		}
+	case n == 2:
+		p.From, p.To = addrs[0], addrs[1]
+	default:
+		p.From = addrs[0]
+		p.RestArgs = addrs[1 : n-1]
+		p.To = addrs[n-1]
+	}
+	return p, nil
+}
+
+// parseOperand parses an operand fmtOperandGoSyntax writes for a
+// register, an immediate or a memory reference.
+func (m archX86) parseOperand(s string) (a obj.Addr, err error) {
+	if strings.HasPrefix(s, "$") {
+		a.Type = obj.TYPE_CONST
+		a.Offset, err = strconv.ParseInt(s[1:], 0, 64)
+		return
+	}
+	if reg, ok := m._AC.Register[s]; ok {
+		a.Type = obj.TYPE_REG
+		a.Reg = reg
+		return
+	}
+
+	// disp(base)(index*scale)
+	a.Type = obj.TYPE_MEM
+	disp, rest, ok := strings.Cut(s, "(")
+	if !ok {
+		return a, fmt.Errorf("bad operand %s", s)
+	}
+	if disp != "" {
+		if a.Offset, err = strconv.ParseInt(disp, 0, 64); err != nil {
+			return
+		}
+	}
+	for i, part := range strings.Split(strings.TrimSuffix(rest, ")"), ")(") {
+		reg, scale, hasScale := strings.Cut(part, "*")
+		r, ok := m._AC.Register[reg]
+		switch {
+		case !ok:
+			return a, fmt.Errorf("bad register %s in %s", reg, s)
+		case i == 0 && !hasScale:
+			a.Reg = r
+		case i <= 1 && hasScale && a.Index == 0:
+			a.Index = r
+			var n int64
+			if n, err = strconv.ParseInt(scale, 10, 16); err != nil {
+				return
+			}
+			a.Scale = int16(n)
+		default:
+			return a, fmt.Errorf("bad operand %s", s)
+		}
+	}
+	return
+}
@@ -0,0 +1,118 @@
+package hdr
+
+import (
+	"fmt"
+	"go/ast"
+	"strings"
+)
+
+const directivePrefix = "//golinker:"
+
+// FuncOptions holds the //golinker: directives of a stub func.
+//
+//	//golinker:symbol io_uring_submit
+//	//golinker:errno
+//	func Submit(ring *Ring) (n int32, err syscall.Errno)
+//
+// A func with a body is a callback when it has //golinker:export:
+//
+//	//golinker:export log_write
+//	func logWrite(p *byte, n int) { ... }
+type FuncOptions struct {
+	// Symbol is the native symbol the func is bound to, the Go name
+	// by default.
+	Symbol string
+	// NoStack drops the stack check, the native code is trusted to
+	// fit in the NOSPLIT stack budget.
+	NoStack bool
+	// Errno makes the last result an errno: the native code returns
+	// -errno on failure, like liburing and raw syscalls do.
+	Errno bool
+	// SystemStack runs the native code on a separate stack, taken from
+	// a pool of -nativestack sized stacks.
+	SystemStack bool
+	// SliceParts is the number of slice header words a []T arg is
+	// passed as: 1 (ptr), 2 (ptr, len) or 3 (ptr, len, cap).
+	SliceParts int
+	// Export is the external symbol a Go func with a body is called
+	// through by native code, empty if the func is not a callback.
+	Export string
+}
+
+func DefaultFuncOptions() FuncOptions {
+	return FuncOptions{
+		SliceParts: 2,
+	}
+}
+
+// GetFuncOptions parses the //golinker: directives in the doc comment
+// of f, on top of the defaults.
+func (h Hdr) GetFuncOptions(f *ast.FuncDecl) (opts FuncOptions, err error) {
+	opts = DefaultFuncOptions()
+	opts.Symbol = f.Name.Name
+	if f.Doc == nil {
+		return
+	}
+	for _, c := range f.Doc.List {
+		if !strings.HasPrefix(c.Text, directivePrefix) {
+			continue
+		}
+		name, arg, _ := strings.Cut(strings.TrimPrefix(c.Text, directivePrefix), " ")
+		arg = strings.TrimSpace(arg)
+		noArg := func() bool {
+			if arg != "" {
+				err = fmt.Errorf("%s: %s: unexpected argument", h.Fset.Position(c.Pos()), c.Text)
+			}
+			return err == nil
+		}
+		switch name {
+		case "symbol":
+			if arg == "" || strings.ContainsAny(arg, " \t") {
+				err = fmt.Errorf("%s: %s: want a symbol name", h.Fset.Position(c.Pos()), c.Text)
+				return
+			}
+			opts.Symbol = arg
+		case "nostack":
+			if !noArg() {
+				return
+			}
+			opts.NoStack = true
+		case "errno":
+			if !noArg() {
+				return
+			}
+			opts.Errno = true
+		case "systemstack":
+			if !noArg() {
+				return
+			}
+			opts.SystemStack = true
+		case "export":
+			if strings.ContainsAny(arg, " \t") {
+				err = fmt.Errorf("%s: %s: want a symbol name", h.Fset.Position(c.Pos()), c.Text)
+				return
+			}
+			opts.Export = arg
+			if arg == "" {
+				opts.Export = f.Name.Name
+			}
+		case "slice":
+			switch strings.ReplaceAll(arg, " ", "") {
+			case "ptr":
+				opts.SliceParts = 1
+			case "ptr,len":
+				opts.SliceParts = 2
+			case "ptr,len,cap":
+				opts.SliceParts = 3
+			default:
+				err = fmt.Errorf("%s: %s: want ptr, ptr,len or ptr,len,cap",
+					h.Fset.Position(c.Pos()), c.Text)
+				return
+			}
+		default:
+			err = fmt.Errorf("%s: unknown directive %s", h.Fset.Position(c.Pos()), c.Text)
+			return
+		}
+	}
+	return
+}
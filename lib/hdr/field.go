@@ -0,0 +1,90 @@
+package hdr
+
+import (
+	"fmt"
+	"go/types"
+	"strconv"
+)
+
+// Field is a scalar component of a Var. Names follow `go vet` asmdecl:
+// struct fields are v_Name, array elems v_0, v_1, ..., string and slice
+// headers v_base, v_len, v_cap, interfaces v_type (v_itable), v_data and
+// complex numbers v_real, v_imag.
+type Field struct {
+	Offset uint64 // FP offset
+	Size   uint64
+	Name   string
+	Type   types.Type
+}
+
+// Fields flattens v into its scalar components, ordered by offset.
+func (h Hdr) Fields(v Var) (fs []Field, err error) {
+	err = h.appendFields(&fs, v.Name, v.Offset, v.Type)
+	return
+}
+
+func (h Hdr) appendFields(fs *[]Field, name string, off uint64, t types.Type) error {
+	word := uint64(h.Sizes.Sizeof(types.Typ[types.Uintptr]))
+	add := func(suffix string, off uint64, t types.Type) {
+		*fs = append(*fs, Field{
+			Offset: off,
+			Size:   uint64(h.Sizes.Sizeof(t)),
+			Name:   name + suffix,
+			Type:   t,
+		})
+	}
+
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case u.Kind() == types.String:
+			add("_base", off, types.Typ[types.UnsafePointer])
+			add("_len", off+word, types.Typ[types.Int])
+		case u.Kind() == types.Complex64:
+			add("_real", off, types.Typ[types.Float32])
+			add("_imag", off+4, types.Typ[types.Float32])
+		case u.Kind() == types.Complex128:
+			add("_real", off, types.Typ[types.Float64])
+			add("_imag", off+8, types.Typ[types.Float64])
+		default:
+			add("", off, t)
+		}
+	case *types.Pointer, *types.Chan, *types.Map, *types.Signature:
+		add("", off, t)
+	case *types.Slice:
+		add("_base", off, types.Typ[types.UnsafePointer])
+		add("_len", off+word, types.Typ[types.Int])
+		add("_cap", off+2*word, types.Typ[types.Int])
+	case *types.Interface:
+		if u.Empty() {
+			add("_type", off, types.Typ[types.UnsafePointer])
+		} else {
+			add("_itable", off, types.Typ[types.UnsafePointer])
+		}
+		add("_data", off+word, types.Typ[types.UnsafePointer])
+	case *types.Struct:
+		var vars []*types.Var
+		for i := 0; i < u.NumFields(); i++ {
+			vars = append(vars, u.Field(i))
+		}
+		offs := h.Sizes.Offsetsof(vars)
+		for i, f := range vars {
+			err := h.appendFields(fs, name+"_"+f.Name(), off+uint64(offs[i]), f.Type())
+			if err != nil {
+				return err
+			}
+		}
+	case *types.Array:
+		elemSz := uint64(h.Sizes.Sizeof(u.Elem()))
+		for i := int64(0); i < u.Len(); i++ {
+			err := h.appendFields(fs, name+"_"+strconv.FormatInt(i, 10),
+				off+uint64(i)*elemSz, u.Elem())
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s: unhandled type: %s", name, t)
+	}
+	return nil
+}
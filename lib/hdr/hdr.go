@@ -3,27 +3,59 @@ package hdr
 import (
 	"fmt"
 	"go/ast"
+	"go/importer"
 	"go/parser"
 	"go/token"
+	"go/types"
+	"strconv"
 )
 
 type Hdr struct {
-	File     *ast.File
-	ArchSize map[string]uint64
+	File  *ast.File
+	Fset  *token.FileSet
+	Pkg   *types.Package
+	Info  *types.Info
+	Sizes types.Sizes
 }
 
 func ParseFile(path, source, arch string) (h Hdr, err error) {
-	h.File, err = parser.ParseFile(token.NewFileSet(), path, source,
+	h.Fset = token.NewFileSet()
+	h.File, err = parser.ParseFile(h.Fset, path, source,
 		parser.SkipObjectResolution|parser.ParseComments)
 	if err != nil {
 		return
 	}
-	var exist bool
-	h.ArchSize, exist = archTypeSize[arch]
-	if !exist {
+	h.Sizes = types.SizesFor("gc", arch)
+	if h.Sizes == nil {
 		err = fmt.Errorf("arch size data not defined")
 		return
 	}
+
+	// type check the stub package, so every param gets the exact
+	// size and alignment the gc toolchain uses. Func bodies may use the
+	// rest of the package, they are not checked, nor the imports only
+	// they use.
+	var errs []error
+	conf := types.Config{
+		Importer:         importer.Default(),
+		Sizes:            h.Sizes,
+		IgnoreFuncBodies: true,
+		Error: func(err error) {
+			if terr, ok := err.(types.Error); ok && terr.Soft {
+				return
+			}
+			errs = append(errs, err)
+		},
+	}
+	h.Info = &types.Info{
+		Types: map[ast.Expr]types.TypeAndValue{},
+		Defs:  map[*ast.Ident]types.Object{},
+	}
+	h.Pkg, _ = conf.Check(h.File.Name.Name, h.Fset, []*ast.File{h.File}, h.Info)
+	if len(errs) > 0 {
+		err = errs[0]
+		return
+	}
 	return
 }
 
@@ -47,88 +79,80 @@ func (h Hdr) GetFuncDecls(hasBody bool) (fs []*ast.FuncDecl) {
 	return
 }
 
-type fieldt struct {
-	typ   string
-	field *ast.Field
-}
-
 type Var struct {
 	Offset uint64
 	Size   uint64
 	Name   string
+	Type   types.Type
 }
 
-// GetFuncArgRetSize
-func (h Hdr) GetFuncArgRetSize(f *ast.FuncDecl) (args []Var, rets []Var, sz uint64) {
-	t := f.Type
-	if t == nil {
-		return
-	}
-	var fields []fieldt
-	params := t.Params
-	if params != nil {
-		for _, field := range params.List {
-			fields = append(fields, fieldt{"arg", field})
-		}
+// GetFuncSignature returns the type checked signature of f.
+func (h Hdr) GetFuncSignature(f *ast.FuncDecl) (*types.Signature, error) {
+	obj, ok := h.Info.Defs[f.Name].(*types.Func)
+	if !ok {
+		return nil, fmt.Errorf("func %s is not type checked", f.Name.Name)
 	}
-	results := t.Results
-	if results != nil {
-		for _, field := range results.List {
-			fields = append(fields, fieldt{"ret", field})
-		}
-	}
-	if len(fields) < 1 {
+	return obj.Type().(*types.Signature), nil
+}
+
+// GetFuncArgRetSize lays out the ABI0 arg/ret frame of f, the same
+// way `go vet` asmdecl expects the +N(FP) offsets: every var is aligned
+// to its own alignment and results start at a register aligned offset.
+// Unnamed vars are called arg, arg1, ... and ret, ret1, ..., blank ones
+// keep the name _ as asmdecl does, which only checks the last of them.
+func (h Hdr) GetFuncArgRetSize(f *ast.FuncDecl) (args []Var, rets []Var, sz uint64, err error) {
+	sig, err := h.GetFuncSignature(f)
+	if err != nil {
 		return
 	}
+	regSize := uint64(h.Sizes.Sizeof(types.Typ[types.Uintptr]))
 
-	// compute arg ret size
 	var off uint64 = 0
-	for _, fieldt := range fields {
-		field := fieldt.field
-		if len(field.Names) < 1 {
-			panic(fmt.Sprintf("argument / return must have a name: fnName %q", f.Name.Name))
-		}
-		var typName string
-		switch tx := field.Type.(type) {
-		case *ast.Ident:
-			typName = tx.Name
-		case *ast.StarExpr:
-			typName = "ptr"
-		case *ast.ArrayType:
-			typName = "array"
-		case *ast.SelectorExpr:
-			x, ok := tx.X.(*ast.Ident)
-			if !ok {
-				panic("unhandled SelectorExpr.X")
+	addVars := func(tuple *types.Tuple, unnamed string) (vars []Var) {
+		for i := 0; i < tuple.Len(); i++ {
+			v := tuple.At(i)
+			name := v.Name()
+			if name == "" {
+				name = unnamed
+				if i > 0 {
+					name += strconv.Itoa(i)
+				}
 			}
-			typName = x.Name + "." + tx.Sel.Name
-		default:
-			panic(fmt.Sprintf("unhandled type: %T", tx))
-		}
-
-		for _, name := range field.Names {
-			sz, exist := h.ArchSize[typName]
-			if !exist {
-				panic(fmt.Sprintf("arch type size undefined: %s", typName))
+			if b, ok := v.Type().(*types.Basic); ok && b.Kind() == types.Invalid {
+				if err == nil {
+					err = fmt.Errorf("func %s: %s has an unknown type", f.Name.Name, name)
+				}
+				continue
 			}
-
-			if fieldt.typ == "arg" {
-				args = append(args, Var{
-					Offset: off,
-					Size:   sz,
-					Name:   name.Name,
-				})
-			} else {
-				rets = append(rets, Var{
-					Offset: off,
-					Size:   sz,
-					Name:   name.Name,
-				})
-			}
-			off = off + sz
+			align := uint64(h.Sizes.Alignof(v.Type()))
+			size := uint64(h.Sizes.Sizeof(v.Type()))
+			off = alignUp(off, align)
+			vars = append(vars, Var{
+				Offset: off,
+				Size:   size,
+				Name:   name,
+				Type:   v.Type(),
+			})
+			off = off + size
 		}
-		// spew.Dump(field)
+		return
+	}
+
+	args = addVars(sig.Params(), "arg")
+	if sig.Results().Len() > 0 {
+		off = alignUp(off, regSize)
+		rets = addVars(sig.Results(), "ret")
 	}
 	sz = off
+	if err != nil {
+		return nil, nil, 0, err
+	}
 	return
 }
+
+func alignUp(off, align uint64) uint64 {
+	if align == 0 {
+		return off
+	}
+	return (off + align - 1) / align * align
+}
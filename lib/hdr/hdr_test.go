@@ -9,6 +9,8 @@ import (
 
 func TestHdrParser(t *testing.T) {
 	src := `package stub
+
+	import "unsafe"
 	
 	// bla bla bla
 	func k()
@@ -20,7 +22,7 @@ func TestHdrParser(t *testing.T) {
 	func as(a string)
 	// func ms(*string)
 	func ms(a *string)
-	func ms(a, b *string) (ret unsafe.Pointer)
+	func ms2(a, b *string) (ret unsafe.Pointer)
 
 	func init() {}
 	func anotherFnDecl() {
@@ -31,7 +33,8 @@ func TestHdrParser(t *testing.T) {
 	assert.NoError(t, err)
 	fns := hdr.GetFuncDecls(false)
 	for _, fn := range fns {
-		args, rets, sz := hdr.GetFuncArgRetSize(fn)
+		args, rets, sz, err := hdr.GetFuncArgRetSize(fn)
+		assert.NoError(t, err)
 		fmt.Printf("fn %q %+#v %+#v  %+#v\n\n",
 			fn.Name,
 			args,
@@ -39,3 +42,136 @@ func TestHdrParser(t *testing.T) {
 			sz)
 	}
 }
+
+func TestHdrFrameLayout(t *testing.T) {
+	src := `package stub
+
+	import "syscall"
+
+	type fd int32
+
+	func a(b byte, u uint64) (r byte)
+	func b(f fd, e syscall.Errno, p [4]uint32, c chan int, m map[int]int, fn func())
+	func c(b bool) (uint32, error)
+	func d(_ uint32, b bool) (r int64)
+	`
+	hdr, err := ParseFile("stub.go", src, "amd64")
+	if !assert.NoError(t, err) {
+		return
+	}
+	type layout struct {
+		args, rets []Var
+		sz         uint64
+	}
+	var got []layout
+	for _, fn := range hdr.GetFuncDecls(false) {
+		args, rets, sz, err := hdr.GetFuncArgRetSize(fn)
+		assert.NoError(t, err)
+		for i := range args {
+			args[i].Type = nil
+		}
+		for i := range rets {
+			rets[i].Type = nil
+		}
+		got = append(got, layout{args, rets, sz})
+	}
+	assert.Equal(t, []layout{
+		{
+			[]Var{{0, 1, "b", nil}, {8, 8, "u", nil}},
+			[]Var{{16, 1, "r", nil}},
+			17,
+		},
+		{
+			[]Var{{0, 4, "f", nil}, {8, 8, "e", nil}, {16, 16, "p", nil},
+				{32, 8, "c", nil}, {40, 8, "m", nil}, {48, 8, "fn", nil}},
+			nil,
+			56,
+		},
+		{
+			[]Var{{0, 1, "b", nil}},
+			[]Var{{8, 4, "ret", nil}, {16, 16, "ret1", nil}},
+			32,
+		},
+		{
+			[]Var{{0, 4, "_", nil}, {4, 1, "b", nil}},
+			[]Var{{8, 8, "r", nil}},
+			16,
+		},
+	}, got)
+}
+
+func TestHdrTypeError(t *testing.T) {
+	hdr, err := ParseFile("stub.go", "package stub\n\nfunc a(p Point)\n", "amd64")
+	assert.ErrorContains(t, err, "stub.go:3:10")
+
+	// the frame of a func that failed to type check is not laid out.
+	_, _, _, err = hdr.GetFuncArgRetSize(hdr.GetFuncDecls(false)[0])
+	assert.EqualError(t, err, "func a: p has an unknown type")
+}
+
+func TestHdrFuncOptions(t *testing.T) {
+	src := `package stub
+
+	// a has a doc comment.
+	//golinker:slice ptr,len,cap
+	func a(b []byte)
+	func b(b []byte)
+	//golinker:slice len
+	func c(b []byte)
+	//golinker:bogus
+	func d()
+
+	//golinker:symbol io_uring_submit
+	//golinker:nostack
+	//golinker:errno
+	func Submit() (n int32, err uintptr)
+	//golinker:nostack now
+	func f()
+
+	//golinker:export go_log
+	func logf(n int) { log(n) }
+	//golinker:export
+	func hook() {}
+	`
+	hdr, err := ParseFile("stub.go", src, "amd64")
+	if !assert.NoError(t, err) {
+		return
+	}
+	fns := hdr.GetFuncDecls(false)
+
+	opts, err := hdr.GetFuncOptions(fns[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 3, opts.SliceParts)
+	assert.Equal(t, "a has a doc comment.\n", fns[0].Doc.Text())
+
+	opts, err = hdr.GetFuncOptions(fns[1])
+	assert.NoError(t, err)
+	def := DefaultFuncOptions()
+	def.Symbol = "b"
+	assert.Equal(t, def, opts)
+
+	_, err = hdr.GetFuncOptions(fns[2])
+	assert.ErrorContains(t, err, "stub.go:7:2: //golinker:slice len")
+
+	_, err = hdr.GetFuncOptions(fns[3])
+	assert.ErrorContains(t, err, "stub.go:9:2: unknown directive //golinker:bogus")
+
+	opts, err = hdr.GetFuncOptions(fns[4])
+	assert.NoError(t, err)
+	assert.Equal(t, "io_uring_submit", opts.Symbol)
+	assert.True(t, opts.NoStack)
+	assert.True(t, opts.Errno)
+	assert.False(t, opts.SystemStack)
+
+	_, err = hdr.GetFuncOptions(fns[5])
+	assert.ErrorContains(t, err, "stub.go:16:2: //golinker:nostack now: unexpected argument")
+
+	// bodies may use the rest of the package.
+	cbs := hdr.GetFuncDecls(true)
+	opts, err = hdr.GetFuncOptions(cbs[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "go_log", opts.Export)
+	opts, err = hdr.GetFuncOptions(cbs[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "hook", opts.Export)
+}
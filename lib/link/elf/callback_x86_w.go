@@ -0,0 +1,266 @@
+package elf
+
+import (
+	"bufio"
+	"fmt"
+	"go/ast"
+	"go/types"
+
+	"github.com/ii64/golinker/lib/hdr"
+)
+
+// A callback is an external symbol native code calls, bound to a Go
+// func with //golinker:export. It runs in three parts:
+//
+//	sym              saves the SysV callee saved and arg registers on
+//	                 the native stack, and jumps to the bridge on the
+//	                 goroutine stack, right below the stub that called
+//	                 the native code
+//	fn__callback     copies the args to an ABI0 frame and calls fn, the
+//	                 runtime unwinds it as if the stub called it
+//	fn__resume       switches back to the native stack and returns
+//
+// The goroutine stack is found in the header of the pool stack, so
+// native code reaching a callback has to run on one. The goroutine
+// stack may move while fn runs, the resume updates the header.
+
+// callbackStackAMD64 is the most native stack a callback uses: the
+// return address, six callee saved registers and eight arg registers.
+const callbackStackAMD64 = 8 + 6*8 + 14*8
+
+var callbackSavedRegsAMD64 = []string{"BP", "BX", "R12", "R13", "R14", "R15"}
+
+func (st *LinkState) isCallback(addr uint64) bool {
+	name, ok := st.sExtSym[addr]
+	if !ok {
+		return false
+	}
+	if st.isStdioShim(name) {
+		return true
+	}
+	_, ok = st.sExport[name]
+	return ok
+}
+
+// bindCallbacksAMD64 runs the stubs whose native code calls a callback
+// on a pool stack. Calls through function pointers are not seen, the
+// stub needs //golinker:systemstack then.
+func (st *LinkState) bindCallbacksAMD64() (err error) {
+	var visit func(off uint64, seen map[uint64]bool) bool
+	visit = func(off uint64, seen map[uint64]bool) bool {
+		if seen[off] {
+			return false
+		}
+		seen[off] = true
+		frame := st.sFnFrame[off]
+		for _, targets := range [][]uint64{frame.Calls, frame.TailCalls} {
+			for _, target := range targets {
+				if st.isCallback(target) {
+					return true
+				}
+				if callee, ok := st.funcAt(target); ok && visit(callee, seen) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for _, off := range st.sFnOrder {
+		opts, ok := st.sFnOpts[off]
+		if !ok || opts.SystemStack {
+			continue
+		}
+		if visit(off, map[uint64]bool{}) {
+			opts.SystemStack = true
+			st.sFnOpts[off] = opts
+		}
+	}
+	return
+}
+
+// writeCallbacksAMD64 writes a callback for every exported Go func.
+func (st *LinkState) writeCallbacksAMD64(bio *bufio.Writer) (err error) {
+	for _, sym := range st.sExportOrder {
+		err = st.writeCallbackAMD64(bio, sym, st.sExport[sym])
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (st *LinkState) writeCallbackAMD64(bio *bufio.Writer, sym string, fn *ast.FuncDecl) (err error) {
+	fnName := fn.Name.Name
+	var opts hdr.FuncOptions
+	opts, err = st.hdr.GetFuncOptions(fn)
+	if err != nil {
+		return
+	}
+	if opts.Errno {
+		return fmt.Errorf("func %s: //golinker:errno is not supported on a callback", fnName)
+	}
+	args, rets, fnArgRetSz, err := st.hdr.GetFuncArgRetSize(fn)
+	if err != nil {
+		return
+	}
+	for _, v := range args {
+		if _, ok := v.Type.Underlying().(*types.Slice); ok && opts.SliceParts < 2 {
+			return fmt.Errorf("func %s: []T arg %s needs a length, //golinker:slice ptr,len", fnName, v.Name)
+		}
+	}
+	var call sysvCallAMD64
+	call, err = lowerSysVCallAMD64(st.hdr, fnName, args, rets, opts)
+	if err != nil {
+		return
+	}
+
+	// arg registers are saved in the order they are used.
+	slots := map[string]uint64{}
+	var regs []string
+	save := func(reg string) {
+		if _, ok := slots[reg]; !ok {
+			slots[reg] = uint64(len(regs)) * 8
+			regs = append(regs, reg)
+		}
+	}
+	if call.sret {
+		save("DI")
+	}
+	for _, val := range call.args {
+		for _, p := range val.pieces {
+			if p.reg != "" {
+				save(p.reg)
+			}
+		}
+	}
+	area := uint64(len(regs)) * 8
+	// stack args of the native caller, above its return address.
+	stackArgs := area + uint64(len(callbackSavedRegsAMD64))*8 + 8
+	size := st.nativeStackSize()
+
+	// --- switch to the goroutine stack ---
+	bio.WriteString(fmt.Sprintf("// %s calls back %s.\n", sym, fnName))
+	bio.WriteString(fmt.Sprintf("TEXT %s(SB), NOSPLIT|NOFRAME, $0\n", sym))
+	bio.WriteString("\tNO_LOCAL_POINTERS\n")
+	for _, reg := range callbackSavedRegsAMD64 {
+		bio.WriteString(fmt.Sprintf("\tPUSHQ %s\n", reg))
+	}
+	if area > 0 {
+		bio.WriteString(fmt.Sprintf("\tSUBQ $%d, SP\n", area))
+	}
+	for _, reg := range regs {
+		mov := "MOVQ"
+		if reg[0] == 'X' {
+			mov = "MOVSD"
+		}
+		bio.WriteString(fmt.Sprintf("\t%s %s, %d(SP)\n", mov, reg, slots[reg]))
+	}
+	bio.WriteString("\tMOVQ SP, R12\n")
+	writeStackTopAMD64(bio, "R12", "R11", size)
+	bio.WriteString("\tMOVQ -16(R11), BP\n")
+	bio.WriteString("\tMOVQ -8(R11), SP\n")
+	bio.WriteString(fmt.Sprintf("\tJMP ·%s__callback(SB)\n\n", fnName))
+
+	// --- call the Go func ---
+	// BP is pushed by hand and the frame made with ADJSP, the runtime
+	// unwinds the bridge and only tracks those.
+	frame := (fnArgRetSz+7)&^7 + 8
+	bio.WriteString(fmt.Sprintf("TEXT ·%s__callback(SB), NOSPLIT|NOFRAME, $0\n", fnName))
+	bio.WriteString("\tNO_LOCAL_POINTERS\n")
+	bio.WriteString("\tPUSHQ BP\n")
+	bio.WriteString("\tMOVQ SP, BP\n")
+	bio.WriteString(fmt.Sprintf("\tADJSP $%d\n", frame))
+	bio.WriteString(fmt.Sprintf("\tMOVQ R12, %d(SP)\n", frame-8))
+	for _, val := range call.args {
+		if val.onStack() {
+			for _, f := range val.fields {
+				writeCopyFieldAMD64(bio, f.Size,
+					fmt.Sprintf("%d(R12)", stackArgs+val.stackOff+f.Offset-val.v.Offset),
+					fmt.Sprintf("%d(SP)", f.Offset))
+			}
+			continue
+		}
+		for _, p := range val.pieces {
+			for _, f := range p.fields {
+				writeCopyFieldAMD64(bio, f.Size,
+					fmt.Sprintf("%d(R12)", slots[p.reg]+f.Offset-p.off),
+					fmt.Sprintf("%d(SP)", f.Offset))
+			}
+		}
+	}
+	// a slice passed as (ptr, len) gets cap = len.
+	for _, v := range args {
+		if _, ok := v.Type.Underlying().(*types.Slice); ok && opts.SliceParts == 2 {
+			bio.WriteString(fmt.Sprintf("\tMOVQ %d(SP), R11\n", v.Offset+8))
+			bio.WriteString(fmt.Sprintf("\tMOVQ R11, %d(SP)\n", v.Offset+16))
+		}
+	}
+	bio.WriteString(fmt.Sprintf("\tCALL ·%s(SB)\n", fnName))
+	bio.WriteString(fmt.Sprintf("\tMOVQ %d(SP), R12\n", frame-8))
+	switch {
+	case call.sret:
+		// the result goes where the native caller asked, the address
+		// is returned in AX.
+		bio.WriteString(fmt.Sprintf("\tMOVQ %d(R12), AX\n", slots["DI"]))
+		for _, f := range call.ret.fields {
+			writeCopyFieldAMD64(bio, f.Size,
+				fmt.Sprintf("%d(SP)", f.Offset),
+				fmt.Sprintf("%d(AX)", f.Offset-call.ret.v.Offset))
+		}
+	case call.ret != nil:
+		for _, p := range call.ret.pieces {
+			writeLoadPiece(bio, p, spRef)
+		}
+	}
+	bio.WriteString(fmt.Sprintf("\tADJSP $-%d\n", frame))
+	bio.WriteString("\tPOPQ BP\n")
+	bio.WriteString(fmt.Sprintf("\tJMP ·%s__resume(SB)\n\n", fnName))
+
+	// --- back to the native stack ---
+	bio.WriteString(fmt.Sprintf("TEXT ·%s__resume(SB), NOSPLIT|NOFRAME, $0\n", fnName))
+	bio.WriteString("\tNO_LOCAL_POINTERS\n")
+	writeStackTopAMD64(bio, "R12", "R11", size)
+	bio.WriteString("\tMOVQ SP, -8(R11)\n")
+	bio.WriteString("\tMOVQ BP, -16(R11)\n")
+	// the pushes of the switch are undone by hand, the assembler only
+	// balances the pushes of the same func.
+	n := uint64(len(callbackSavedRegsAMD64))
+	bio.WriteString(fmt.Sprintf("\tLEAQ %d(R12), R11\n", area+n*8))
+	// R12 is the base, restored last.
+	var r12 uint64
+	for i, reg := range callbackSavedRegsAMD64 {
+		off := area + (n-1-uint64(i))*8
+		if reg == "R12" {
+			r12 = off
+			continue
+		}
+		bio.WriteString(fmt.Sprintf("\tMOVQ %d(R12), %s\n", off, reg))
+	}
+	bio.WriteString(fmt.Sprintf("\tMOVQ %d(R12), R12\n", r12))
+	bio.WriteString("\tMOVQ R11, SP\n")
+	_, err = bio.WriteString("\tRET\n\n")
+	return
+}
+
+// writeStackTopAMD64 computes the top of the pool stack sp is on, in
+// reg.
+func writeStackTopAMD64(bio *bufio.Writer, sp, reg string, size uint64) {
+	bio.WriteString(fmt.Sprintf("\tMOVQ %s, %s\n", sp, reg))
+	bio.WriteString(fmt.Sprintf("\tANDQ $~%d, %s\n", size-1, reg))
+	bio.WriteString(fmt.Sprintf("\tADDQ $%d, %s\n", size, reg))
+}
+
+// writeCopyFieldAMD64 copies a scalar through R11.
+func writeCopyFieldAMD64(bio *bufio.Writer, size uint64, src, dst string) {
+	load := "MOVQ"
+	switch size {
+	case 4:
+		load = "MOVL"
+	case 2:
+		load = "MOVWLZX"
+	case 1:
+		load = "MOVBLZX"
+	}
+	bio.WriteString(fmt.Sprintf("\t%s %s, R11\n", load, src))
+	bio.WriteString(fmt.Sprintf("\t%s R11, %s\n", movFromSizeAMD64(size), dst))
+}
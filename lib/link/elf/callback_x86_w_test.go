@@ -0,0 +1,211 @@
+package elf
+
+import (
+	"bufio"
+	"bytes"
+	"go/ast"
+	"testing"
+
+	"github.com/ii64/golinker/lib/disasm2"
+	"github.com/stretchr/testify/assert"
+)
+
+const callbackTestSrc = `package stub
+
+import "syscall"
+
+type box struct{ a, b, c int64 }
+
+func run(n int64) (r int64)
+func idle(n int64) (r int64)
+
+//golinker:export go_add
+func goAdd(a int64, x float64) int64 { return a + int64(x) }
+
+//golinker:export go_box
+func goBox(v int64) box { return box{v, v + 1, v + 2} }
+
+//golinker:export
+//golinker:errno
+func fail() (err syscall.Errno) { return 0 }
+`
+
+func newCallbackTestState(t *testing.T) (st *LinkState, offs map[string]uint64) {
+	st, offs = newStubTestState(t, callbackTestSrc)
+	st.sExport = map[string]*ast.FuncDecl{}
+	for _, fn := range st.hdr.GetFuncDecls(true) {
+		opts, err := st.hdr.GetFuncOptions(fn)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		if opts.Export != "" {
+			st.sExport[opts.Export] = fn
+			st.sExportOrder = append(st.sExportOrder, opts.Export)
+		}
+	}
+	return
+}
+
+func genCallbackAMD64(t *testing.T, st *LinkState, sym string) (string, error) {
+	var buf bytes.Buffer
+	bio := bufio.NewWriter(&buf)
+	err := st.writeCallbackAMD64(bio, sym, st.sExport[sym])
+	bio.Flush()
+	return buf.String(), err
+}
+
+func TestCallbackAMD64(t *testing.T) {
+	st, _ := newCallbackTestState(t)
+	assert.Equal(t, []string{"go_add", "go_box", "fail"}, st.sExportOrder)
+
+	out, err := genCallbackAMD64(t, st, "go_add")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// the args are saved below the callee saved registers, then the
+	// goroutine SP and BP come from the header of the pool stack.
+	assert.Contains(t, out, "TEXT go_add(SB), NOSPLIT|NOFRAME, $0\n\tNO_LOCAL_POINTERS\n"+
+		"\tPUSHQ BP\n\tPUSHQ BX\n\tPUSHQ R12\n\tPUSHQ R13\n\tPUSHQ R14\n\tPUSHQ R15\n"+
+		"\tSUBQ $16, SP\n\tMOVQ DI, 0(SP)\n\tMOVSD X0, 8(SP)\n"+
+		"\tMOVQ SP, R12\n\tMOVQ R12, R11\n\tANDQ $~8388607, R11\n\tADDQ $8388608, R11\n"+
+		"\tMOVQ -16(R11), BP\n\tMOVQ -8(R11), SP\n\tJMP ·goAdd__callback(SB)\n")
+	assert.Contains(t, out, "TEXT ·goAdd__callback(SB), NOSPLIT|NOFRAME, $0\n\tNO_LOCAL_POINTERS\n"+
+		"\tPUSHQ BP\n\tMOVQ SP, BP\n\tADJSP $32\n\tMOVQ R12, 24(SP)\n"+
+		"\tMOVQ 0(R12), R11\n\tMOVQ R11, 0(SP)\n"+
+		"\tMOVQ 8(R12), R11\n\tMOVQ R11, 8(SP)\n"+
+		"\tCALL ·goAdd(SB)\n\tMOVQ 24(SP), R12\n\tMOVQ 16(SP), AX\n"+
+		"\tADJSP $-32\n\tPOPQ BP\n\tJMP ·goAdd__resume(SB)\n")
+	// the goroutine stack may have moved, R12 goes back last.
+	assert.Contains(t, out, "TEXT ·goAdd__resume(SB), NOSPLIT|NOFRAME, $0\n\tNO_LOCAL_POINTERS\n"+
+		"\tMOVQ R12, R11\n\tANDQ $~8388607, R11\n\tADDQ $8388608, R11\n"+
+		"\tMOVQ SP, -8(R11)\n\tMOVQ BP, -16(R11)\n\tLEAQ 64(R12), R11\n"+
+		"\tMOVQ 56(R12), BP\n\tMOVQ 48(R12), BX\n\tMOVQ 32(R12), R13\n"+
+		"\tMOVQ 24(R12), R14\n\tMOVQ 16(R12), R15\n\tMOVQ 40(R12), R12\n"+
+		"\tMOVQ R11, SP\n\tRET\n")
+
+	// a struct result goes where DI points.
+	out, err = genCallbackAMD64(t, st, "go_box")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Contains(t, out, "\tSUBQ $16, SP\n\tMOVQ DI, 0(SP)\n\tMOVQ SI, 8(SP)\n")
+	assert.Contains(t, out, "\tMOVQ 8(R12), R11\n\tMOVQ R11, 0(SP)\n\tCALL ·goBox(SB)\n")
+	assert.Contains(t, out, "\tMOVQ 0(R12), AX\n"+
+		"\tMOVQ 8(SP), R11\n\tMOVQ R11, 0(AX)\n"+
+		"\tMOVQ 16(SP), R11\n\tMOVQ R11, 8(AX)\n"+
+		"\tMOVQ 24(SP), R11\n\tMOVQ R11, 16(AX)\n")
+
+	_, err = genCallbackAMD64(t, st, "fail")
+	assert.EqualError(t, err, "func fail: //golinker:errno is not supported on a callback")
+}
+
+func TestBindCallbacksAMD64(t *testing.T) {
+	st, offs := newCallbackTestState(t)
+	st.sExtSym[0x100] = "go_add"
+	st.sExtSym[0x108] = "malloc"
+	st.sFnFrame[offs["run"]] = disasm2.StackFrame{Calls: []uint64{0x100}}
+	st.sFnFrame[offs["idle"]] = disasm2.StackFrame{Calls: []uint64{0x108}}
+
+	assert.NoError(t, st.bindCallbacksAMD64())
+	assert.True(t, st.sFnOpts[offs["run"]].SystemStack)
+	assert.False(t, st.sFnOpts[offs["idle"]].SystemStack)
+}
+
+func TestStubCallbackAMD64(t *testing.T) {
+	// the callbacks collect garbage and grow the goroutine stack while
+	// the native code waits for them.
+	out, ok := runStubProgramAMD64(t, `#include <stdint.h>
+struct box { int64_t a, b, c; };
+extern int64_t go_add(int64_t a, int64_t b);
+extern double go_scale(double x, int32_t k);
+extern struct box go_box(int64_t v);
+extern int64_t go_len(const char *p, int64_t n);
+extern int64_t go_many(int64_t a, int64_t b, int64_t c, int64_t d,
+	int64_t e, int64_t f, int64_t g, int8_t h);
+
+int64_t use(int64_t x) {
+	int64_t s = 0;
+	for (int i = 0; i < 4; i++)
+		s += go_add(x, i);
+	return s * 2;
+}
+double usef(double x) { return go_scale(x, 4); }
+int64_t usebox(int64_t v) {
+	struct box b = go_box(v);
+	return b.a + b.b * 10 + b.c * 100;
+}
+int64_t uselen(const char *p, int64_t n) {
+	return go_len(p, n) + go_many(1, 2, 3, 4, 5, 6, 7, -8);
+}
+`, `package main
+
+import "runtime"
+
+type box struct{ a, b, c int64 }
+
+func use(x int64) (r int64)
+func usef(x float64) (r float64)
+func usebox(v int64) (r int64)
+func uselen(s string) (r int64)
+
+func grow(d int, v int64) int64 {
+	var pad [128]byte
+	pad[d%128] = 1
+	if d == 0 {
+		return v
+	}
+	return grow(d-1, v) + int64(pad[d%128]) - 1
+}
+
+//golinker:export go_add
+func goAdd(a, b int64) int64 {
+	runtime.GC()
+	return grow(200, a) + b
+}
+
+//golinker:export go_scale
+func goScale(x float64, k int32) float64 { return x * float64(k) }
+
+//golinker:export go_box
+func goBox(v int64) box { return box{v, v + 1, v + 2} }
+
+//golinker:export go_len
+func goLen(p []byte) int64 { return int64(len(p)*cap(p)) * int64(p[1]) / 5 }
+
+//golinker:export go_many
+func goMany(a, b, c, d, e, f, g int64, h int8) int64 {
+	return a + b + c + d + e + f + g*100 + int64(h)*1000
+}
+`, `package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+func main() {
+	var wg sync.WaitGroup
+	var failed int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+			if got, want := use(i), 2*(4*i+6); got != want {
+				fmt.Fprintf(os.Stderr, "got %d, want %d\n", got, want)
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&failed) != 0 {
+		os.Exit(1)
+	}
+	fmt.Println(usef(1.5), usebox(3), uselen("hello"))
+}
+`)
+	if ok {
+		assert.Equal(t, "6 543 -6774\n", out)
+	}
+}
@@ -15,3 +15,22 @@ func (st *LinkState) doDisasm() (err error) {
 	}
 	return fmt.Errorf("unsupported arch disasm")
 }
+
+func (st *LinkState) analyzeStack() (err error) {
+	switch st.Arch {
+	case "amd64":
+		return st.analyzeStackAMD64()
+	}
+	return
+}
+
+func (st *LinkState) bindCallbacks() (err error) {
+	if len(st.sExport) == 0 {
+		return
+	}
+	switch st.Arch {
+	case "amd64":
+		return st.bindCallbacksAMD64()
+	}
+	return fmt.Errorf("//golinker:export is not supported on %s", st.Arch)
+}
@@ -14,6 +14,8 @@ func (st *LinkState) doDisasm386() (err error) {
 
 func (st *LinkState) doDisasmAMD64() (err error) {
 	var insts []gs.Instruction
+	var verify [disasm2.Fallback + 1]int
+	var failed []string
 
 	for _, fnAddr := range st.sFnOrder {
 		code, exist := st.sFn[fnAddr]
@@ -41,13 +43,16 @@ func (st *LinkState) doDisasmAMD64() (err error) {
 			return
 		}
 
-		fs := disasm2.ArchAMD64.GoSyntaxBlock(insts, fnAddr, st.resolveSymbol2, nil)
-
 		fmt.Printf("---- %s (%x) stk:%d ----\n", fnName, fnAddr, st.sFnStackSz[fnAddr])
 		for i, _ := range insts {
 			inst := &insts[i]
-			asmfmt := fs[i]
 			addr := uint64(inst.Address)
+			asmfmt, err := disasm2.ArchAMD64.GoSyntax(*inst, addr, st.resolveSymbol2, nil)
+			if err != nil {
+				// keep going, every instruction is reported at once.
+				failed = append(failed, fmt.Sprintf("%s: %s", fnName, err))
+				continue
+			}
 
 			// !! check for entry-relative call/jmp
 			// by checking the string operand
@@ -58,16 +63,24 @@ func (st *LinkState) doDisasmAMD64() (err error) {
 					asmstrs = append(asmstrs, ts.Asm)
 				}
 				tmp.Asm = strings.Join(asmstrs, "; ")
+				tmp.Verify = disasm2.Fallback
 				st.sIns[addr] = tmp
 			} else {
 				st.sIns[addr] = asmfmt
 			}
 
 			st.sInsList = append(st.sInsList, addr)
+			verify[st.sIns[addr].Verify]++
 
 			fmt.Printf("%x:\t%s\n", inst.Address, asmfmt)
 		}
 	}
+	fmt.Printf("---- verified %d, fallback %d, unverified %d ----\n",
+		verify[disasm2.Verified], verify[disasm2.Fallback], verify[disasm2.Unverified])
+	if len(failed) > 0 {
+		err = fmt.Errorf("%d instructions not translated, -fallback-rawbytes-x86 writes them as raw bytes:\n\t%s",
+			len(failed), strings.Join(failed, "\n\t"))
+	}
 	return
 }
 
@@ -80,8 +93,10 @@ func (st *LinkState) inspectInstsAMD64(fnOff uint64, insts []gs.Instruction) (er
 	// In x86, [noun] can laying down data within the .text section
 	// See https://9p.io/sys/doc/asm.html about "Laying down data"
 
-	// compute stack size
-	st.sFnStackSz[fnOff] = disasm2.ArchAMD64.StackSize(insts)
+	// compute stack frame, the callees are added by analyzeStackAMD64.
+	frame := disasm2.ArchAMD64.StackFrame(insts)
+	st.sFnFrame[fnOff] = frame
+	st.sFnStackSz[fnOff] = frame.Size
 
 	// register empty instruction addr
 	for _, inst := range insts {
@@ -0,0 +1,198 @@
+package elf
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strings"
+
+	"github.com/ii64/golinker/lib/cdecl"
+	"github.com/ii64/golinker/lib/hdr"
+)
+
+// checkDWARF cross-checks the stub signatures against the DWARF of the
+// object, if it has any. A mismatch in arg count, size or class would
+// corrupt registers at run time.
+func (st *LinkState) checkDWARF() (err error) {
+	if st.Arch != "amd64" {
+		return
+	}
+	d, errx := st.File.DWARF()
+	if errx != nil {
+		// built without -g.
+		return
+	}
+	var f *cdecl.File
+	f, err = cdecl.FromDWARF(d, "object", st.Arch)
+	if err != nil {
+		return fmt.Errorf("dwarf: %w", err)
+	}
+	cfns := map[string]*cdecl.FuncDecl{}
+	for _, d := range f.Decls {
+		if fn, ok := d.(*cdecl.FuncDecl); ok {
+			cfns[fn.Name] = fn
+		}
+	}
+
+	var errs []string
+	for _, off := range st.sFnOrder {
+		fn, ok := st.sFnHdr[off]
+		if !ok {
+			continue
+		}
+		opts := st.sFnOpts[off]
+		cfn, ok := cfns[opts.Symbol]
+		if !ok {
+			continue
+		}
+		errs = append(errs, checkSignatureAMD64(st.hdr, fn, opts, cfn)...)
+	}
+	if len(errs) > 0 {
+		err = fmt.Errorf("stub does not match DWARF:\n%s", strings.Join(errs, "\n"))
+	}
+	return
+}
+
+// checkSignatureAMD64 compares the lowered args and result of a stub
+// func with the C prototype.
+func checkSignatureAMD64(h hdr.Hdr, fn *ast.FuncDecl, opts hdr.FuncOptions, cfn *cdecl.FuncDecl) (errs []string) {
+	errorf := func(pos token.Pos, format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf("%s: func %s: %s",
+			h.Fset.Position(pos), fn.Name.Name, fmt.Sprintf(format, args...)))
+	}
+	if cfn.Type.Variadic {
+		errorf(fn.Pos(), "%s is variadic", cfn.Name)
+		return
+	}
+
+	args, rets, _, err := h.GetFuncArgRetSize(fn)
+	if err != nil {
+		errorf(fn.Pos(), "%s", err)
+		return
+	}
+	args, err = decomposeSysV(h, args, opts)
+	if err != nil {
+		errorf(fn.Pos(), "%s", err)
+		return
+	}
+	if opts.Errno && len(rets) > 0 {
+		rets = rets[:len(rets)-1]
+	}
+
+	if len(args) != len(cfn.Type.Params) {
+		errorf(fn.Pos(), "%d args, %s takes %d", len(args), cfn.Name, len(cfn.Type.Params))
+		return
+	}
+	for i, v := range args {
+		val, err := classifySysV(h, v)
+		if err != nil {
+			errorf(fn.Pos(), "%s", err)
+			continue
+		}
+		if msg := compareSysV(val, cfn.Type.Params[i].Type); msg != "" {
+			errorf(paramPos(fn, v.Name), "arg %s: %s", v.Name, msg)
+		}
+	}
+
+	_, void := cdecl.Underlying(cfn.Type.Result).(cdecl.Void)
+	switch {
+	case len(rets) == 0 && opts.Errno && void:
+		errorf(fn.Pos(), "errno needs a result, %s returns void", cfn.Name)
+	case len(rets) == 0 && opts.Errno:
+		if c := cEightbytes(cfn.Type.Result); len(c) != 1 || c[0] != sysvInteger {
+			errorf(fn.Pos(), "errno needs an integer result, %s returns %s", cfn.Name, cfn.Type.Result)
+		}
+	case len(rets) == 0 && !void:
+		errorf(fn.Pos(), "missing result, %s returns %s", cfn.Name, cfn.Type.Result)
+	case len(rets) > 0 && void:
+		errorf(paramPos(fn, rets[0].Name), "%s returns void", cfn.Name)
+	case len(rets) > 0:
+		val, err := classifySysVResults(h, rets)
+		if err != nil {
+			errorf(fn.Pos(), "%s", err)
+			break
+		}
+		if msg := compareSysV(val, cfn.Type.Result); msg != "" {
+			errorf(paramPos(fn, rets[0].Name), "result: %s", msg)
+		}
+	}
+	return
+}
+
+// compareSysV reports how a classified Go value differs from the C
+// type, empty if both are passed the same way.
+func compareSysV(val sysvValue, t cdecl.Type) string {
+	if _, ok := cdecl.Underlying(t).(cdecl.Unsupported); ok {
+		return fmt.Sprintf("C type %s is not supported", t)
+	}
+	if uint64(t.Size()) != val.v.Size {
+		return fmt.Sprintf("size %d, C has %d (%s)", val.v.Size, t.Size(), t)
+	}
+	goClasses := []sysvClass{val.class}
+	if !val.onStack() {
+		goClasses = goClasses[:0]
+		for _, p := range val.pieces {
+			goClasses = append(goClasses, p.class)
+		}
+	}
+	cClasses := cEightbytes(t)
+	if fmt.Sprint(goClasses) != fmt.Sprint(cClasses) {
+		return fmt.Sprintf("class %v, C has %v (%s)", goClasses, cClasses, t)
+	}
+	return ""
+}
+
+// cEightbytes classifies a C type per eightbyte, like classifySysV.
+func cEightbytes(t cdecl.Type) []sysvClass {
+	if t.Size() > 16 {
+		return []sysvClass{sysvMemory}
+	}
+	classes := make([]sysvClass, (t.Size()+7)/8)
+	var walk func(t cdecl.Type, off int64)
+	walk = func(t cdecl.Type, off int64) {
+		switch u := cdecl.Underlying(t).(type) {
+		case *cdecl.Struct:
+			for _, f := range u.Fields {
+				walk(f.Type, off+f.Offset)
+			}
+		case cdecl.Array:
+			for i := int64(0); i < u.Len; i++ {
+				walk(u.Elem, off+i*u.Elem.Size())
+			}
+		case cdecl.Float:
+			if classes[off/8] == sysvNoClass {
+				classes[off/8] = sysvSSE
+			}
+		case cdecl.Void:
+		default:
+			classes[off/8] = sysvInteger
+		}
+	}
+	walk(t, 0)
+	return classes
+}
+
+// paramPos finds the stub position of a param or result from its asm
+// name, a decomposed arg like b_base is found as b.
+func paramPos(fn *ast.FuncDecl, name string) token.Pos {
+	lists := []*ast.FieldList{fn.Type.Params, fn.Type.Results}
+	names := []string{name}
+	if i := strings.LastIndex(name, "_"); i > 0 {
+		names = append(names, name[:i])
+	}
+	for _, n := range names {
+		for _, l := range lists {
+			if l == nil {
+				continue
+			}
+			for _, f := range l.List {
+				for _, id := range f.Names {
+					if id.Name == n {
+						return id.Pos()
+					}
+				}
+			}
+		}
+	}
+	return fn.Pos()
+}
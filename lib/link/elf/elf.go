@@ -17,6 +17,9 @@ type LinkState struct {
 	File *elf.File
 	Arch string
 
+	// Warnings holds the problems found that do not stop the link.
+	Warnings []string
+
 	sBaseAddr uint64
 	sSymbols  []elf.Symbol
 
@@ -26,12 +29,16 @@ type LinkState struct {
 
 	// hold starting PC, and prog data that's linked with sTextContent
 	sFn        map[uint64][]byte
-	sFnStackSz map[uint64]uint64
+	sFnStackSz map[uint64]uint64 // worst case, callees included
+	sFnFrame   map[uint64]disasm2.StackFrame
 	sFnName    map[uint64]string
 	sFnSize    map[uint64]uint64
 	sFnOrder   []uint64
 	sFnLastOff uint64
 
+	// why the stack size is not a bound
+	sFnStackUnbounded map[uint64]string
+
 	// disasm inst with its PC
 	sIns     map[uint64]disasm2.Text
 	sInsList []uint64
@@ -43,9 +50,14 @@ type LinkState struct {
 	sLabelSym       map[uint64]string
 	sComment        map[uint64]string // comment on instr
 
-	cfg    *conf.Config
-	hdr    hdr.Hdr
-	sFnHdr map[uint64]*ast.FuncDecl
+	cfg     *conf.Config
+	hdr     hdr.Hdr
+	sFnHdr  map[uint64]*ast.FuncDecl
+	sFnOpts map[uint64]hdr.FuncOptions
+
+	// Go funcs called back through an external symbol
+	sExport      map[string]*ast.FuncDecl
+	sExportOrder []string
 }
 
 func New(cfg *conf.Config, o *elf.File) (st *LinkState, err error) {
@@ -63,6 +75,8 @@ func New(cfg *conf.Config, o *elf.File) (st *LinkState, err error) {
 
 	st.sFn = map[uint64][]byte{}
 	st.sFnStackSz = map[uint64]uint64{}
+	st.sFnFrame = map[uint64]disasm2.StackFrame{}
+	st.sFnStackUnbounded = map[uint64]string{}
 	st.sFnName = map[uint64]string{}
 	st.sFnSize = map[uint64]uint64{}
 
@@ -74,6 +88,8 @@ func New(cfg *conf.Config, o *elf.File) (st *LinkState, err error) {
 	st.sComment = map[uint64]string{}
 
 	st.sFnHdr = map[uint64]*ast.FuncDecl{}
+	st.sFnOpts = map[uint64]hdr.FuncOptions{}
+	st.sExport = map[string]*ast.FuncDecl{}
 
 	if err = st.init(); err != nil {
 		return
@@ -108,6 +124,11 @@ func (st *LinkState) init() (err error) {
 		return
 	}
 
+	err = st.checkDWARF()
+	if err != nil {
+		return
+	}
+
 	// load relocation
 	err = st.getRelocation()
 	if err != nil {
@@ -119,6 +140,18 @@ func (st *LinkState) init() (err error) {
 	if err != nil {
 		return
 	}
+
+	// stubs reaching a callback
+	err = st.bindCallbacks()
+	if err != nil {
+		return
+	}
+
+	// stack use along the call graph
+	err = st.analyzeStack()
+	if err != nil {
+		return
+	}
 	return
 }
 
@@ -155,26 +188,81 @@ func (st *LinkState) parseHeader() (err error) {
 	if err != nil {
 		return
 	}
+	// the Go funcs of the stdio shims are declared after the stub.
+	exported := map[string]bool{}
+	for _, fn := range st.hdr.GetFuncDecls(true) {
+		if opts, errx := st.hdr.GetFuncOptions(fn); errx == nil && opts.Export != "" {
+			exported[opts.Export] = true
+		}
+	}
+	if syms := st.stdioUndefined(exported); len(syms) > 0 {
+		if err = st.checkStdioNames(syms); err != nil {
+			return
+		}
+		st.hdr, err = hdr.ParseFile(st.cfg.StubFile, string(bb)+st.stdioHdrSource(syms), st.Arch)
+		if err != nil {
+			return
+		}
+	}
 
 	for _, fn := range st.hdr.GetFuncDecls(false) {
+		if st.isStdioDecl(fn) {
+			continue
+		}
 		astFnName := fn.Name.Name
-		if astFnName == "native_entry" {
-			err = fmt.Errorf("reserved func name: %s", astFnName)
+		var opts hdr.FuncOptions
+		opts, err = st.hdr.GetFuncOptions(fn)
+		if err != nil {
+			return
+		}
+		if opts.Symbol == "native_entry" {
+			err = fmt.Errorf("reserved func name: %s", opts.Symbol)
 			return
 		}
 		var found = false
 		for off, nm := range st.sFnName {
-			if nm == astFnName {
+			if nm == opts.Symbol {
+				if prev, bound := st.sFnHdr[off]; bound {
+					err = fmt.Errorf("func %s: symbol %s is already bound to %s",
+						astFnName, nm, prev.Name.Name)
+					return
+				}
 				st.sFnHdr[off] = fn
+				st.sFnOpts[off] = opts
 				found = true
 				break
 			}
 		}
 		if !found {
-			err = fmt.Errorf("func header is not used: %q, have %+#v", astFnName, st.sFnName)
+			err = fmt.Errorf("func header is not used: %q, have %+#v", opts.Symbol, st.sFnName)
 			return
 		}
 	}
+
+	for _, fn := range append(st.hdr.GetFuncDecls(true), st.stdioDecls()...) {
+		var opts hdr.FuncOptions
+		opts, err = st.hdr.GetFuncOptions(fn)
+		if err != nil {
+			return
+		}
+		if opts.Export == "" {
+			continue
+		}
+		if prev, ok := st.sExport[opts.Export]; ok {
+			err = fmt.Errorf("func %s: symbol %s is already exported by %s",
+				fn.Name.Name, opts.Export, prev.Name.Name)
+			return
+		}
+		for _, nm := range st.sFnName {
+			if nm == opts.Export {
+				err = fmt.Errorf("func %s: symbol %s is defined by the native code",
+					fn.Name.Name, opts.Export)
+				return
+			}
+		}
+		st.sExport[opts.Export] = fn
+		st.sExportOrder = append(st.sExportOrder, opts.Export)
+	}
 	return
 }
 
@@ -314,9 +402,7 @@ func (st *LinkState) loadProgbitSections() (err error) {
 		return
 	}
 
-	// !! add off with base
-	// var off = st.sBaseAddr
-	var progbitStartOff uint64 = 0
+	// !! sections are laid down one after the other, each aligned.
 	for i, s := range st.File.Sections {
 		if s.Type != elf.SHT_PROGBITS {
 			continue
@@ -324,26 +410,29 @@ func (st *LinkState) loadProgbitSections() (err error) {
 		if s.Flags&elf.SHF_ALLOC == 0 {
 			continue
 		}
-		if progbitStartOff == 0 {
-			progbitStartOff = s.Offset
-		}
 
-		off := uint64(int64(st.sBaseAddr) + int64(s.Offset) - int64(progbitStartOff))
+		off := uint64(len(st.sProgData))
 
-		if toAlign := off % s.Addralign; toAlign != 0 {
-			szNop := s.Addralign - toAlign
-			nops := st.archNop(int(szNop))
-			psuFnName := fmt.Sprintf("__%s_aligner%d_%d__%d",
-				st.cfg.NativeEntryName,
-				s.Addralign, szNop, off)
-			st.registerFunc(off, szNop, psuFnName)
-			st.sProgData = append(st.sProgData, nops...)
+		if s.Addralign > 1 && off%s.Addralign != 0 {
+			szPad := s.Addralign - off%s.Addralign
 			if s.Name == ".text" {
-				st.sBaseAddr += szNop
+				nops := st.archNop(int(szPad))
+				psuFnName := fmt.Sprintf("__%s_aligner%d_%d__%d",
+					st.cfg.NativeEntryName,
+					s.Addralign, szPad, off)
+				st.registerFunc(off, szPad, psuFnName)
+				st.sProgData = append(st.sProgData, nops...)
+			} else {
+				// data past the funcs, an aligner func would grow the
+				// last one over the data before it.
+				st.sProgData = append(st.sProgData, make([]byte, szPad)...)
 			}
 		}
 
-		off = uint64(int64(st.sBaseAddr) + int64(s.Offset) - int64(progbitStartOff))
+		off = uint64(len(st.sProgData))
+		if s.Name == ".text" {
+			st.sBaseAddr = off
+		}
 		// println(delta)
 
 		sectID := elf.SectionIndex(i)
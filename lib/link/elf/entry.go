@@ -38,12 +38,9 @@ func entryAMD64() (code []byte, fs []disasm2.Text) {
 		// lea    -0x7(%rip),%rax
 		0x48, 0x8d, 0x05, 0xf9, 0xff, 0xff, 0xff,
 
+		// MOVQ AX, ret+0(FP), the entry has no frame
 		// mov    %rax,0x8(%rsp)
-		// 0x48, 0x89, 0x44, 0x24, 0x08,
-
-		// MOVQ AX, ret+8(FP)
-		// mov    %rax,0x10(%rsp)
-		0x48, 0x89, 0x44, 0x24, 0x10,
+		0x48, 0x89, 0x44, 0x24, 0x08,
 
 		// ret
 		0xc3,
@@ -55,7 +52,10 @@ func entryAMD64() (code []byte, fs []disasm2.Text) {
 	if err != nil {
 		panic("entry disasm failed")
 	}
-	fs = disasm2.ArchAMD64.GoSyntaxBlock(insts, 0x0, nil, nil)
+	fs, err = disasm2.ArchAMD64.GoSyntaxBlock(insts, 0x0, nil, nil)
+	if err != nil {
+		panic("entry disasm failed")
+	}
 
 	return
 }
@@ -0,0 +1,177 @@
+package elf
+
+import (
+	"bufio"
+	"fmt"
+)
+
+// A libc shim is a built-in body for a libc function compilers call
+// even in freestanding code. It is linked in when the native code
+// leaves the symbol undefined and no Go func is exported under it.
+//
+// memcpy, memmove and the zero fill of memset call the runtime through
+// the ABI0 wrappers, which load g in R14 and clobber BX. Both are callee
+// saved in SysV and restored by the shim.
+type libcShimAMD64 struct {
+	// stack is the most native stack the shim uses below its return
+	// address.
+	stack uint64
+	write func(st *LinkState, bio *bufio.Writer, sym string)
+	// arena shims allocate from the malloc arena, they are linked only
+	// when the arena is enabled.
+	arena bool
+}
+
+// libcRuntimeStackAMD64 is the stack of a shim calling the runtime:
+// three saved registers, the ABI0 args and room for the wrapper frame.
+const libcRuntimeStackAMD64 = 128
+
+var libcShimsAMD64 = map[string]libcShimAMD64{
+	"memcpy":           {stack: libcRuntimeStackAMD64, write: writeMemmoveShimAMD64},
+	"memmove":          {stack: libcRuntimeStackAMD64, write: writeMemmoveShimAMD64},
+	"memset":           {stack: libcRuntimeStackAMD64, write: writeMemsetShimAMD64},
+	"memcmp":           {stack: 0, write: writeMemcmpShimAMD64},
+	"strlen":           {stack: 0, write: writeStrlenShimAMD64},
+	"__errno_location": {stack: 0, write: writeErrnoLocationShimAMD64},
+	"malloc":           {stack: 0, write: writeMallocShimAMD64, arena: true},
+	"free":             {stack: 0, write: writeFreeShimAMD64, arena: true},
+	"calloc":           {stack: 8, write: writeCallocShimAMD64, arena: true},
+	"realloc":          {stack: 8, write: writeReallocShimAMD64, arena: true},
+}
+
+// libcShim returns the shim bound to the external symbol at addr.
+func (st *LinkState) libcShim(addr uint64) (shim libcShimAMD64, ok bool) {
+	name, ok := st.sExtSym[addr]
+	if !ok {
+		return
+	}
+	return st.libcShimByName(name)
+}
+
+func (st *LinkState) libcShimByName(name string) (shim libcShimAMD64, ok bool) {
+	if _, exported := st.sExport[name]; exported {
+		return shim, false
+	}
+	shim, ok = libcShimsAMD64[name]
+	if shim.arena && st.cfg.MallocArenaSize == 0 {
+		return shim, false
+	}
+	return
+}
+
+// usesArena reports whether the native code calls an arena shim, the
+// offsets file then carries the arena.
+func (st *LinkState) usesArena() bool {
+	for _, name := range st.sExtSym {
+		if shim, ok := st.libcShimByName(name); ok && shim.arena {
+			return true
+		}
+	}
+	return false
+}
+
+func (st *LinkState) errnoName() string {
+	return st.cfg.NativeEntryName + "_errno"
+}
+
+// writeLibcShimsAMD64 writes the shims of the undefined symbols the
+// native code calls.
+func (st *LinkState) writeLibcShimsAMD64(bio *bufio.Writer) {
+	var arena bool
+	for _, off := range st.sExtSymOffOrder {
+		name := st.sExtSym[off]
+		if shim, ok := st.libcShimByName(name); ok {
+			shim.write(st, bio, name)
+			arena = arena || shim.arena
+		}
+	}
+	if arena {
+		st.writeArenaAMD64(bio)
+	}
+}
+
+func writeMemmoveShimAMD64(st *LinkState, bio *bufio.Writer, sym string) {
+	bio.WriteString(fmt.Sprintf("// %s is runtime·memmove.\n", sym))
+	bio.WriteString(fmt.Sprintf("TEXT %s(SB), NOSPLIT|NOFRAME, $0\n", sym))
+	bio.WriteString("\tPUSHQ BX\n")
+	bio.WriteString("\tPUSHQ R14\n")
+	bio.WriteString("\tPUSHQ DI\n")
+	bio.WriteString("\tADJSP $24\n")
+	bio.WriteString("\tMOVQ DI, 0(SP)\n")
+	bio.WriteString("\tMOVQ SI, 8(SP)\n")
+	bio.WriteString("\tMOVQ DX, 16(SP)\n")
+	bio.WriteString("\tCALL runtime·memmove(SB)\n")
+	bio.WriteString("\tADJSP $-24\n")
+	bio.WriteString("\tPOPQ AX\n")
+	bio.WriteString("\tPOPQ R14\n")
+	bio.WriteString("\tPOPQ BX\n")
+	bio.WriteString("\tRET\n\n")
+}
+
+func writeMemsetShimAMD64(st *LinkState, bio *bufio.Writer, sym string) {
+	bio.WriteString(fmt.Sprintf("// %s clears with runtime·memclrNoHeapPointers, other bytes\n", sym))
+	bio.WriteString("// are stored one by one.\n")
+	bio.WriteString(fmt.Sprintf("TEXT %s(SB), NOSPLIT|NOFRAME, $0\n", sym))
+	bio.WriteString("\tTESTB SI, SI\n")
+	bio.WriteString("\tJEQ clear\n")
+	bio.WriteString("\tMOVQ DI, R8\n")
+	bio.WriteString("\tMOVL SI, AX\n")
+	bio.WriteString("\tMOVQ DX, CX\n")
+	bio.WriteString("\tREP; STOSB\n")
+	bio.WriteString("\tMOVQ R8, AX\n")
+	bio.WriteString("\tRET\n")
+	bio.WriteString("clear:\n")
+	bio.WriteString("\tPUSHQ BX\n")
+	bio.WriteString("\tPUSHQ R14\n")
+	bio.WriteString("\tPUSHQ DI\n")
+	bio.WriteString("\tADJSP $16\n")
+	bio.WriteString("\tMOVQ DI, 0(SP)\n")
+	bio.WriteString("\tMOVQ DX, 8(SP)\n")
+	bio.WriteString("\tCALL runtime·memclrNoHeapPointers(SB)\n")
+	bio.WriteString("\tADJSP $-16\n")
+	bio.WriteString("\tPOPQ AX\n")
+	bio.WriteString("\tPOPQ R14\n")
+	bio.WriteString("\tPOPQ BX\n")
+	bio.WriteString("\tRET\n\n")
+}
+
+func writeMemcmpShimAMD64(st *LinkState, bio *bufio.Writer, sym string) {
+	bio.WriteString(fmt.Sprintf("// %s returns the difference of the first bytes that differ.\n", sym))
+	bio.WriteString(fmt.Sprintf("TEXT %s(SB), NOSPLIT|NOFRAME, $0\n", sym))
+	bio.WriteString("\tXORL AX, AX\n")
+	bio.WriteString("\tTESTQ DX, DX\n")
+	bio.WriteString("\tJEQ done\n")
+	bio.WriteString("loop:\n")
+	bio.WriteString("\tMOVBLZX (DI), AX\n")
+	bio.WriteString("\tMOVBLZX (SI), CX\n")
+	bio.WriteString("\tSUBL CX, AX\n")
+	bio.WriteString("\tJNE done\n")
+	bio.WriteString("\tINCQ DI\n")
+	bio.WriteString("\tINCQ SI\n")
+	bio.WriteString("\tDECQ DX\n")
+	bio.WriteString("\tJNE loop\n")
+	bio.WriteString("done:\n")
+	bio.WriteString("\tRET\n\n")
+}
+
+func writeStrlenShimAMD64(st *LinkState, bio *bufio.Writer, sym string) {
+	bio.WriteString(fmt.Sprintf("TEXT %s(SB), NOSPLIT|NOFRAME, $0\n", sym))
+	bio.WriteString("\tMOVQ DI, AX\n")
+	bio.WriteString("loop:\n")
+	bio.WriteString("\tCMPB (AX), $0\n")
+	bio.WriteString("\tJEQ done\n")
+	bio.WriteString("\tINCQ AX\n")
+	bio.WriteString("\tJMP loop\n")
+	bio.WriteString("done:\n")
+	bio.WriteString("\tSUBQ DI, AX\n")
+	bio.WriteString("\tRET\n\n")
+}
+
+// writeErrnoLocationShimAMD64 writes an errno shared by every thread,
+// the native code is not expected to rely on it.
+func writeErrnoLocationShimAMD64(st *LinkState, bio *bufio.Writer, sym string) {
+	bio.WriteString(fmt.Sprintf("GLOBL ·%s(SB), NOPTR, $8\n\n", st.errnoName()))
+	bio.WriteString(fmt.Sprintf("TEXT %s(SB), NOSPLIT|NOFRAME, $0\n", sym))
+	bio.WriteString(fmt.Sprintf("\tLEAQ ·%s(SB), AX\n", st.errnoName()))
+	bio.WriteString("\tRET\n\n")
+}
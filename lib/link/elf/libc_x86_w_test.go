@@ -0,0 +1,122 @@
+package elf
+
+import (
+	"bufio"
+	"bytes"
+	"go/ast"
+	"testing"
+
+	"github.com/ii64/golinker/lib/disasm2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLibcShimsAMD64(t *testing.T) {
+	st, offs := newStubTestState(t, `package stub
+
+func copy2(n int64) (r int64)
+func alloc(n int64) (r int64)
+
+//golinker:export
+func strlen(p *byte) int64 { return 0 }
+`)
+	st.sExport = map[string]*ast.FuncDecl{"strlen": st.hdr.GetFuncDecls(true)[0]}
+	for i, name := range []string{"memcpy", "malloc", "strlen", "__errno_location"} {
+		off := uint64(0x1000 + i)
+		st.sExtSym[off] = name
+		st.sExtSymOffOrder = append(st.sExtSymOffOrder, off)
+	}
+	st.sFnFrame[offs["copy2"]] = disasm2.StackFrame{Size: 0x10, Calls: []uint64{0x1000}}
+	st.sFnFrame[offs["alloc"]] = disasm2.StackFrame{Size: 0x10, Calls: []uint64{0x1001}}
+
+	// a shim is bounded, other externals are not.
+	assert.NoError(t, st.analyzeStackAMD64())
+	assert.Equal(t, uint64(0x10+8+libcRuntimeStackAMD64), st.sFnStackSz[offs["copy2"]])
+	assert.Equal(t, "", st.sFnStackUnbounded[offs["copy2"]])
+	assert.Equal(t, "alloc: calls external malloc", st.sFnStackUnbounded[offs["alloc"]])
+
+	var buf bytes.Buffer
+	bio := bufio.NewWriter(&buf)
+	st.writeLibcShimsAMD64(bio)
+	bio.Flush()
+	out := buf.String()
+	// BX and R14 are callee saved, the wrapper clobbers them.
+	assert.Contains(t, out, "TEXT memcpy(SB), NOSPLIT|NOFRAME, $0\n"+
+		"\tPUSHQ BX\n\tPUSHQ R14\n\tPUSHQ DI\n\tADJSP $24\n"+
+		"\tMOVQ DI, 0(SP)\n\tMOVQ SI, 8(SP)\n\tMOVQ DX, 16(SP)\n"+
+		"\tCALL runtime·memmove(SB)\n\tADJSP $-24\n"+
+		"\tPOPQ AX\n\tPOPQ R14\n\tPOPQ BX\n\tRET\n")
+	assert.Contains(t, out, "GLOBL ·__native_entry___errno(SB), NOPTR, $8\n\n"+
+		"TEXT __errno_location(SB), NOSPLIT|NOFRAME, $0\n"+
+		"\tLEAQ ·__native_entry___errno(SB), AX\n\tRET\n")
+	// the exported Go func wins.
+	assert.NotContains(t, out, "TEXT strlen(SB)")
+	assert.NotContains(t, out, "malloc")
+}
+
+func TestStubLibcShimsAMD64(t *testing.T) {
+	out, ok := runStubProgramAMD64(t, `#include <errno.h>
+#include <stdint.h>
+#include <string.h>
+
+int64_t cpy(char *dst, int64_t dn, const char *src, int64_t sn) {
+	memcpy(dst, src, sn);
+	return dst[0];
+}
+void shift(char *p, int64_t n) { memmove(p + 1, p, n - 1); }
+void fill(char *p, int64_t n, int64_t c) { memset(p, (int)c, n); }
+int64_t cmp(const char *a, int64_t an, const char *b, int64_t bn) {
+	return memcmp(a, b, an);
+}
+int64_t slen(const char *s) { return strlen(s); }
+int64_t seterr(int64_t v) {
+	errno = (int)v;
+	return *__errno_location() + 1;
+}
+`, `package main
+
+func cpy(dst, src []byte) (r int64)
+func shift(p []byte)
+func fill(p []byte, c int64)
+func cmp(a, b []byte) (r int64)
+func slen(s *byte) (r int64)
+func seterr(v int64) (r int64)
+`, `package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+func main() {
+	// past 2K memmove switches to REP MOVSQ.
+	src := make([]byte, 5000)
+	for i := range src {
+		src[i] = byte(i * 7)
+	}
+	dst := make([]byte, len(src))
+	cpy(dst, src)
+	small := make([]byte, 3)
+	cpy(small, src[:3])
+
+	p := []byte("abcdef")
+	shift(p)
+	q := append([]byte(nil), src...)
+	shift(q)
+
+	x := []byte("abc")
+	fill(x, 'x')
+	z := append([]byte(nil), src...)
+	fill(z, 0)
+
+	fmt.Println(bytes.Equal(dst, src), bytes.Equal(small, src[:3]))
+	fmt.Println(string(p), bytes.Equal(q[1:], src[:len(src)-1]))
+	fmt.Println(string(x), bytes.Equal(z, make([]byte, len(src))))
+	fmt.Println(cmp([]byte("abc"), []byte("abd")) < 0, cmp([]byte("abc"), []byte("abc")),
+		cmp([]byte("abz"), []byte("abc")) > 0)
+	fmt.Println(slen(&[]byte("hello\x00")[0]), seterr(7))
+}
+`)
+	if ok {
+		assert.Equal(t, "true true\naabcde true\nxxx true\ntrue 0 true\n5 8\n", out)
+	}
+}
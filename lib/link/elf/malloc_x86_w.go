@@ -0,0 +1,238 @@
+package elf
+
+import (
+	"bufio"
+	"fmt"
+)
+
+// The malloc arena is a block of Go memory the arena shims allocate
+// from, handed in at init so its use shows in the Go heap metrics.
+//
+// Blocks are a power of two in size, 32 bytes at least, with a header
+// of 16 bytes holding the size class and, once freed, the next block of
+// the free list of the class. A block is taken from its free list or
+// cut from the arena top, it is never split nor merged. The state is a
+// Go var the asm reads at fixed offsets, guarded by a spin lock.
+const (
+	arenaHeaderAMD64   = 16
+	arenaMinClassAMD64 = 5
+	arenaClassesAMD64  = 48
+
+	arenaLockOffAMD64 = 0
+	arenaNextOffAMD64 = 8
+	arenaEndOffAMD64  = 16
+	arenaUsedOffAMD64 = 24
+	arenaFreeOffAMD64 = 32
+)
+
+func (st *LinkState) arenaName() string {
+	return st.cfg.NativeEntryName + "_arena"
+}
+
+// writeArenaGoAMD64 writes the arena state and its Go API to the offsets
+// file.
+func (st *LinkState) writeArenaGoAMD64(bio *bufio.Writer) {
+	arena := st.arenaName()
+
+	bio.WriteString(fmt.Sprintf("// %s_size is the size of the arena malloc allocates from.\n", arena))
+	bio.WriteString(fmt.Sprintf("const %s_size = %d\n\n", arena, st.cfg.MallocArenaSize))
+	bio.WriteString(fmt.Sprintf("// %s is read by the native malloc at fixed offsets.\n", arena))
+	bio.WriteString(fmt.Sprintf("var %s struct {\n", arena))
+	bio.WriteString("\tlock uint32\n")
+	bio.WriteString("\t_    uint32\n")
+	bio.WriteString("\tnext uintptr\n")
+	bio.WriteString("\tend  uintptr\n")
+	bio.WriteString("\tused uintptr\n")
+	bio.WriteString(fmt.Sprintf("\tfree [%d]uintptr\n", arenaClassesAMD64))
+	bio.WriteString("\tmem  []byte\n")
+	bio.WriteString("}\n\n")
+
+	bio.WriteString("func init() {\n")
+	bio.WriteString(fmt.Sprintf("\t%s_init(%s_size)\n", arena, arena))
+	bio.WriteString("}\n\n")
+
+	bio.WriteString(fmt.Sprintf("// %s_init gives malloc a new arena of size bytes. It panics while\n", arena))
+	bio.WriteString("// blocks of the previous arena are in use.\n")
+	bio.WriteString(fmt.Sprintf("func %s_init(size uintptr) {\n", arena))
+	// make may stop the world, which never comes while the native malloc
+	// spins on the lock, so the arena is allocated before taking it.
+	bio.WriteString(fmt.Sprintf("\tmem := make([]byte, size+%d)\n", arenaHeaderAMD64))
+	bio.WriteString(fmt.Sprintf("\tstart := (uintptr(unsafe.Pointer(&mem[0])) + %d) &^ %d\n",
+		arenaHeaderAMD64-1, arenaHeaderAMD64-1))
+	bio.WriteString(fmt.Sprintf("\ta := &%s\n", arena))
+	bio.WriteString("\tfor !atomic.CompareAndSwapUint32(&a.lock, 0, 1) {\n")
+	bio.WriteString("\t\truntime.Gosched()\n")
+	bio.WriteString("\t}\n")
+	bio.WriteString("\tif a.used != 0 {\n")
+	bio.WriteString("\t\tatomic.StoreUint32(&a.lock, 0)\n")
+	bio.WriteString("\t\tpanic(\"golinker: arena in use\")\n")
+	bio.WriteString("\t}\n")
+	bio.WriteString("\ta.mem = mem\n")
+	bio.WriteString("\ta.next = start\n")
+	bio.WriteString("\ta.end = start + size\n")
+	bio.WriteString(fmt.Sprintf("\ta.free = [%d]uintptr{}\n", arenaClassesAMD64))
+	bio.WriteString("\tatomic.StoreUint32(&a.lock, 0)\n")
+	bio.WriteString("}\n\n")
+
+	bio.WriteString(fmt.Sprintf("// %s_used returns the bytes of the arena in allocated blocks.\n", arena))
+	bio.WriteString(fmt.Sprintf("func %s_used() uintptr {\n", arena))
+	bio.WriteString(fmt.Sprintf("\treturn atomic.LoadUintptr(&%s.used)\n", arena))
+	bio.WriteString("}\n\n")
+}
+
+func writeArenaLockAMD64(bio *bufio.Writer) {
+	bio.WriteString("lock:\n")
+	bio.WriteString("\tXORL AX, AX\n")
+	bio.WriteString("\tMOVL $1, DX\n")
+	bio.WriteString(fmt.Sprintf("\tLOCK; CMPXCHGL DX, %d(SI)\n", arenaLockOffAMD64))
+	bio.WriteString("\tJEQ locked\n")
+	bio.WriteString("\tPAUSE\n")
+	bio.WriteString("\tJMP lock\n")
+	bio.WriteString("locked:\n")
+}
+
+// writeArenaAMD64 writes the allocator the arena shims call, alloc
+// takes the size in DI and free the block in DI. Both clobber AX, CX,
+// DX, SI and DI only.
+func (st *LinkState) writeArenaAMD64(bio *bufio.Writer) {
+	arena := st.arenaName()
+	unlock := fmt.Sprintf("\tMOVL $0, %d(SI)\n", arenaLockOffAMD64)
+
+	bio.WriteString(fmt.Sprintf("// %s_alloc returns a block of DI bytes in AX, 0 when the\n", arena))
+	bio.WriteString("// arena is full.\n")
+	bio.WriteString(fmt.Sprintf("TEXT ·%s_alloc(SB), NOSPLIT|NOFRAME, $0\n", arena))
+	bio.WriteString(fmt.Sprintf("\tMOVQ $%#x, AX\n", uint64(1)<<(arenaClassesAMD64-2)))
+	bio.WriteString("\tCMPQ DI, AX\n")
+	bio.WriteString("\tJCC fail\n")
+	bio.WriteString(fmt.Sprintf("\tLEAQ %d(DI), CX\n", arenaHeaderAMD64-1))
+	bio.WriteString("\tBSRQ CX, CX\n")
+	bio.WriteString("\tINCQ CX\n")
+	bio.WriteString(fmt.Sprintf("\tCMPQ CX, $%d\n", arenaMinClassAMD64))
+	bio.WriteString("\tJCC class\n")
+	bio.WriteString(fmt.Sprintf("\tMOVQ $%d, CX\n", arenaMinClassAMD64))
+	bio.WriteString("class:\n")
+	bio.WriteString(fmt.Sprintf("\tLEAQ ·%s(SB), SI\n", arena))
+	writeArenaLockAMD64(bio)
+	bio.WriteString(fmt.Sprintf("\tMOVQ %d(SI)(CX*8), AX\n", arenaFreeOffAMD64))
+	bio.WriteString("\tTESTQ AX, AX\n")
+	bio.WriteString("\tJEQ top\n")
+	bio.WriteString("\tMOVQ 8(AX), DX\n")
+	bio.WriteString(fmt.Sprintf("\tMOVQ DX, %d(SI)(CX*8)\n", arenaFreeOffAMD64))
+	bio.WriteString("\tJMP got\n")
+	bio.WriteString("top:\n")
+	bio.WriteString(fmt.Sprintf("\tMOVQ %d(SI), AX\n", arenaNextOffAMD64))
+	bio.WriteString("\tMOVL $1, DX\n")
+	bio.WriteString("\tSHLQ CX, DX\n")
+	bio.WriteString("\tADDQ AX, DX\n")
+	bio.WriteString(fmt.Sprintf("\tCMPQ DX, %d(SI)\n", arenaEndOffAMD64))
+	bio.WriteString("\tJHI full\n")
+	bio.WriteString(fmt.Sprintf("\tMOVQ DX, %d(SI)\n", arenaNextOffAMD64))
+	bio.WriteString("got:\n")
+	bio.WriteString("\tMOVQ CX, 0(AX)\n")
+	bio.WriteString("\tMOVL $1, DX\n")
+	bio.WriteString("\tSHLQ CX, DX\n")
+	bio.WriteString(fmt.Sprintf("\tADDQ DX, %d(SI)\n", arenaUsedOffAMD64))
+	bio.WriteString(unlock)
+	bio.WriteString(fmt.Sprintf("\tADDQ $%d, AX\n", arenaHeaderAMD64))
+	bio.WriteString("\tRET\n")
+	bio.WriteString("full:\n")
+	bio.WriteString(unlock)
+	bio.WriteString("fail:\n")
+	bio.WriteString("\tXORL AX, AX\n")
+	bio.WriteString("\tRET\n\n")
+
+	bio.WriteString(fmt.Sprintf("// %s_free puts the block in DI on its free list.\n", arena))
+	bio.WriteString(fmt.Sprintf("TEXT ·%s_free(SB), NOSPLIT|NOFRAME, $0\n", arena))
+	bio.WriteString("\tTESTQ DI, DI\n")
+	bio.WriteString("\tJEQ done\n")
+	bio.WriteString(fmt.Sprintf("\tSUBQ $%d, DI\n", arenaHeaderAMD64))
+	bio.WriteString("\tMOVQ 0(DI), CX\n")
+	bio.WriteString(fmt.Sprintf("\tLEAQ ·%s(SB), SI\n", arena))
+	writeArenaLockAMD64(bio)
+	bio.WriteString(fmt.Sprintf("\tMOVQ %d(SI)(CX*8), AX\n", arenaFreeOffAMD64))
+	bio.WriteString("\tMOVQ AX, 8(DI)\n")
+	bio.WriteString(fmt.Sprintf("\tMOVQ DI, %d(SI)(CX*8)\n", arenaFreeOffAMD64))
+	bio.WriteString("\tMOVL $1, DX\n")
+	bio.WriteString("\tSHLQ CX, DX\n")
+	bio.WriteString(fmt.Sprintf("\tSUBQ DX, %d(SI)\n", arenaUsedOffAMD64))
+	bio.WriteString(unlock)
+	bio.WriteString("done:\n")
+	bio.WriteString("\tRET\n\n")
+}
+
+func writeMallocShimAMD64(st *LinkState, bio *bufio.Writer, sym string) {
+	bio.WriteString(fmt.Sprintf("TEXT %s(SB), NOSPLIT|NOFRAME, $0\n", sym))
+	bio.WriteString(fmt.Sprintf("\tJMP ·%s_alloc(SB)\n\n", st.arenaName()))
+}
+
+func writeFreeShimAMD64(st *LinkState, bio *bufio.Writer, sym string) {
+	bio.WriteString(fmt.Sprintf("TEXT %s(SB), NOSPLIT|NOFRAME, $0\n", sym))
+	bio.WriteString(fmt.Sprintf("\tJMP ·%s_free(SB)\n\n", st.arenaName()))
+}
+
+func writeCallocShimAMD64(st *LinkState, bio *bufio.Writer, sym string) {
+	bio.WriteString(fmt.Sprintf("// %s clears the block, a freed one is dirty.\n", sym))
+	bio.WriteString(fmt.Sprintf("TEXT %s(SB), NOSPLIT|NOFRAME, $0\n", sym))
+	bio.WriteString("\tMOVQ DI, AX\n")
+	bio.WriteString("\tMULQ SI\n")
+	bio.WriteString("\tJCS fail\n")
+	bio.WriteString("\tMOVQ AX, DI\n")
+	bio.WriteString("\tMOVQ AX, R9\n")
+	bio.WriteString(fmt.Sprintf("\tCALL ·%s_alloc(SB)\n", st.arenaName()))
+	bio.WriteString("\tTESTQ AX, AX\n")
+	bio.WriteString("\tJEQ done\n")
+	bio.WriteString("\tMOVQ AX, R8\n")
+	bio.WriteString("\tMOVQ AX, DI\n")
+	bio.WriteString("\tMOVQ R9, CX\n")
+	bio.WriteString("\tXORL AX, AX\n")
+	bio.WriteString("\tREP; STOSB\n")
+	bio.WriteString("\tMOVQ R8, AX\n")
+	bio.WriteString("done:\n")
+	bio.WriteString("\tRET\n")
+	bio.WriteString("fail:\n")
+	bio.WriteString("\tXORL AX, AX\n")
+	bio.WriteString("\tRET\n\n")
+}
+
+// writeReallocShimAMD64 writes a realloc keeping the block while the
+// new size fits its class. Like glibc, a zero size frees the block.
+func writeReallocShimAMD64(st *LinkState, bio *bufio.Writer, sym string) {
+	arena := st.arenaName()
+	bio.WriteString(fmt.Sprintf("TEXT %s(SB), NOSPLIT|NOFRAME, $0\n", sym))
+	bio.WriteString("\tTESTQ DI, DI\n")
+	bio.WriteString("\tJNE resize\n")
+	bio.WriteString("\tMOVQ SI, DI\n")
+	bio.WriteString(fmt.Sprintf("\tJMP ·%s_alloc(SB)\n", arena))
+	bio.WriteString("resize:\n")
+	bio.WriteString("\tTESTQ SI, SI\n")
+	bio.WriteString("\tJNE fits\n")
+	bio.WriteString(fmt.Sprintf("\tCALL ·%s_free(SB)\n", arena))
+	bio.WriteString("\tXORL AX, AX\n")
+	bio.WriteString("\tRET\n")
+	bio.WriteString("fits:\n")
+	bio.WriteString(fmt.Sprintf("\tMOVQ -%d(DI), CX\n", arenaHeaderAMD64))
+	bio.WriteString("\tMOVL $1, DX\n")
+	bio.WriteString("\tSHLQ CX, DX\n")
+	bio.WriteString(fmt.Sprintf("\tSUBQ $%d, DX\n", arenaHeaderAMD64))
+	bio.WriteString("\tCMPQ SI, DX\n")
+	bio.WriteString("\tJHI move\n")
+	bio.WriteString("\tMOVQ DI, AX\n")
+	bio.WriteString("\tRET\n")
+	bio.WriteString("move:\n")
+	bio.WriteString("\tMOVQ DI, R9\n")
+	bio.WriteString("\tMOVQ DX, R10\n")
+	bio.WriteString("\tMOVQ SI, DI\n")
+	bio.WriteString(fmt.Sprintf("\tCALL ·%s_alloc(SB)\n", arena))
+	bio.WriteString("\tTESTQ AX, AX\n")
+	bio.WriteString("\tJEQ done\n")
+	bio.WriteString("\tMOVQ AX, R11\n")
+	bio.WriteString("\tMOVQ AX, DI\n")
+	bio.WriteString("\tMOVQ R9, SI\n")
+	bio.WriteString("\tMOVQ R10, CX\n")
+	bio.WriteString("\tREP; MOVSB\n")
+	bio.WriteString("\tMOVQ R9, DI\n")
+	bio.WriteString(fmt.Sprintf("\tCALL ·%s_free(SB)\n", arena))
+	bio.WriteString("\tMOVQ R11, AX\n")
+	bio.WriteString("done:\n")
+	bio.WriteString("\tRET\n\n")
+}
@@ -0,0 +1,145 @@
+package elf
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ii64/golinker/conf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArenaShimsAMD64(t *testing.T) {
+	st, _ := newStubTestState(t, `package stub
+
+func alloc(n int64) (r int64)
+`)
+	st.sExtSym[0x1000] = "calloc"
+	st.sExtSymOffOrder = append(st.sExtSymOffOrder, 0x1000)
+
+	// without an arena malloc stays external.
+	_, ok := st.libcShimByName("calloc")
+	assert.False(t, ok)
+	assert.False(t, st.usesArena())
+
+	st.cfg.MallocArenaSize = 1 << 20
+	shim, ok := st.libcShimByName("calloc")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(8), shim.stack)
+	assert.True(t, st.usesArena())
+
+	var buf bytes.Buffer
+	bio := bufio.NewWriter(&buf)
+	st.writeLibcShimsAMD64(bio)
+	bio.Flush()
+	out := buf.String()
+	assert.Contains(t, out, "TEXT calloc(SB), NOSPLIT|NOFRAME, $0\n")
+	assert.Contains(t, out, "\tCALL ·__native_entry___arena_alloc(SB)\n")
+	assert.Contains(t, out, "TEXT ·__native_entry___arena_alloc(SB), NOSPLIT|NOFRAME, $0\n")
+	assert.Contains(t, out, "TEXT ·__native_entry___arena_free(SB), NOSPLIT|NOFRAME, $0\n")
+	assert.NotContains(t, out, "TEXT malloc(SB)")
+
+	buf.Reset()
+	st.writeArenaGoAMD64(bio)
+	bio.Flush()
+	out = buf.String()
+	assert.Contains(t, out, "const __native_entry___arena_size = 1048576\n")
+	assert.Contains(t, out, "func __native_entry___arena_init(size uintptr) {\n")
+	assert.Contains(t, out, "func __native_entry___arena_used() uintptr {\n")
+	// the arena is allocated outside of the lock native malloc spins on.
+	assert.Less(t, strings.Index(out, "make("), strings.Index(out, "CompareAndSwapUint32"))
+	assert.NotContains(t, out, "defer atomic.StoreUint32")
+}
+
+func TestStubArenaAMD64(t *testing.T) {
+	out, ok := runStubProgramOptsAMD64(t, `#include <stdint.h>
+#include <stdlib.h>
+
+void *alloc(int64_t n) { return malloc(n); }
+void *zalloc(int64_t n, int64_t m) { return calloc(n, m); }
+void *grow(void *p, int64_t n) { return realloc(p, n); }
+void release(void *p) { free(p); }
+`, `package main
+
+func alloc(n int64) (r uintptr)
+func zalloc(n, m int64) (r uintptr)
+func grow(p uintptr, n int64) (r uintptr)
+func release(p uintptr)
+`, `package main
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+func bytesAt(p uintptr, n int) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(p)), n)
+}
+
+func sum(b []byte) (s int) {
+	for _, c := range b {
+		s += int(c)
+	}
+	return
+}
+
+func main() {
+	used := __native_entry___arena_used
+	p := alloc(100)
+	for i := range bytesAt(p, 100) {
+		bytesAt(p, 100)[i] = 0xff
+	}
+	fmt.Println(p%16, used())
+
+	// the freed block comes back cleared.
+	release(p)
+	z := zalloc(10, 10)
+	fmt.Println(z == p, sum(bytesAt(z, 100)), used())
+
+	b := bytesAt(z, 100)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	g := grow(z, 50)
+	g2 := grow(g, 1000)
+	fmt.Println(g == z, g2 != g, sum(bytesAt(g2, 100)), used())
+
+	fmt.Println(alloc(1<<20) == 0, zalloc(1<<62, 4) == 0, grow(g2, 1<<20) == 0)
+	release(g2)
+	release(0)
+	fmt.Println(used())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				q := alloc(int64(16 * (i + j%7)))
+				bytesAt(q, 1)[0] = byte(i)
+				release(q)
+			}
+		}(i)
+	}
+	wg.Wait()
+	fmt.Println(used())
+
+	q := alloc(8)
+	func() {
+		defer func() { fmt.Println(recover()) }()
+		__native_entry___arena_init(1 << 20)
+	}()
+	release(q)
+	__native_entry___arena_init(1 << 20)
+	fmt.Println(alloc(1<<19) != 0, used())
+}
+`, stubProgramOptsAMD64{cfg: func(cfg *conf.Config) {
+		cfg.MallocArenaSize = 64 << 10
+	}})
+	if ok {
+		assert.Equal(t, "0 128\ntrue 0 128\ntrue true 4950 1024\ntrue true true\n0\n0\n"+
+			"golinker: arena in use\ntrue 1048576\n", out)
+	}
+}
@@ -20,12 +20,18 @@ func (st *LinkState) getRelocation() (err error) {
 		if s.Type != elf.SHT_RELA && s.Type != elf.SHT_REL {
 			continue
 		}
+		// relocations of sections not loaded, such as .debug_info.
+		if _, loaded := st.sProgSectionLoc[elf.SectionIndex(s.Info)]; !loaded {
+			continue
+		}
 		var dat []byte
 		dat, err = s.Data()
 		if err != nil {
 			return
 		}
-		err = st.loadRelocation(dat, s.Type)
+		// offsets are relative to the section relocated.
+		base := st.sProgSectionLoc[elf.SectionIndex(s.Info)][0]
+		err = st.loadRelocation(dat, s.Type, base)
 		if err != nil {
 			return
 		}
@@ -33,7 +39,7 @@ func (st *LinkState) getRelocation() (err error) {
 	return
 }
 
-func (st *LinkState) loadRelocation(dat []byte, sectionType elf.SectionType) (err error) {
+func (st *LinkState) loadRelocation(dat []byte, sectionType elf.SectionType, base uint64) (err error) {
 	switch st.Arch {
 	case "386":
 		// 8 is the size of Rel32.
@@ -46,7 +52,7 @@ func (st *LinkState) loadRelocation(dat []byte, sectionType elf.SectionType) (er
 		if len(dat)%24 != 0 {
 			return fmt.Errorf("length of relocation section is not a mutliple of 24")
 		}
-		return st.loadRelocationAMD64(dat)
+		return st.loadRelocationAMD64(dat, base)
 	case "arm64":
 		// 24 is the size of Rela64
 		if len(dat)%24 != 0 {
@@ -75,7 +81,7 @@ func (st *LinkState) loadRelocation386(dat []byte) (err error) {
 	return
 }
 
-func (st *LinkState) loadRelocationAMD64(dat []byte) (err error) {
+func (st *LinkState) loadRelocationAMD64(dat []byte, base uint64) (err error) {
 	b := bytes.NewReader(dat)
 	var rela elf.Rela64
 	for b.Len() > 0 {
@@ -89,13 +95,23 @@ func (st *LinkState) loadRelocationAMD64(dat []byte) (err error) {
 		_ = sym
 
 		switch typ {
+		case elf.R_X86_64_GOTPCREL, elf.R_X86_64_GOTPCRELX, elf.R_X86_64_REX_GOTPCRELX:
+			// there is no GOT, a MOVQ of the GOT slot becomes a LEAQ of
+			// the symbol, like ld relaxes it.
+			begin := base + rela.Off
+			if begin < 2 || st.sProgData[begin-2] != 0x8b {
+				err = fmt.Errorf("unhandled GOT load: %s -> %+#v (symName: %q)", typ, rela, sym.Name)
+				return
+			}
+			st.sProgData[begin-2] = 0x8d
+			fallthrough
 		case elf.R_X86_64_PLT32, elf.R_X86_64_PC32,
 
 			// !! fix me
 			elf.R_X86_64_32, elf.R_X86_64_64:
 
 			// !! add rela off with base
-			begin := st.sBaseAddr + rela.Off
+			begin := base + rela.Off
 			var end int64
 			end = int64(begin + 4)
 
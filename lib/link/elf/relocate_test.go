@@ -0,0 +1,53 @@
+package elf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelocateGOTPCRELAMD64(t *testing.T) {
+	st := &LinkState{
+		File: &elf.File{FileHeader: elf.FileHeader{ByteOrder: binary.LittleEndian}},
+		sSymbols: []elf.Symbol{
+			{Name: "primes", Section: 2},
+		},
+		sProgSectionLoc: map[elf.SectionIndex][2]uint64{2: {0x10, 0x30}},
+		// movq primes@GOTPCREL(%rip), %rax
+		sProgData: []byte{0x48, 0x8b, 0x05, 0, 0, 0, 0},
+	}
+	var rela bytes.Buffer
+	binary.Write(&rela, binary.LittleEndian, []elf.Rela64{
+		{Off: 3, Info: 1<<32 | uint64(elf.R_X86_64_REX_GOTPCRELX), Addend: -4},
+	})
+	err := st.loadRelocationAMD64(rela.Bytes(), 0)
+	assert.NoError(t, err)
+	// leaq primes(%rip), %rax
+	assert.Equal(t, []byte{0x48, 0x8d, 0x05, 0x09, 0, 0, 0}, st.sProgData)
+}
+
+func TestRelocateGOTLoadAMD64(t *testing.T) {
+	st := &LinkState{
+		File:    &elf.File{FileHeader: elf.FileHeader{ByteOrder: binary.LittleEndian}},
+		sExtSym: map[uint64]string{},
+		sSymbols: []elf.Symbol{
+			{Name: "f", Section: elf.SHN_UNDEF},
+		},
+		// callq *f@GOTPCREL(%rip); callq f
+		sProgData: []byte{0xff, 0x15, 0, 0, 0, 0, 0xe8, 0, 0, 0, 0},
+	}
+	var rela bytes.Buffer
+	binary.Write(&rela, binary.LittleEndian, []elf.Rela64{
+		{Off: 2, Info: 1<<32 | uint64(elf.R_X86_64_GOTPCRELX), Addend: -4},
+		{Off: 7, Info: 1<<32 | uint64(elf.R_X86_64_PLT32), Addend: -4},
+	})
+	// only a MOVQ of the GOT slot is relaxed, the relocations after it
+	// must not hide the error.
+	err := st.loadRelocationAMD64(rela.Bytes(), 0)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unhandled GOT load: R_X86_64_GOTPCRELX")
+	}
+}
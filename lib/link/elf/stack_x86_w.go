@@ -0,0 +1,214 @@
+package elf
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// stackDepth is the worst case stack use of a native function and its
+// callees, below the entry SP.
+type stackDepth struct {
+	size uint64
+	// path and why are set when size is not a bound, path is the call
+	// chain down to the function at fault.
+	path []string
+	why  string
+	done bool
+}
+
+func (d stackDepth) unbounded() string {
+	if d.why == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s: %s", strings.Join(d.path, " -> "), d.why)
+}
+
+// analyzeStackAMD64 sets the stack size of every native function to the
+// worst case along its call graph: its own frame, and for each call the
+// return address and the callee. Recursion, indirect and external calls
+// have no bound, bound stubs reaching one are reported.
+func (st *LinkState) analyzeStackAMD64() (err error) {
+	depths := map[uint64]*stackDepth{}
+	var visit func(off uint64, active map[uint64]bool) *stackDepth
+	visit = func(off uint64, active map[uint64]bool) *stackDepth {
+		name := st.sFnName[off]
+		if d, ok := depths[off]; ok {
+			if !d.done && active[off] {
+				return &stackDepth{path: []string{name}, why: "recursion"}
+			}
+			return d
+		}
+		d := &stackDepth{}
+		depths[off] = d
+		active[off] = true
+		defer delete(active, off)
+
+		frame := st.sFnFrame[off]
+		d.size = frame.Size
+		if frame.Unbounded != "" {
+			d.path, d.why = []string{name}, frame.Unbounded
+		}
+		sub := func(target uint64, extra uint64) {
+			callee, ok := st.funcAt(target)
+			shim, isShim := st.libcShim(target)
+			var cd *stackDepth
+			switch {
+			case ok:
+				cd = visit(callee, active)
+			case st.isCallback(target):
+				// the Go side runs on the goroutine stack.
+				cd = &stackDepth{size: callbackStackAMD64}
+			case isShim:
+				cd = &stackDepth{size: shim.stack}
+			default:
+				cd = &stackDepth{why: st.unknownCallee(target)}
+			}
+			if sz := extra + cd.size; sz > d.size {
+				d.size = sz
+			}
+			if d.why == "" && cd.why != "" {
+				d.path = append([]string{name}, cd.path...)
+				d.why = cd.why
+			}
+		}
+		for _, target := range frame.Calls {
+			sub(target, frame.Size+8)
+		}
+		// the frame is released before a tail call.
+		for _, target := range frame.TailCalls {
+			sub(target, 0)
+		}
+		d.done = true
+		return d
+	}
+
+	for _, off := range st.sFnOrder {
+		d := visit(off, map[uint64]bool{})
+		st.sFnStackSz[off] = d.size
+		if d.why != "" {
+			st.sFnStackUnbounded[off] = d.unbounded()
+		}
+	}
+
+	for _, off := range st.sFnOrder {
+		fn, ok := st.sFnHdr[off]
+		why := st.sFnStackUnbounded[off]
+		if ok && why == "" && st.sFnOpts[off].SystemStack {
+			if need := st.sFnStackSz[off] + stubStackSlackAMD64; need > st.nativeStackSize() {
+				st.Warnings = append(st.Warnings, fmt.Sprintf(
+					"%s: func %s: native stack needs %d bytes, more than the %d bytes of -nativestack",
+					st.hdr.Fset.Position(fn.Pos()), fn.Name.Name, need, st.nativeStackSize()))
+			}
+		}
+		if !ok || why == "" {
+			continue
+		}
+		opts := st.sFnOpts[off]
+		if opts.NoStack || opts.SystemStack {
+			continue
+		}
+		st.Warnings = append(st.Warnings, fmt.Sprintf(
+			"%s: func %s: native stack is unbounded (%s), the %d bytes reserved may not be enough",
+			st.hdr.Fset.Position(fn.Pos()), fn.Name.Name, why, st.sFnStackSz[off]))
+	}
+	return
+}
+
+// funcAt finds the native function holding addr.
+func (st *LinkState) funcAt(addr uint64) (off uint64, ok bool) {
+	i := sort.Search(len(st.sFnOrder), func(i int) bool {
+		return st.sFnOrder[i] > addr
+	})
+	if i == 0 {
+		return
+	}
+	off = st.sFnOrder[i-1]
+	return off, addr < off+st.sFnSize[off]
+}
+
+func (st *LinkState) unknownCallee(addr uint64) string {
+	if name, ok := st.sExtSym[addr]; ok {
+		return fmt.Sprintf("calls external %s", name)
+	}
+	return fmt.Sprintf("calls unknown address %#x", addr)
+}
+
+func (st *LinkState) nativeStackGetName() string {
+	return st.cfg.NativeEntryName + "_stack_get"
+}
+
+func (st *LinkState) nativeStackPutName() string {
+	return st.cfg.NativeEntryName + "_stack_put"
+}
+
+// usesSystemStack reports whether a stub runs on a native stack of its
+// own, the offsets file then carries the stack pool.
+func (st *LinkState) usesSystemStack() bool {
+	for _, opts := range st.sFnOpts {
+		if opts.SystemStack {
+			return true
+		}
+	}
+	return false
+}
+
+// minNativeStackSize is the smallest pool stack.
+const minNativeStackSize = 64 << 10
+
+// nativeStackSize is the size of the pool stacks, a power of two so a
+// callback finds the stack top from any SP on the stack.
+func (st *LinkState) nativeStackSize() uint64 {
+	size := uint64(minNativeStackSize)
+	for size < st.cfg.GetNativeStackSize() {
+		size <<= 1
+	}
+	return size
+}
+
+// writeNativeStackPoolAMD64 writes the pool of stacks systemstack stubs
+// switch to. A stack is mmapped aligned to its size with a guard page
+// below it, and kept for reuse once the call returns. get returns the
+// stack top.
+func (st *LinkState) writeNativeStackPoolAMD64(bio *bufio.Writer) {
+	entry := st.cfg.NativeEntryName
+	size := st.nativeStackSize()
+
+	bio.WriteString(fmt.Sprintf("const %s_stack_size = %d\n\n", entry, size))
+	bio.WriteString(fmt.Sprintf("var %s_stack_pool struct {\n", entry))
+	bio.WriteString("\tsync.Mutex\n")
+	bio.WriteString("\tfree []uintptr\n")
+	bio.WriteString("}\n\n")
+
+	bio.WriteString(fmt.Sprintf("func %s() uintptr {\n", st.nativeStackGetName()))
+	bio.WriteString(fmt.Sprintf("\tp := &%s_stack_pool\n", entry))
+	bio.WriteString("\tp.Lock()\n")
+	bio.WriteString("\tif n := len(p.free); n > 0 {\n")
+	bio.WriteString("\t\ttop := p.free[n-1]\n")
+	bio.WriteString("\t\tp.free = p.free[:n-1]\n")
+	bio.WriteString("\t\tp.Unlock()\n")
+	bio.WriteString("\t\treturn top\n")
+	bio.WriteString("\t}\n")
+	bio.WriteString("\tp.Unlock()\n")
+	bio.WriteString("\tguard := uintptr(syscall.Getpagesize())\n")
+	bio.WriteString(fmt.Sprintf("\tmem, err := syscall.Mmap(-1, 0, 2*%s_stack_size,\n", entry))
+	bio.WriteString("\t\tsyscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)\n")
+	bio.WriteString("\tif err != nil {\n")
+	bio.WriteString("\t\tpanic(\"golinker: native stack: \" + err.Error())\n")
+	bio.WriteString("\t}\n")
+	bio.WriteString("\tstart := uintptr(unsafe.Pointer(&mem[0]))\n")
+	bio.WriteString(fmt.Sprintf("\tbase := (start + guard + %s_stack_size - 1) &^ (%s_stack_size - 1)\n", entry, entry))
+	bio.WriteString("\tif err = syscall.Mprotect(mem[base-guard-start:base-start], syscall.PROT_NONE); err != nil {\n")
+	bio.WriteString("\t\tpanic(\"golinker: native stack guard: \" + err.Error())\n")
+	bio.WriteString("\t}\n")
+	bio.WriteString(fmt.Sprintf("\treturn base + %s_stack_size\n", entry))
+	bio.WriteString("}\n\n")
+
+	bio.WriteString(fmt.Sprintf("func %s(top uintptr) {\n", st.nativeStackPutName()))
+	bio.WriteString(fmt.Sprintf("\tp := &%s_stack_pool\n", entry))
+	bio.WriteString("\tp.Lock()\n")
+	bio.WriteString("\tp.free = append(p.free, top)\n")
+	bio.WriteString("\tp.Unlock()\n")
+	bio.WriteString("}\n\n")
+}
@@ -0,0 +1,420 @@
+package elf
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"go/ast"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The stdio shims bind the stdio calls of native code being debugged
+// to Go callbacks printing to os.Stderr, whatever the stream. They are
+// callbacks like the //golinker:export ones: the Go funcs are declared
+// to the stub header and written to the offsets file.
+//
+// The args of a variadic call are taken from the SysV arg registers,
+// the ints and the eight floats, so a format reads no more args than
+// fit in registers. abort panics naming the native function it is
+// called from, the pool stack of the stub is not returned.
+type stdioShimAMD64 struct {
+	// params of the Go func, in the order SysV passes them.
+	params string
+	// result of the Go func, with a leading space.
+	result string
+	// body of the Go func, ENTRY stands for the native entry name.
+	body string
+}
+
+// stdioVarArgsAMD64 are the variadic args in registers, after n int
+// args.
+func stdioVarArgsAMD64(n int) string {
+	var ints, floats []string
+	for i := n + 1; i <= 6; i++ {
+		ints = append(ints, fmt.Sprintf("a%d", i))
+	}
+	for i := 0; i < 8; i++ {
+		floats = append(floats, fmt.Sprintf("x%d", i))
+	}
+	return strings.Join(ints, ", ") + " uint64, " + strings.Join(floats, ", ") + " float64"
+}
+
+func stdioFormatCallAMD64(n int) string {
+	var ints []string
+	for i := n + 1; i <= 6; i++ {
+		ints = append(ints, fmt.Sprintf("a%d", i))
+	}
+	return fmt.Sprintf("\treturn ENTRY_stdio_write(ENTRY_format(ENTRY_cstring(format),\n"+
+		"\t\t[]uint64{%s}, []float64{x0, x1, x2, x3, x4, x5, x6, x7}))\n",
+		strings.Join(ints, ", "))
+}
+
+var stdioShimsAMD64 = map[string]stdioShimAMD64{
+	"printf": {
+		params: "format *byte, " + stdioVarArgsAMD64(1),
+		result: " int32",
+		body:   stdioFormatCallAMD64(1),
+	},
+	"__printf_chk": {
+		params: "flag int32, format *byte, " + stdioVarArgsAMD64(2),
+		result: " int32",
+		body:   stdioFormatCallAMD64(2),
+	},
+	"fprintf": {
+		params: "stream uintptr, format *byte, " + stdioVarArgsAMD64(2),
+		result: " int32",
+		body:   stdioFormatCallAMD64(2),
+	},
+	"__fprintf_chk": {
+		params: "stream uintptr, flag int32, format *byte, " + stdioVarArgsAMD64(3),
+		result: " int32",
+		body:   stdioFormatCallAMD64(3),
+	},
+	"puts": {
+		params: "s *byte",
+		result: " int32",
+		body:   "\treturn ENTRY_stdio_write([]byte(ENTRY_cstring(s) + \"\\n\"))\n",
+	},
+	"fputs": {
+		params: "s *byte, stream uintptr",
+		result: " int32",
+		body:   "\treturn ENTRY_stdio_write([]byte(ENTRY_cstring(s)))\n",
+	},
+	"putchar": {
+		params: "c int32",
+		result: " int32",
+		body:   "\tENTRY_stdio_write([]byte{byte(c)})\n\treturn c & 0xff\n",
+	},
+	"fputc": {
+		params: "c int32, stream uintptr",
+		result: " int32",
+		body:   "\tENTRY_stdio_write([]byte{byte(c)})\n\treturn c & 0xff\n",
+	},
+	// glibc inlines putchar to putc on stdout.
+	"putc": {
+		params: "c int32, stream uintptr",
+		result: " int32",
+		body:   "\tENTRY_stdio_write([]byte{byte(c)})\n\treturn c & 0xff\n",
+	},
+	"fwrite": {
+		params: "p *byte, size, n, stream uintptr",
+		result: " uintptr",
+		body: "\tif size*n == 0 {\n\t\treturn 0\n\t}\n" +
+			"\tENTRY_stdio_write(unsafe.Slice(p, size*n))\n\treturn n\n",
+	},
+	"fflush": {
+		params: "stream uintptr",
+		result: " int32",
+		body:   "\treturn 0\n",
+	},
+	// abort is reached through a trampoline passing its return address.
+	"abort": {
+		params: "pc uintptr",
+		body:   "\tpanic(\"golinker: abort called by \" + ENTRY_func_name(pc))\n",
+	},
+}
+
+// stdioStreamsAMD64 are the stream vars native code loads the address
+// of, the shims don't read them.
+var stdioStreamsAMD64 = []string{"stdin", "stdout", "stderr"}
+
+func (st *LinkState) stdioGoName(sym string) string {
+	return st.cfg.NativeEntryName + "_" + strings.TrimPrefix(sym, "__")
+}
+
+// stdioExportName is the callback symbol sym is bound to, abort goes
+// through a trampoline first.
+func (st *LinkState) stdioExportName(sym string) string {
+	if sym == "abort" {
+		return st.cfg.NativeEntryName + "_abort"
+	}
+	return sym
+}
+
+// stdioUndefined returns the stdio symbols the native code leaves
+// undefined and no Go func is exported under, sorted.
+func (st *LinkState) stdioUndefined(exported map[string]bool) (syms []string) {
+	if !st.cfg.DebugStdio {
+		return
+	}
+	seen := map[string]bool{}
+	for _, sym := range st.sSymbols {
+		if sym.Section != elf.SHN_UNDEF || seen[sym.Name] || exported[sym.Name] {
+			continue
+		}
+		if _, ok := stdioShimsAMD64[sym.Name]; ok {
+			seen[sym.Name] = true
+			syms = append(syms, sym.Name)
+		}
+	}
+	sort.Strings(syms)
+	return
+}
+
+// stdioHelpersAMD64 are the names the offsets file declares for the
+// shims besides their funcs, ENTRY stands for the native entry name.
+var stdioHelpersAMD64 = []string{
+	"ENTRY_funcs", "ENTRY_func_name", "ENTRY_cstring", "ENTRY_stdio_write", "ENTRY_format",
+}
+
+// checkStdioNames fails when the stub declares a name the shims of
+// syms take, the shims are declared to the same package.
+func (st *LinkState) checkStdioNames(syms []string) error {
+	var names []string
+	for _, name := range stdioHelpersAMD64 {
+		names = append(names, strings.Replace(name, "ENTRY", st.cfg.NativeEntryName, 1))
+	}
+	for _, sym := range syms {
+		names = append(names, st.stdioGoName(sym))
+	}
+	for _, name := range names {
+		if obj := st.hdr.Pkg.Scope().Lookup(name); obj != nil {
+			return fmt.Errorf("%s: %s is taken by the -debugstdio shims, rename it",
+				st.hdr.Fset.Position(obj.Pos()), name)
+		}
+	}
+	return nil
+}
+
+// stdioHdrFile is the file name the stub header gives the declarations
+// of the shims.
+const stdioHdrFile = "golinker-debugstdio.go"
+
+// stdioHdrSource declares the Go funcs of syms to the stub header, the
+// bodies are written to the offsets file. The line directive sets the
+// declarations apart from the stub, in errors and for stdioDecls.
+func (st *LinkState) stdioHdrSource(syms []string) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("\n//line %s:1\n", stdioHdrFile))
+	for _, sym := range syms {
+		shim := stdioShimsAMD64[sym]
+		b.WriteString(fmt.Sprintf("\n//golinker:export %s\n", st.stdioExportName(sym)))
+		b.WriteString(fmt.Sprintf("func %s(%s)%s\n", st.stdioGoName(sym), shim.params, shim.result))
+	}
+	return b.String()
+}
+
+// isStdioDecl reports whether fn is declared by stdioHdrSource, the
+// line directive file is relative to the stub dir.
+func (st *LinkState) isStdioDecl(fn *ast.FuncDecl) bool {
+	return filepath.Base(st.hdr.Fset.Position(fn.Pos()).Filename) == stdioHdrFile
+}
+
+// stdioDecls returns the funcs declared by stdioHdrSource, they have no
+// body like the stubs but are exported.
+func (st *LinkState) stdioDecls() (fs []*ast.FuncDecl) {
+	for _, fn := range st.hdr.GetFuncDecls(false) {
+		if st.isStdioDecl(fn) {
+			fs = append(fs, fn)
+		}
+	}
+	return
+}
+
+// isStdioShim reports whether sym is a stdio symbol bound to Go.
+func (st *LinkState) isStdioShim(sym string) bool {
+	if _, ok := stdioShimsAMD64[sym]; !ok || !st.cfg.DebugStdio {
+		return false
+	}
+	fn, ok := st.sExport[st.stdioExportName(sym)]
+	return ok && fn.Name.Name == st.stdioGoName(sym)
+}
+
+func (st *LinkState) isStdioStream(sym string) bool {
+	if !st.cfg.DebugStdio {
+		return false
+	}
+	for _, name := range stdioStreamsAMD64 {
+		if name == sym {
+			return true
+		}
+	}
+	return false
+}
+
+// usesStdio reports whether a stdio symbol is bound to Go, the offsets
+// file then carries the Go side.
+func (st *LinkState) usesStdio() bool {
+	return len(st.stdioBound()) > 0
+}
+
+// stdioBound returns the stdio symbols bound to Go, sorted.
+func (st *LinkState) stdioBound() (syms []string) {
+	for sym := range stdioShimsAMD64 {
+		if st.isStdioShim(sym) {
+			syms = append(syms, sym)
+		}
+	}
+	sort.Strings(syms)
+	return
+}
+
+// writeStdioAMD64 writes the abort trampoline and the stream vars.
+func (st *LinkState) writeStdioAMD64(bio *bufio.Writer) {
+	for _, off := range st.sExtSymOffOrder {
+		name := st.sExtSym[off]
+		switch {
+		case name == "abort" && st.isStdioShim(name):
+			bio.WriteString(fmt.Sprintf("// %s passes its return address to %s.\n", name, st.stdioExportName(name)))
+			bio.WriteString(fmt.Sprintf("TEXT %s(SB), NOSPLIT|NOFRAME, $0\n", name))
+			bio.WriteString("\tMOVQ 0(SP), DI\n")
+			bio.WriteString(fmt.Sprintf("\tJMP %s(SB)\n\n", st.stdioExportName(name)))
+		case st.isStdioStream(name):
+			bio.WriteString(fmt.Sprintf("GLOBL %s(SB), NOPTR, $8\n\n", name))
+		}
+	}
+}
+
+// writeStdioGoAMD64 writes the Go funcs of the stdio shims and the
+// printf formatter to the offsets file.
+func (st *LinkState) writeStdioGoAMD64(bio *bufio.Writer) {
+	r := strings.NewReplacer("ENTRY", st.cfg.NativeEntryName)
+	for _, sym := range st.stdioBound() {
+		shim := stdioShimsAMD64[sym]
+		bio.WriteString(fmt.Sprintf("func %s(%s)%s {\n", st.stdioGoName(sym), shim.params, shim.result))
+		bio.WriteString(r.Replace(shim.body))
+		bio.WriteString("}\n\n")
+	}
+
+	// native funcs by offset, for abort.
+	bio.WriteString(r.Replace("var ENTRY_funcs = []struct {\n\toff  uintptr\n\tname string\n}{\n"))
+	for _, off := range st.sFnOrder[1:] {
+		if st.needToWriteOffsetAndStackInfoAMD64(off) {
+			bio.WriteString(fmt.Sprintf("\t{%d, %q},\n", off, st.sFnName[off]))
+		}
+	}
+	bio.WriteString("}\n\n")
+	bio.WriteString(r.Replace(stdioGoHelpers))
+}
+
+const stdioGoHelpers = `// ENTRY_func_name returns the native func pc is in.
+func ENTRY_func_name(pc uintptr) string {
+	off := pc - ENTRY()
+	name := "?"
+	for _, fn := range ENTRY_funcs {
+		if fn.off <= off {
+			name = fn.name
+		}
+	}
+	return name
+}
+
+func ENTRY_cstring(p *byte) string {
+	if p == nil {
+		return "(null)"
+	}
+	n := 0
+	for *(*byte)(unsafe.Add(unsafe.Pointer(p), n)) != 0 {
+		n++
+	}
+	return string(unsafe.Slice(p, n))
+}
+
+func ENTRY_stdio_write(b []byte) int32 {
+	n, _ := os.Stderr.Write(b)
+	return int32(n)
+}
+
+// ENTRY_format formats like printf, the int and float args are taken in
+// order. Flags, width, precision and length modifiers are handled, with
+// the conversions d i u x X o c s p f F e E g G and %%.
+func ENTRY_format(format string, ints []uint64, floats []float64) []byte {
+	var out []byte
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			out = append(out, format[i])
+			continue
+		}
+		spec := "%"
+		for i++; i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0; i++ {
+			spec += format[i : i+1]
+		}
+		prec := false
+		for ; i < len(format) && strings.IndexByte("0123456789.*", format[i]) >= 0; i++ {
+			switch format[i] {
+			case '*':
+				if len(ints) > 0 {
+					spec += strconv.Itoa(int(int32(ints[0])))
+					ints = ints[1:]
+				}
+			case '.':
+				prec = true
+				spec += "."
+			default:
+				spec += format[i : i+1]
+			}
+		}
+		size := 4
+		for ; i < len(format) && strings.IndexByte("hlLqjzt", format[i]) >= 0; i++ {
+			if format[i] == 'h' {
+				size /= 2
+			} else {
+				size = 8
+			}
+		}
+		if i == len(format) {
+			break
+		}
+		verb := format[i]
+		switch verb {
+		case '%':
+			out = append(out, '%')
+			continue
+		case 'f', 'F', 'e', 'E', 'g', 'G':
+			if len(floats) == 0 {
+				out = append(out, "%!"+string(verb)+"(MISSING)"...)
+				continue
+			}
+			if !prec {
+				spec += ".6"
+			}
+			out = append(out, fmt.Sprintf(spec+string(verb), floats[0])...)
+			floats = floats[1:]
+			continue
+		}
+		if len(ints) == 0 {
+			out = append(out, "%!"+string(verb)+"(MISSING)"...)
+			continue
+		}
+		v := ints[0]
+		ints = ints[1:]
+		switch verb {
+		case 'd', 'i':
+			n := int64(v)
+			switch size {
+			case 1:
+				n = int64(int8(v))
+			case 2:
+				n = int64(int16(v))
+			case 4:
+				n = int64(int32(v))
+			}
+			out = append(out, fmt.Sprintf(spec+"d", n)...)
+		case 'u', 'x', 'X', 'o':
+			if size < 8 {
+				v &= 1<<(size*8) - 1
+			}
+			if verb == 'u' {
+				verb = 'd'
+			}
+			out = append(out, fmt.Sprintf(spec+string(verb), v)...)
+		case 'c':
+			out = append(out, fmt.Sprintf(spec+"s", string([]byte{byte(v)}))...)
+		case 's':
+			out = append(out, fmt.Sprintf(spec+"s", ENTRY_cstring((*byte)(unsafe.Pointer(uintptr(v)))))...)
+		case 'p':
+			if v == 0 {
+				out = append(out, fmt.Sprintf(spec+"s", "(nil)")...)
+			} else {
+				out = append(out, fmt.Sprintf(spec+"#x", v)...)
+			}
+		default:
+			out = append(out, "%!"+string(verb)+"(BADVERB)"...)
+		}
+	}
+	return out
+}
+
+`
@@ -0,0 +1,98 @@
+package elf
+
+import (
+	"debug/elf"
+	"testing"
+
+	"github.com/ii64/golinker/conf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStdioShimsAMD64(t *testing.T) {
+	st, _ := newStubTestState(t, `package stub
+
+func report(n int64) (r int64)
+`)
+	st.sSymbols = []elf.Symbol{
+		{Name: "printf", Section: elf.SHN_UNDEF},
+		{Name: "puts", Section: elf.SHN_UNDEF},
+		{Name: "abort", Section: elf.SHN_UNDEF},
+		{Name: "printf", Section: elf.SHN_UNDEF},
+		{Name: "strlen", Section: elf.SHN_UNDEF},
+		{Name: "fputs", Section: 1},
+	}
+
+	// off by default.
+	assert.Empty(t, st.stdioUndefined(nil))
+
+	st.cfg.DebugStdio = true
+	syms := st.stdioUndefined(map[string]bool{"puts": true})
+	assert.Equal(t, []string{"abort", "printf"}, syms)
+	assert.Equal(t, "\n//line golinker-debugstdio.go:1\n"+
+		"\n//golinker:export __native_entry___abort\n"+
+		"func __native_entry___abort(pc uintptr)\n"+
+		"\n//golinker:export printf\n"+
+		"func __native_entry___printf(format *byte, a2, a3, a4, a5, a6 uint64, "+
+		"x0, x1, x2, x3, x4, x5, x6, x7 float64) int32\n",
+		st.stdioHdrSource(syms))
+	assert.Equal(t, "__native_entry___printf_chk", st.stdioGoName("__printf_chk"))
+	assert.NoError(t, st.checkStdioNames(syms))
+}
+
+func TestStdioNameClashAMD64(t *testing.T) {
+	st, _ := newStubTestState(t, `package stub
+
+func report(n int64) (r int64)
+
+func __native_entry___cstring(p *byte) string { return "" }
+`)
+	st.cfg.DebugStdio = true
+	err := st.checkStdioNames([]string{"puts"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), ":5:6: __native_entry___cstring is taken by the -debugstdio shims, rename it")
+	}
+}
+
+func TestStubStdioAMD64(t *testing.T) {
+	out, ok := runStubProgramOptsAMD64(t, `#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+
+/* gcc moves the abort path to .text.unlikely otherwise. */
+__attribute__((section(".text"))) int64_t check(int64_t v) {
+	if (v < 0)
+		abort();
+	return v;
+}
+
+int64_t report(int64_t n, double x, const char *name) {
+	printf("%s: n=%ld x=%.3f\n", name, n, x);
+	printf("[%5d|%-4x|%03u|%c|%%]\n", (int)n, 255u, 7u, 'z');
+	printf("%hhd %lld %g %e\n", 300, (long long)-n, x, 1234.5);
+	fprintf(stderr, "err %s %d\n", name, (int)n);
+	puts(name);
+	putchar('!');
+	putchar('\n');
+	return check(n) + 1;
+}
+`, `package main
+
+func check(v int64) (r int64)
+func report(n int64, x float64, name *byte) (r int64)
+`, `package main
+
+import "fmt"
+
+func main() {
+	fmt.Println(report(41, 2.5, &[]byte("go\x00")[0]))
+	defer func() { fmt.Println(recover()) }()
+	check(-1)
+}
+`, stubProgramOptsAMD64{cfg: func(cfg *conf.Config) {
+		cfg.DebugStdio = true
+	}})
+	if ok {
+		assert.Equal(t, "go: n=41 x=2.500\n[   41|ff  |007|z|%]\n44 -41 2.5 1.234500e+03\n"+
+			"err go 41\ngo\n!\n42\ngolinker: abort called by check\n", out)
+	}
+}
@@ -0,0 +1,261 @@
+package elf
+
+import (
+	"bufio"
+	"fmt"
+	"go/types"
+
+	"github.com/ii64/golinker/lib/hdr"
+)
+
+// stubFrameAMD64 is the frame a Go stub sets up before it calls into
+// SysV code. Go only keeps SP 8-byte aligned, so the native SP is placed
+// at the first 16-byte boundary above the native stack area:
+//
+//	SP+0                 native stack, grows down from native SP
+//	native SP+0          outgoing stack args
+//	native SP+outArgs    saved Go SP
+//	native SP+outArgs+8  saved R14 (g)
+//	native SP+outArgs+16 saved R15 (GOT pointer under -dynlink)
+//
+// The native stack is part of the declared frame, so the stack check
+// the Go assembler inserts covers it.
+//
+// On a pool stack the saved Go SP slot holds the stack top instead, the
+// Go SP and BP are kept in the stack header where callbacks update them
+// when the goroutine stack moves:
+//
+//	top-8  Go SP
+//	top-16 Go BP
+type stubFrameAMD64 struct {
+	stack   uint64 // native stack area, 16-byte aligned
+	outArgs uint64 // outgoing stack arg area, 16-byte aligned
+	size    uint64 // frame size declared on TEXT
+	// top is the register holding the pool stack top, if any.
+	top string
+}
+
+// nativeStackHdrAMD64 is the size of the pool stack header.
+const nativeStackHdrAMD64 = 16
+
+// stubStackSlackAMD64 is a margin added to the native stack depth,
+// which leaves out the return address of the stub call.
+const stubStackSlackAMD64 = 256
+
+func align16(n uint64) uint64 {
+	return (n + 15) &^ 15
+}
+
+// newStubFrameAMD64 lays out a frame for stack bytes of native stack,
+// zero if the native code runs below the Go SP unchecked.
+func newStubFrameAMD64(outArgs, stack uint64) (f stubFrameAMD64) {
+	f.stack = align16(stack)
+	f.outArgs = align16(outArgs)
+	// saved SP, R14, R15 slots + up to 8 bytes lost to alignment.
+	f.size = f.stack + f.outArgs + 32
+	return
+}
+
+// writeAlignSP computes the 16-byte aligned native SP into reg.
+func (f stubFrameAMD64) writeAlignSP(bio *bufio.Writer, reg string) {
+	bio.WriteString(fmt.Sprintf("\tLEAQ %d(SP), %s\n", f.stack+15, reg))
+	bio.WriteString(fmt.Sprintf("\tANDQ $~15, %s\n", reg))
+}
+
+// newPoolFrameAMD64 lays out a frame on the pool stack whose top is in
+// the top register.
+func newPoolFrameAMD64(outArgs uint64, top string) (f stubFrameAMD64) {
+	f = newStubFrameAMD64(outArgs, 0)
+	f.top = top
+	return
+}
+
+// writeAlignTop fills the stack header and computes the native SP below
+// it in reg.
+func (f stubFrameAMD64) writeAlignTop(bio *bufio.Writer, reg string) {
+	bio.WriteString(fmt.Sprintf("\tMOVQ SP, -8(%s)\n", f.top))
+	bio.WriteString(fmt.Sprintf("\tMOVQ BP, -16(%s)\n", f.top))
+	bio.WriteString(fmt.Sprintf("\tLEAQ -%d(%s), %s\n", nativeStackHdrAMD64+f.outArgs+24, f.top, reg))
+	bio.WriteString(fmt.Sprintf("\tANDQ $~15, %s\n", reg))
+}
+
+// writeSwitchSP saves the Go SP and moves SP to the native SP in reg.
+// FP based operands are invalid until writeRestoreSP.
+func (f stubFrameAMD64) writeSwitchSP(bio *bufio.Writer, reg string) {
+	saved := "SP"
+	if f.top != "" {
+		saved = f.top
+	}
+	bio.WriteString(fmt.Sprintf("\tMOVQ %s, %d(%s)\n", saved, f.outArgs, reg))
+	bio.WriteString(fmt.Sprintf("\tMOVQ %s, SP\n", reg))
+}
+
+// writeSaveRegs saves the registers Go reserves, SP must be the native
+// SP. SysV has R14 and R15 callee-saved, but hand written or miscompiled
+// code may not honour it, and a clobbered g crashes far from the call.
+func (f stubFrameAMD64) writeSaveRegs(bio *bufio.Writer) {
+	bio.WriteString(fmt.Sprintf("\tMOVQ R14, %d(SP)\n", f.outArgs+8))
+	bio.WriteString(fmt.Sprintf("\tMOVQ R15, %d(SP)\n", f.outArgs+16))
+}
+
+// writeRestoreRegs restores R14 and R15, zeroes X15 which SysV does not
+// preserve, and clears DF in case the callee left it set.
+func (f stubFrameAMD64) writeRestoreRegs(bio *bufio.Writer) {
+	bio.WriteString(fmt.Sprintf("\tMOVQ %d(SP), R14\n", f.outArgs+8))
+	bio.WriteString(fmt.Sprintf("\tMOVQ %d(SP), R15\n", f.outArgs+16))
+	bio.WriteString("\tXORPS X15, X15\n")
+	bio.WriteString("\tCLD\n")
+}
+
+// writeRestoreSP switches back to the Go SP, SP must be the native SP.
+// R11 is clobbered on a pool stack.
+func (f stubFrameAMD64) writeRestoreSP(bio *bufio.Writer) {
+	if f.top == "" {
+		bio.WriteString(fmt.Sprintf("\tMOVQ %d(SP), SP\n", f.outArgs))
+		return
+	}
+	bio.WriteString(fmt.Sprintf("\tMOVQ %d(SP), R11\n", f.outArgs))
+	bio.WriteString("\tMOVQ -16(R11), BP\n")
+	bio.WriteString("\tMOVQ -8(R11), SP\n")
+}
+
+func movFromSizeAMD64(sz uint64) string {
+	switch sz {
+	case 4:
+		return "MOVL"
+	case 2:
+		return "MOVW"
+	case 1:
+		return "MOVB"
+	}
+	return "MOVQ"
+}
+
+// movExtFromTypeAMD64 loads a scalar of type t into a register. clang
+// expects narrow args zero or sign extended to 32 bits, following the
+// signedness of the type, and bool zero extended.
+func movExtFromTypeAMD64(t types.Type, sz uint64) string {
+	signed := false
+	if b, ok := t.Underlying().(*types.Basic); ok {
+		signed = b.Info()&types.IsUnsigned == 0 && b.Info()&types.IsInteger != 0
+	}
+	switch {
+	case sz == 1 && signed:
+		return "MOVBLSX"
+	case sz == 1:
+		return "MOVBLZX"
+	case sz == 2 && signed:
+		return "MOVWLSX"
+	case sz == 2:
+		return "MOVWLZX"
+	}
+	return movFromSizeAMD64(sz)
+}
+
+func isBoolAMD64(t types.Type) bool {
+	b, ok := t.Underlying().(*types.Basic)
+	return ok && b.Info()&types.IsBoolean != 0
+}
+
+func movSSEFromSizeAMD64(sz uint64) string {
+	if sz <= 4 {
+		return "MOVSS"
+	}
+	return "MOVSD"
+}
+
+func fpRef(f hdr.Field, off uint64) string {
+	return fmt.Sprintf("%s+%d(FP)", f.Name, off)
+}
+
+// spRef refers to the outgoing Go arg frame of a call.
+func spRef(f hdr.Field, off uint64) string {
+	return fmt.Sprintf("%d(SP)", off)
+}
+
+// writeLoadPiece loads an eightbyte from the Go frame into its
+// register, ref addresses the frame. A piece made of several fields is
+// loaded at once, Go and SysV agree on the layout of aggregates, through
+// its address in R10: no field of the frame is as wide as the load.
+func writeLoadPiece(bio *bufio.Writer, p sysvEightbyte, ref func(hdr.Field, uint64) string) {
+	if len(p.fields) == 0 {
+		return
+	}
+	f := p.fields[0]
+	src := ref(f, p.off)
+	if len(p.fields) == 1 {
+		switch p.class {
+		case sysvSSE:
+			bio.WriteString(fmt.Sprintf("\t%s %s, %s\n", movSSEFromSizeAMD64(f.Size), src, p.reg))
+		default:
+			bio.WriteString(fmt.Sprintf("\t%s %s, %s\n", movExtFromTypeAMD64(f.Type, f.Size), src, p.reg))
+		}
+		return
+	}
+	bio.WriteString(fmt.Sprintf("\tLEAQ %s, R10\n", src))
+	switch {
+	case p.class == sysvSSE && p.size <= 4:
+		bio.WriteString(fmt.Sprintf("\tMOVSS 0(R10), %s\n", p.reg))
+	case p.class == sysvSSE:
+		bio.WriteString(fmt.Sprintf("\tMOVQ 0(R10), %s\n", p.reg))
+	case p.size <= 4:
+		bio.WriteString(fmt.Sprintf("\tMOVL 0(R10), %s\n", p.reg))
+	default:
+		bio.WriteString(fmt.Sprintf("\tMOVQ 0(R10), %s\n", p.reg))
+	}
+}
+
+// writeStorePiece stores a result eightbyte field by field, so no byte
+// outside the Go result is written. Only bit 0 of a _Bool is defined,
+// bool fields are masked to 0 or 1. R10 and R11 are clobbered.
+func writeStorePiece(bio *bufio.Writer, p sysvEightbyte) {
+	if len(p.fields) == 0 {
+		return
+	}
+	if len(p.fields) == 1 {
+		f := p.fields[0]
+		switch {
+		case p.class == sysvSSE:
+			bio.WriteString(fmt.Sprintf("\t%s %s, %s\n", movSSEFromSizeAMD64(f.Size), p.reg, fpRef(f, f.Offset)))
+		case isBoolAMD64(f.Type):
+			bio.WriteString(fmt.Sprintf("\tANDL $1, %s\n", p.reg))
+			fallthrough
+		default:
+			bio.WriteString(fmt.Sprintf("\t%s %s, %s\n", movFromSizeAMD64(f.Size), p.reg, fpRef(f, f.Offset)))
+		}
+		return
+	}
+	bio.WriteString(fmt.Sprintf("\tMOVQ %s, R11\n", p.reg))
+	var shift uint64
+	for _, f := range p.fields {
+		if sh := (f.Offset - p.off) * 8; sh != shift {
+			bio.WriteString(fmt.Sprintf("\tSHRQ $%d, R11\n", sh-shift))
+			shift = sh
+		}
+		if isBoolAMD64(f.Type) {
+			bio.WriteString("\tMOVL R11, R10\n")
+			bio.WriteString("\tANDL $1, R10\n")
+			bio.WriteString(fmt.Sprintf("\tMOVB R10, %s\n", fpRef(f, f.Offset)))
+			continue
+		}
+		bio.WriteString(fmt.Sprintf("\t%s R11, %s\n", movFromSizeAMD64(f.Size), fpRef(f, f.Offset)))
+	}
+}
+
+// writeStackCopy copies a memory class arg to the outgoing arg area at
+// base, eightbyte per eightbyte through AX. R10 is clobbered.
+func writeStackCopy(bio *bufio.Writer, val sysvValue, base string) {
+	if len(val.fields) == 1 {
+		f := val.fields[0]
+		bio.WriteString(fmt.Sprintf("\t%s %s, AX\n", movExtFromTypeAMD64(f.Type, f.Size), fpRef(f, f.Offset)))
+		bio.WriteString(fmt.Sprintf("\tMOVQ AX, %d(%s)\n", val.stackOff, base))
+		return
+	}
+	// the eightbytes are addressed through R10, they are wider than
+	// the fields the frame is checked against.
+	bio.WriteString(fmt.Sprintf("\tLEAQ %s, R10\n", fpRef(val.fields[0], val.fields[0].Offset)))
+	for off := uint64(0); off < val.v.Size; off += 8 {
+		bio.WriteString(fmt.Sprintf("\tMOVQ %d(R10), AX\n", val.v.Offset+off-val.fields[0].Offset))
+		bio.WriteString(fmt.Sprintf("\tMOVQ AX, %d(%s)\n", val.stackOff+off, base))
+	}
+}
@@ -0,0 +1,890 @@
+package elf
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"go/ast"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ii64/golinker/conf"
+	"github.com/ii64/golinker/lib/cdecl"
+	"github.com/ii64/golinker/lib/disasm2"
+	"github.com/ii64/golinker/lib/hdr"
+	"github.com/ii64/golinker/lib/proc/cc"
+	"github.com/stretchr/testify/assert"
+)
+
+// newStubTestState links every func decl of src to a fake native
+// function, the first one at offset 0x10, 0x10 apart.
+func newStubTestState(t *testing.T, src string) (st *LinkState, offs map[string]uint64) {
+	var err error
+	st = &LinkState{
+		Arch:       "amd64",
+		cfg:        &conf.Config{NativeEntryName: "__native_entry__"},
+		sFnName:    map[uint64]string{},
+		sFnStackSz: map[uint64]uint64{},
+		sFnFrame:   map[uint64]disasm2.StackFrame{},
+		sFnSize:    map[uint64]uint64{},
+		sExtSym:    map[uint64]string{},
+		sFnHdr:     map[uint64]*ast.FuncDecl{},
+		sFnOpts:    map[uint64]hdr.FuncOptions{},
+
+		sFnStackUnbounded: map[uint64]string{},
+	}
+	st.hdr, err = hdr.ParseFile("stub.go", src, st.Arch)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	offs = map[string]uint64{}
+	off := uint64(0x10)
+	for _, fn := range st.hdr.GetFuncDecls(false) {
+		st.sFnName[off] = fn.Name.Name
+		st.sFnStackSz[off] = 0
+		st.sFnSize[off] = 0x10
+		st.sFnHdr[off] = fn
+		st.sFnOpts[off], err = st.hdr.GetFuncOptions(fn)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		st.sFnOrder = append(st.sFnOrder, off)
+		offs[fn.Name.Name] = off
+		off += 0x10
+	}
+	return
+}
+
+func genStubAMD64(t *testing.T, st *LinkState, off uint64) string {
+	var buf bytes.Buffer
+	bio := bufio.NewWriter(&buf)
+	err := st.getAsmFuncStubAMD64(off, bio)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return buf.String()
+}
+
+func TestStubStackArgsAMD64(t *testing.T) {
+	st, offs := newStubTestState(t, `package stub
+
+func add8(a1, a2, a3, a4, a5, a6, a7, a8 uint64) (ret uint64)
+`)
+	out := genStubAMD64(t, st, offs["add8"])
+	assert.Contains(t, out, "TEXT ·add8(SB), $304 - 72\n")
+	assert.Contains(t, out, "\tLEAQ 271(SP), R11\n\tANDQ $~15, R11\n")
+	assert.Contains(t, out, "\tMOVQ a7+48(FP), AX\n\tMOVQ AX, 0(R11)\n")
+	assert.Contains(t, out, "\tMOVQ a8+56(FP), AX\n\tMOVQ AX, 8(R11)\n")
+	assert.Contains(t, out, "\tMOVQ a6+40(FP), R9\n")
+	assert.Contains(t, out, "\tMOVQ SP, 16(R11)\n\tMOVQ R11, SP\n")
+	assert.Contains(t, out, "\tCALL ·__native_entry__+16(SB)\n")
+	assert.Contains(t, out, "\tMOVQ 16(SP), SP\n")
+	assert.Contains(t, out, "\tMOVQ AX, ret+64(FP)\n")
+}
+
+func TestStubRegArgsAMD64(t *testing.T) {
+	st, offs := newStubTestState(t, `package stub
+
+func add2(a, b uint64) (ret uint64)
+func put(a uint64)
+`)
+	out := genStubAMD64(t, st, offs["add2"])
+	assert.Contains(t, out, "TEXT ·add2(SB), $288 - 24\n")
+	assert.Contains(t, out, "\tMOVQ SP, 0(R11)\n\tMOVQ R11, SP\n")
+
+	// no tail call, the reserved registers are restored after it.
+	out = genStubAMD64(t, st, offs["put"])
+	assert.NotContains(t, out, "JMP")
+	assert.Contains(t, out, "\tCALL ·__native_entry__+32(SB)\n")
+}
+
+func TestStubNamedTypesAMD64(t *testing.T) {
+	st, offs := newStubTestState(t, `package stub
+
+import "syscall"
+
+type fd int32
+
+func wr(f fd, b byte, n uint64) (e syscall.Errno)
+func fl(f float64)
+`)
+	out := genStubAMD64(t, st, offs["wr"])
+	assert.Contains(t, out, "TEXT ·wr(SB), $288 - 24\n")
+	assert.Contains(t, out, "\tMOVL f+0(FP), DI\n")
+	assert.Contains(t, out, "\tMOVBLZX b+4(FP), SI\n")
+	assert.Contains(t, out, "\tMOVQ n+8(FP), DX\n")
+	assert.Contains(t, out, "\tMOVQ AX, e+16(FP)\n")
+
+	out = genStubAMD64(t, st, offs["fl"])
+	assert.Contains(t, out, "\tMOVSD f+0(FP), X0\n")
+}
+
+func TestStubStructAMD64(t *testing.T) {
+	st, offs := newStubTestState(t, `package stub
+
+type Point struct{ X, Y float64 }
+type Rect struct{ X0, Y0, X1, Y1 float64 }
+type Pair struct{ A, B int32 }
+type Mixed struct {
+	X, Y float32
+	Z    int32
+}
+
+func bbox(p Point, q Point) (r Rect)
+func swap(p Pair) (r Pair)
+func mixed(m Mixed) (r Mixed)
+func many(a, b, c, d, e int64, p, q Pair) (r int64)
+`)
+	out := genStubAMD64(t, st, offs["bbox"])
+	assert.Contains(t, out, "TEXT ·bbox(SB), $288 - 64\n")
+	assert.Contains(t, out, "\tLEAQ r+32(FP), DI\n")
+	assert.Contains(t, out, "\tMOVSD p_X+0(FP), X0\n\tMOVSD p_Y+8(FP), X1\n")
+	assert.Contains(t, out, "\tMOVSD q_X+16(FP), X2\n\tMOVSD q_Y+24(FP), X3\n")
+	assert.Contains(t, out, "\tMOVQ 0(SP), SP\n\tRET\n")
+
+	out = genStubAMD64(t, st, offs["swap"])
+	assert.Contains(t, out, "\tLEAQ p_A+0(FP), R10\n\tMOVQ 0(R10), DI\n")
+	assert.Contains(t, out, "\tMOVQ AX, R11\n\tMOVL R11, r_A+8(FP)\n"+
+		"\tSHRQ $32, R11\n\tMOVL R11, r_B+12(FP)\n")
+
+	out = genStubAMD64(t, st, offs["mixed"])
+	assert.Contains(t, out, "\tLEAQ m_X+0(FP), R10\n\tMOVQ 0(R10), X0\n\tMOVL m_Z+8(FP), DI\n")
+	assert.Contains(t, out, "\tMOVQ X0, R11\n\tMOVL R11, r_X+16(FP)\n"+
+		"\tSHRQ $32, R11\n\tMOVL R11, r_Y+20(FP)\n")
+	assert.Contains(t, out, "\tMOVL AX, r_Z+24(FP)\n")
+
+	// q does not fit in the registers left, it goes to the stack.
+	out = genStubAMD64(t, st, offs["many"])
+	assert.Contains(t, out, "\tLEAQ p_A+40(FP), R10\n\tMOVQ 0(R10), R9\n")
+	assert.Contains(t, out, "\tLEAQ q_A+48(FP), R10\n\tMOVQ 0(R10), AX\n\tMOVQ AX, 0(R11)\n")
+}
+
+// TestStubStructProgramAMD64 passes structs packing several fields in
+// an eightbyte, by register and on the stack.
+func TestStubStructProgramAMD64(t *testing.T) {
+	out, ok := runStubProgramAMD64(t, `#include <stdint.h>
+struct pair { int32_t a, b; };
+struct mixed { float x, y; int32_t z; };
+struct big { int16_t a, b; int32_t c; int64_t d, e; };
+int64_t pack(struct pair p, struct mixed m) {
+	return p.a * 1000 + p.b * 100 + (int64_t)m.x * 10 + (int64_t)m.y + m.z;
+}
+int64_t spread(struct big b) { return b.a + b.b + b.c + b.d + b.e; }
+`, `package main
+
+type pair struct {
+	A, B int32
+}
+
+type mixed struct {
+	X, Y float32
+	Z    int32
+}
+
+type big struct {
+	A, B int16
+	C    int32
+	D, E int64
+}
+
+//golinker:symbol pack
+func Pack(p pair, m mixed) (r int64)
+
+//golinker:symbol spread
+func Spread(b big) (r int64)
+`, `package main
+
+import "fmt"
+
+func main() {
+	fmt.Println(Pack(pair{1, 2}, mixed{3, 4, 5}), Spread(big{1, 2, 3, 4, 5}))
+}
+`)
+	if ok {
+		assert.Equal(t, "1239 15\n", out)
+	}
+}
+
+func TestClassifySysV(t *testing.T) {
+	h, err := hdr.ParseFile("stub.go", `package stub
+
+type A struct {
+	F float32
+	I int32
+	D float64
+}
+
+func f(a A, s string, b [3]int64, c complex128, e struct{})
+`, "amd64")
+	if !assert.NoError(t, err) {
+		return
+	}
+	args, _, _, err := h.GetFuncArgRetSize(h.GetFuncDecls(false)[0])
+	assert.NoError(t, err)
+	var classes [][]sysvClass
+	for _, v := range args {
+		val, err := classifySysV(h, v)
+		assert.NoError(t, err)
+		cs := []sysvClass{val.class}
+		for _, p := range val.pieces {
+			cs = append(cs, p.class)
+		}
+		classes = append(classes, cs)
+	}
+	assert.Equal(t, [][]sysvClass{
+		{sysvInteger, sysvInteger, sysvSSE},
+		{sysvInteger, sysvInteger, sysvInteger},
+		{sysvMemory},
+		{sysvSSE, sysvSSE, sysvSSE},
+		{sysvNoClass},
+	}, classes)
+}
+
+func TestStubMultiResultAMD64(t *testing.T) {
+	st, offs := newStubTestState(t, `package stub
+
+import "syscall"
+
+func mul64(a, b uint64) (lo, hi uint64)
+func nerr(x int64) (n int, err syscall.Errno)
+func id(a int64, b float64) (x int64, y float64)
+func wide(x int64) (a, b, c int64)
+`)
+	out := genStubAMD64(t, st, offs["mul64"])
+	assert.Contains(t, out, "\tMOVQ AX, lo+16(FP)\n\tMOVQ DX, hi+24(FP)\n")
+
+	out = genStubAMD64(t, st, offs["nerr"])
+	assert.Contains(t, out, "\tMOVQ AX, n+8(FP)\n\tMOVQ DX, err+16(FP)\n")
+
+	out = genStubAMD64(t, st, offs["id"])
+	assert.Contains(t, out, "\tMOVQ AX, x+16(FP)\n\tMOVSD X0, y+24(FP)\n")
+
+	out = genStubAMD64(t, st, offs["wide"])
+	assert.Contains(t, out, "\tLEAQ a+8(FP), DI\n\tMOVQ x+0(FP), SI\n")
+}
+
+func TestStubNarrowIntAMD64(t *testing.T) {
+	st, offs := newStubTestState(t, `package stub
+
+type Flags struct {
+	Ok  bool
+	Bad bool
+}
+
+func ext(a bool, b int8, c uint8, d int16, e uint16, f int32)
+func spill(a, b, c, d, e, f int64, g int8) (ok bool)
+func flags() (r Flags)
+`)
+	out := genStubAMD64(t, st, offs["ext"])
+	assert.Contains(t, out, "\tMOVBLZX a+0(FP), DI\n")
+	assert.Contains(t, out, "\tMOVBLSX b+1(FP), SI\n")
+	assert.Contains(t, out, "\tMOVBLZX c+2(FP), DX\n")
+	assert.Contains(t, out, "\tMOVWLSX d+4(FP), CX\n")
+	assert.Contains(t, out, "\tMOVWLZX e+6(FP), R8\n")
+	assert.Contains(t, out, "\tMOVL f+8(FP), R9\n")
+
+	out = genStubAMD64(t, st, offs["spill"])
+	assert.Contains(t, out, "\tMOVBLSX g+48(FP), AX\n\tMOVQ AX, 0(R11)\n")
+	assert.Contains(t, out, "\tANDL $1, AX\n\tMOVB AX, ok+56(FP)\n")
+
+	out = genStubAMD64(t, st, offs["flags"])
+	assert.Contains(t, out, "\tMOVQ AX, R11\n"+
+		"\tMOVL R11, R10\n\tANDL $1, R10\n\tMOVB R10, r_Ok+0(FP)\n"+
+		"\tSHRQ $8, R11\n"+
+		"\tMOVL R11, R10\n\tANDL $1, R10\n\tMOVB R10, r_Bad+1(FP)\n")
+}
+
+func TestStubSliceStringAMD64(t *testing.T) {
+	st, offs := newStubTestState(t, `package stub
+
+func count(p []byte, c uint8) (n uint64)
+func slen(s string) (n uint64)
+
+//golinker:slice ptr,len,cap
+func room(b []byte) (n uint64)
+`)
+	out := genStubAMD64(t, st, offs["count"])
+	assert.Contains(t, out, "\tMOVQ p_base+0(FP), DI\n\tMOVQ p_len+8(FP), SI\n"+
+		"\tMOVBLZX c+24(FP), DX\n")
+
+	out = genStubAMD64(t, st, offs["slen"])
+	assert.Contains(t, out, "\tMOVQ s_base+0(FP), DI\n\tMOVQ s_len+8(FP), SI\n")
+
+	out = genStubAMD64(t, st, offs["room"])
+	assert.Contains(t, out, "\tMOVQ b_base+0(FP), DI\n\tMOVQ b_len+8(FP), SI\n"+
+		"\tMOVQ b_cap+16(FP), DX\n")
+}
+
+func TestStubDirectivesAMD64(t *testing.T) {
+	st, offs := newStubTestState(t, `package stub
+
+import "syscall"
+
+//golinker:symbol io_uring_submit
+//golinker:errno
+func Submit(ring uintptr) (n int32, err syscall.Errno)
+
+//golinker:errno
+func Close(fd int32) (err syscall.Errno)
+
+//golinker:nostack
+func deep(x int64) (r int64)
+
+//golinker:systemstack
+func big(n int64) (r int64)
+`)
+	out := genStubAMD64(t, st, offs["Submit"])
+	assert.Contains(t, out, "TEXT ·Submit(SB), $288 - 24\n")
+	assert.Contains(t, out, "\tXORL R10, R10\n\tTESTL AX, AX\n\tJGE _errno_done\n"+
+		"\tMOVL AX, R10\n\tNEGL R10\n_errno_done:\n\tMOVQ R10, err+16(FP)\n")
+	assert.Contains(t, out, "\tMOVL AX, n+8(FP)\n")
+
+	// no result left but the native int is still read.
+	out = genStubAMD64(t, st, offs["Close"])
+	assert.NotContains(t, out, "JMP AX")
+	assert.Contains(t, out, "\tTESTL AX, AX\n")
+	assert.Contains(t, out, "\tMOVQ R10, err+8(FP)\n")
+
+	st.sFnStackSz[offs["deep"]] = 64
+	out = genStubAMD64(t, st, offs["deep"])
+	assert.Contains(t, out, "TEXT ·deep(SB), NOSPLIT, $32 - 16\n")
+	assert.Contains(t, out, "\tLEAQ 15(SP), R11\n")
+
+	// the native stack comes from the pool, the leaf that switches to it
+	// gets a copy of the args and the stack top in R12.
+	st.sFnStackSz[offs["big"]] = 1 << 20
+	out = genStubAMD64(t, st, offs["big"])
+	assert.Contains(t, out, "TEXT ·big(SB), $24 - 16\n")
+	assert.Contains(t, out, "\tCALL ·__native_entry___stack_get(SB)\n"+
+		"\tMOVQ 0(SP), AX\n\tMOVQ AX, 16(SP)\n\tLEAQ n+0(FP), SI\n")
+	assert.Contains(t, out, "\tMOVQ 16(SP), R12\n\tCALL ·big__native(SB)\n"+
+		"\tLEAQ n+0(FP), SI\n\tMOVQ 8(SP), AX\n\tMOVQ AX, 8(SI)\n")
+	assert.Contains(t, out, "\tCALL ·__native_entry___stack_put(SB)\n\tRET\n")
+	// the goroutine SP and BP go in the header at the stack top.
+	assert.Contains(t, out, "TEXT ·big__native(SB), NOSPLIT|NOFRAME, $0 - 16\n\tNO_LOCAL_POINTERS\n"+
+		"\tMOVQ SP, -8(R12)\n\tMOVQ BP, -16(R12)\n\tLEAQ -40(R12), R11\n\tANDQ $~15, R11\n")
+	assert.Contains(t, out, "\tMOVQ 0(SP), R11\n\tMOVQ -16(R11), BP\n\tMOVQ -8(R11), SP\n")
+	assert.Contains(t, out, "\tMOVQ AX, r+8(FP)\n\tRET\n")
+}
+
+func TestCheckSignatureAMD64(t *testing.T) {
+	h, err := hdr.ParseFile("stub.go", `package stub
+
+import "syscall"
+
+type Point struct{ X, Y float64 }
+
+func ok(buf []byte, p Point, fd int32) (n int64)
+func narrow(fd int32, n int32) (r int64)
+func count(a, b int64) (r int64)
+func class(p Point) (r int64)
+func noret(a int64)
+func vret(a int64) (r int64)
+
+//golinker:errno
+func close2(fd int32) (err syscall.Errno)
+`, "amd64")
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := cdecl.Parse("x.h", `#include <stdint.h>
+#include <stddef.h>
+struct point { double x, y; };
+int64_t ok(const char *buf, size_t len, struct point p, int fd);
+int64_t narrow(int fd, int64_t n);
+int64_t count(int64_t a);
+struct pair { int64_t x, y; };
+int64_t class(struct pair p);
+int64_t noret(int64_t a);
+void vret(int64_t a);
+int close2(int fd);
+`, "amd64")
+	if !assert.NoError(t, err) {
+		return
+	}
+	cfns := map[string]*cdecl.FuncDecl{}
+	for _, d := range f.Decls {
+		if fn, ok := d.(*cdecl.FuncDecl); ok {
+			cfns[fn.Name] = fn
+		}
+	}
+	var errs []string
+	for _, fn := range h.GetFuncDecls(false) {
+		opts, err := h.GetFuncOptions(fn)
+		assert.NoError(t, err)
+		errs = append(errs, checkSignatureAMD64(h, fn, opts, cfns[fn.Name.Name])...)
+	}
+	assert.Equal(t, []string{
+		"stub.go:8:23: func narrow: arg n: size 4, C has 8 (int64_t)",
+		"stub.go:9:1: func count: 2 args, count takes 1",
+		"stub.go:10:12: func class: arg p: class [SSE SSE], C has [INTEGER INTEGER] (struct pair)",
+		"stub.go:11:1: func noret: missing result, noret returns int64_t",
+		"stub.go:12:21: func vret: vret returns void",
+	}, errs)
+}
+
+func TestStubNativeStackAMD64(t *testing.T) {
+	st, offs := newStubTestState(t, `package stub
+
+func walk(n int64) (r int64)
+`)
+	// the native stack is in the frame, the assembler checks it.
+	st.sFnStackSz[offs["walk"]] = 1000
+	out := genStubAMD64(t, st, offs["walk"])
+	assert.Contains(t, out, "TEXT ·walk(SB), $1296 - 16\n")
+	assert.Contains(t, out, "\tLEAQ 1279(SP), R11\n\tANDQ $~15, R11\n")
+	assert.NotContains(t, out, "NOSPLIT")
+	assert.NotContains(t, out, "morestack")
+	assert.NotContains(t, out, "(TLS)")
+}
+
+// runStubProgramAMD64 compiles csrc, links it against the stub file and
+// runs the Go program in main, returning its output.
+func runStubProgramAMD64(t *testing.T, csrc, stub, main string) (out string, ok bool) {
+	return runStubProgramOptsAMD64(t, csrc, stub, main, stubProgramOptsAMD64{})
+}
+
+type stubProgramOptsAMD64 struct {
+	// link runs on the object before the stubs are generated, it
+	// returns the object to use.
+	link func(obj string) (string, error)
+	// cfg adjusts the config of the stubs.
+	cfg func(cfg *conf.Config)
+}
+
+func runStubProgramOptsAMD64(t *testing.T, csrc, stub, main string,
+	opts stubProgramOptsAMD64) (out string, ok bool) {
+	if testing.Short() {
+		t.Skip("builds a Go program")
+	}
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command")
+	}
+	dir, cdir := t.TempDir(), t.TempDir()
+	write := func(name, src string) {
+		err := os.WriteFile(name, []byte(src), 0644)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	write(filepath.Join(cdir, "native.c"), csrc)
+	write(filepath.Join(dir, "stub.go"), stub)
+	write(filepath.Join(dir, "main.go"), main)
+	write(filepath.Join(dir, "go.mod"), "module native\n\ngo 1.18\n")
+
+	obj := filepath.Join(cdir, "native.o")
+	b, err := exec.Command(cc, "-O2", "-fPIC", "-fno-asynchronous-unwind-tables",
+		"-fno-stack-protector", "-fno-stack-clash-protection",
+		"-c", filepath.Join(cdir, "native.c"), "-o", obj).CombinedOutput()
+	if !assert.NoError(t, err, string(b)) {
+		return
+	}
+	if opts.link != nil {
+		if obj, err = opts.link(obj); !assert.NoError(t, err) {
+			return
+		}
+	}
+	f, err := elf.Open(obj)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+
+	disasm2.X86RawBytesFallback = true
+	defer func() { disasm2.X86RawBytesFallback = false }()
+	cfg := &conf.Config{
+		StubFile:        filepath.Join(dir, "stub.go"),
+		OutputDir:       dir,
+		NativeEntryName: "__native_entry__",
+	}
+	if opts.cfg != nil {
+		opts.cfg(cfg)
+	}
+	st, err := New(cfg, f)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, st.Generate()) {
+		return
+	}
+
+	// asmdecl does not follow the frame sizes of the stubs nor the
+	// entry, but the FP refs must match the width and offset of the
+	// args they name.
+	vet := exec.Command(goBin, "vet", "-asmdecl", ".")
+	vet.Dir = dir
+	vet.Env = append(os.Environ(), "GOWORK=off", "GOFLAGS=-mod=mod")
+	b, _ = vet.CombinedOutput()
+	for _, ln := range strings.Split(string(b), "\n") {
+		if !assert.NotContains(t, ln, ": invalid ") {
+			return
+		}
+	}
+
+	run := exec.Command(goBin, "run", ".")
+	run.Dir = dir
+	run.Env = append(os.Environ(), "GOWORK=off", "GOFLAGS=-mod=mod")
+	b, err = run.CombinedOutput()
+	return string(b), assert.NoError(t, err, string(b))
+}
+
+// TestStubDeepStackAMD64 links a native func using 4K of stack that
+// calls another using 64K, and calls it from fresh goroutines, their
+// stack must grow for both first.
+func TestStubDeepStackAMD64(t *testing.T) {
+	out, ok := runStubProgramAMD64(t, `#include <stdint.h>
+__attribute__((noinline)) int64_t sum(volatile uint8_t *p, int64_t n) {
+	volatile uint8_t buf[65536];
+	int64_t s = 0;
+	for (int64_t i = 0; i < n; i++)
+		buf[i] = p[i];
+	for (int64_t i = 0; i < n; i++)
+		s += buf[i];
+	return s;
+}
+int64_t fill(int64_t n) {
+	volatile uint8_t buf[4096];
+	for (int64_t i = 0; i < (int64_t)sizeof(buf); i++)
+		buf[i] = (uint8_t)(i + n);
+	return sum(buf, sizeof(buf));
+}
+`, `package main
+
+//golinker:symbol fill
+func Fill(n int64) (r int64)
+`, `package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+func nest(d int, n int64) int64 {
+	var pad [64]byte
+	pad[d%64] = byte(d)
+	if d == 0 {
+		return Fill(n)
+	}
+	return nest(d-1, n) + int64(pad[d%64]) - int64(d%256)
+}
+
+func main() {
+	var want int64
+	for i := int64(0); i < 4096; i++ {
+		want += int64(uint8(i + 7))
+	}
+	var wg sync.WaitGroup
+	var failed int32
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(d int) {
+			defer wg.Done()
+			if got := nest(d, 7); got != want {
+				fmt.Fprintf(os.Stderr, "depth %d: got %d, want %d\n", d, got, want)
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(i * 3)
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&failed) != 0 {
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+`)
+	if ok {
+		assert.Equal(t, "ok\n", out)
+	}
+}
+
+func TestStubSystemStackAMD64(t *testing.T) {
+	// 4 MB of recursion, more than a goroutine stack may grow to here.
+	out, ok := runStubProgramAMD64(t, `#include <stdint.h>
+// hidden, gcc would call a walk.localalias otherwise.
+__attribute__((visibility("hidden"))) int64_t walk(int64_t n) {
+	volatile uint8_t buf[4096];
+	buf[n & 4095] = (uint8_t)n;
+	if (n == 0)
+		return buf[0];
+	return walk(n - 1) + buf[n & 4095] - (uint8_t)n + 1;
+}
+`, `package main
+
+//golinker:systemstack
+//golinker:symbol walk
+func Walk(n int64) (r int64)
+`, `package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+func main() {
+	debug.SetMaxStack(1 << 20)
+	var wg sync.WaitGroup
+	var failed int32
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 8; j++ {
+				if got := Walk(1000); got != 1000 {
+					fmt.Fprintf(os.Stderr, "got %d, want 1000\n", got)
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&failed) != 0 {
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+`)
+	if ok {
+		assert.Equal(t, "ok\n", out)
+	}
+}
+
+func TestStubAlignedSpillAMD64(t *testing.T) {
+	// movaps faults unless the native SP is 16-byte aligned, Go SP is
+	// only 8-byte aligned at the stub. A nostack stub reserves no native
+	// stack, its SP is aligned all the same.
+	out, ok := runStubProgramAMD64(t, `#include <emmintrin.h>
+double spill(double a, double b) {
+	volatile __m128d v = _mm_set_pd(a, b);
+	return v[0] + v[1];
+}
+double spill_nostack(double a, double b) {
+	volatile __m128d v = _mm_set_pd(a, b);
+	return v[0] + v[1];
+}
+`, `package main
+
+//golinker:symbol spill
+func Spill(a, b float64) (r float64)
+
+//golinker:symbol spill_nostack
+//golinker:nostack
+func SpillNoStack(a, b float64) (r float64)
+`, `package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// nest calls Spill from frames of different sizes.
+func nest(d int, a float64) float64 {
+	var pad [3]uint64
+	pad[d%3] = uint64(d)
+	if d == 0 {
+		return Spill(a, 1) + SpillNoStack(a, 1) - a - 1
+	}
+	return nest(d-1, a) + float64(pad[d%3]) - float64(d)
+}
+
+func main() {
+	for d := 0; d < 16; d++ {
+		if got := nest(d, float64(d)); got != float64(d+1) {
+			fmt.Fprintf(os.Stderr, "depth %d: got %v\n", d, got)
+			os.Exit(1)
+		}
+	}
+	fmt.Println("ok")
+}
+`)
+	if ok {
+		assert.Equal(t, "ok\n", out)
+	}
+}
+
+func TestNativeEntryAMD64(t *testing.T) {
+	// every offset var is the entry address plus an offset, the entry
+	// starts with its own lea.
+	out, ok := runStubProgramAMD64(t, `#include <stdint.h>
+int64_t one(void) { return 1; }
+`, `package main
+
+//golinker:symbol one
+func One() (r int64)
+`, `package main
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+func main() {
+	entry := __native_entry__()
+	fmt.Printf("%x %d\n", *(*[3]byte)(unsafe.Pointer(entry)), One())
+}
+`)
+	if ok {
+		assert.Equal(t, "488d05 1\n", out)
+	}
+}
+
+func TestAnalyzeStackAMD64(t *testing.T) {
+	st, offs := newStubTestState(t, `package stub
+
+func top(n int64) (r int64)
+func rec(n int64) (r int64)
+func ext(n int64) (r int64)
+
+//golinker:nostack
+func quiet(n int64) (r int64)
+`)
+	// unbound natives after the stubs, sFnOrder stays sorted.
+	leaf, tail := uint64(0x50), uint64(0x60)
+	for i, name := range []string{"leaf", "tail"} {
+		off := leaf + uint64(i)*0x10
+		st.sFnName[off] = name
+		st.sFnSize[off] = 0x10
+		st.sFnOrder = append(st.sFnOrder, off)
+	}
+	st.sExtSym[0x1000] = "malloc"
+	st.sFnFrame[offs["top"]] = disasm2.StackFrame{Size: 0x18, Calls: []uint64{leaf, tail + 4}}
+	st.sFnFrame[leaf] = disasm2.StackFrame{Size: 0x100}
+	st.sFnFrame[tail] = disasm2.StackFrame{Size: 0x8, TailCalls: []uint64{leaf}}
+	st.sFnFrame[offs["rec"]] = disasm2.StackFrame{Size: 0x20, Calls: []uint64{leaf, offs["rec"]}}
+	st.sFnFrame[offs["ext"]] = disasm2.StackFrame{Size: 0x10, Calls: []uint64{0x1000}}
+	st.sFnFrame[offs["quiet"]] = disasm2.StackFrame{Unbounded: "indirect call at 0x42: callq *%rax"}
+
+	assert.NoError(t, st.analyzeStackAMD64())
+	// own frame, return address and the deepest callee, a call into
+	// the middle of tail counts as tail.
+	assert.Equal(t, uint64(0x18+8+0x100), st.sFnStackSz[offs["top"]])
+	assert.Equal(t, uint64(0x100), st.sFnStackSz[tail])
+	assert.Equal(t, "", st.sFnStackUnbounded[offs["top"]])
+
+	assert.Equal(t, uint64(0x20+8+0x100), st.sFnStackSz[offs["rec"]])
+	assert.Equal(t, "rec -> rec: recursion", st.sFnStackUnbounded[offs["rec"]])
+	assert.Equal(t, "ext: calls external malloc", st.sFnStackUnbounded[offs["ext"]])
+	assert.Equal(t, "quiet: indirect call at 0x42: callq *%rax", st.sFnStackUnbounded[offs["quiet"]])
+
+	// nostack funcs are not reported.
+	assert.Equal(t, []string{
+		"stub.go:4:1: func rec: native stack is unbounded (rec -> rec: recursion), the 296 bytes reserved may not be enough",
+		"stub.go:5:1: func ext: native stack is unbounded (ext: calls external malloc), the 24 bytes reserved may not be enough",
+	}, st.Warnings)
+}
+
+func TestStubReservedRegsAMD64(t *testing.T) {
+	st, offs := newStubTestState(t, `package stub
+
+func add2(a, b uint64) (ret uint64)
+func add8(a1, a2, a3, a4, a5, a6, a7, a8 uint64) (ret uint64)
+`)
+	out := genStubAMD64(t, st, offs["add2"])
+	assert.Contains(t, out, "\tMOVQ R11, SP\n"+
+		"\tMOVQ R14, 8(SP)\n\tMOVQ R15, 16(SP)\n"+
+		"\tCALL ·__native_entry__+16(SB)\n"+
+		"\tMOVQ 8(SP), R14\n\tMOVQ 16(SP), R15\n"+
+		"\tXORPS X15, X15\n\tCLD\n"+
+		"\tMOVQ 0(SP), SP\n")
+
+	// the slots sit above the outgoing stack args.
+	out = genStubAMD64(t, st, offs["add8"])
+	assert.Contains(t, out, "\tMOVQ R14, 24(SP)\n\tMOVQ R15, 32(SP)\n")
+	assert.Contains(t, out, "\tMOVQ 24(SP), R14\n\tMOVQ 32(SP), R15\n")
+}
+
+func TestStubBuiltinsAMD64(t *testing.T) {
+	link := func(obj string) (string, error) {
+		archive, err := cc.BuiltinsArchive(elf.EM_X86_64)
+		if err != nil || archive == "" {
+			t.Skip("no builtins archive")
+		}
+		out := obj + ".builtins.o"
+		b, err := exec.Command("ld", "--relocatable", "-o", out, obj, archive).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", err, b)
+		}
+		return out, nil
+	}
+	// the archive members come with .eh_frame, its relocations must not
+	// land in .text.
+	out, ok := runStubProgramOptsAMD64(t, `#include <stdint.h>
+uint64_t udiv(uint64_t hi, uint64_t lo, uint64_t d) {
+	unsigned __int128 n = ((unsigned __int128)hi << 64) | lo;
+	return (uint64_t)(n / d);
+}
+int64_t pop(uint64_t v) { return __builtin_popcountll(v); }
+`, `package main
+
+func udiv(hi, lo, d uint64) (r uint64)
+func pop(v uint64) (r int64)
+`, `package main
+
+import "fmt"
+
+func main() {
+	fmt.Println(udiv(1, 0, 3), pop(0xf0f0))
+}
+`, stubProgramOptsAMD64{link: link})
+	if ok {
+		assert.Equal(t, "6148914691236517205 8\n", out)
+	}
+}
+
+func TestStubRodataAMD64(t *testing.T) {
+	// .rodata.cst8 follows the strings, it is aligned where it is laid
+	// down, not at its file offset.
+	out, ok := runStubProgramAMD64(t, `#include <stdint.h>
+int64_t tag(void) { return "xyz"[1]; }
+double scale(double x) { return x * 1.5 + 0.25; }
+`, `package main
+
+func tag() (r int64)
+func scale(x float64) (r float64)
+`, `package main
+
+import "fmt"
+
+func main() {
+	fmt.Println(tag(), scale(2))
+}
+`)
+	if ok {
+		assert.Equal(t, "121 3.25\n", out)
+	}
+}
+
+func TestStubGOTPCRELAMD64(t *testing.T) {
+	// -fPIC loads the address of a global through the GOT, there is no
+	// GOT, the load is relaxed to a LEAQ of the global.
+	out, ok := runStubProgramAMD64(t, `#include <stdint.h>
+const int64_t primes[] = {2, 3, 5, 7};
+int64_t prime(int64_t i) { return primes[i]; }
+`, `package main
+
+func prime(i int64) (r int64)
+`, `package main
+
+import "fmt"
+
+func main() {
+	fmt.Println(prime(0), prime(3))
+}
+`)
+	if ok {
+		assert.Equal(t, "2 7\n", out)
+	}
+}
@@ -0,0 +1,330 @@
+package elf
+
+import (
+	"bufio"
+	"fmt"
+	"go/types"
+
+	"github.com/ii64/golinker/lib/hdr"
+)
+
+// ref: System V Application Binary Interface, AMD64 Architecture
+// Processor Supplement, 3.2.3 Parameter Passing.
+
+type sysvClass uint8
+
+const (
+	sysvNoClass sysvClass = iota
+	sysvInteger
+	sysvSSE
+	sysvMemory
+)
+
+func (c sysvClass) String() string {
+	switch c {
+	case sysvInteger:
+		return "INTEGER"
+	case sysvSSE:
+		return "SSE"
+	case sysvMemory:
+		return "MEMORY"
+	}
+	return "NO_CLASS"
+}
+
+var (
+	sysvIntArgRegs = []string{"DI", "SI", "DX", "CX", "R8", "R9"}
+	sysvSSEArgRegs = []string{"X0", "X1", "X2", "X3", "X4", "X5", "X6", "X7"}
+	sysvIntRetRegs = []string{"AX", "DX"}
+	sysvSSERetRegs = []string{"X0", "X1"}
+)
+
+// sysvEightbyte is a register sized piece of a classified value.
+type sysvEightbyte struct {
+	class  sysvClass
+	off    uint64 // FP offset
+	size   uint64 // bytes of the value covered by this piece
+	fields []hdr.Field
+	reg    string
+}
+
+// sysvValue is a Go var classified as a SysV argument or result.
+type sysvValue struct {
+	v      hdr.Var
+	class  sysvClass // sysvMemory if the whole value is passed in memory
+	fields []hdr.Field
+	pieces []sysvEightbyte
+
+	stackOff uint64 // offset in the outgoing arg area, if on the stack
+}
+
+func (val sysvValue) onStack() bool {
+	return val.class == sysvMemory
+}
+
+func sysvFieldClass(t types.Type) sysvClass {
+	if b, ok := t.Underlying().(*types.Basic); ok && b.Info()&types.IsFloat != 0 {
+		return sysvSSE
+	}
+	return sysvInteger
+}
+
+// classifySysV splits v into eightbytes and classifies each of them.
+// Values larger than two eightbytes are passed in memory.
+func classifySysV(h hdr.Hdr, v hdr.Var) (val sysvValue, err error) {
+	var fields []hdr.Field
+	fields, err = h.Fields(v)
+	if err != nil {
+		return
+	}
+	val = classifySysVFields(v, fields)
+	return
+}
+
+// classifySysVResults classifies the results as the fields of a single
+// struct, the Go result area is laid out the same way as the C struct.
+func classifySysVResults(h hdr.Hdr, rets []hdr.Var) (val sysvValue, err error) {
+	if len(rets) == 1 {
+		return classifySysV(h, rets[0])
+	}
+	var fields []hdr.Field
+	for _, v := range rets {
+		var fs []hdr.Field
+		fs, err = h.Fields(v)
+		if err != nil {
+			return
+		}
+		fields = append(fields, fs...)
+	}
+	v := rets[0]
+	last := rets[len(rets)-1]
+	v.Size = last.Offset + last.Size - v.Offset
+	v.Type = nil
+	val = classifySysVFields(v, fields)
+	return
+}
+
+func classifySysVFields(v hdr.Var, fields []hdr.Field) (val sysvValue) {
+	val.v = v
+	val.fields = fields
+	if v.Size == 0 {
+		return
+	}
+	if v.Size > 16 {
+		val.class = sysvMemory
+		return
+	}
+
+	n := (v.Size + 7) / 8
+	val.pieces = make([]sysvEightbyte, n)
+	for i := range val.pieces {
+		p := &val.pieces[i]
+		p.off = v.Offset + uint64(i)*8
+		p.size = v.Size - uint64(i)*8
+		if p.size > 8 {
+			p.size = 8
+		}
+	}
+	for _, f := range val.fields {
+		if f.Size == 0 {
+			continue
+		}
+		p := &val.pieces[(f.Offset-v.Offset)/8]
+		p.fields = append(p.fields, f)
+		// INTEGER wins over SSE within an eightbyte.
+		switch c := sysvFieldClass(f.Type); {
+		case p.class == sysvNoClass:
+			p.class = c
+		case c == sysvInteger:
+			p.class = sysvInteger
+		}
+	}
+	val.class = val.pieces[0].class
+	for _, p := range val.pieces {
+		if p.class == sysvInteger {
+			val.class = sysvInteger
+		}
+	}
+	return
+}
+
+// sysvCallAMD64 is the SysV lowering of a stub signature.
+type sysvCallAMD64 struct {
+	args []sysvValue
+	ret  *sysvValue
+	// sret is set when the result is returned in memory, the caller
+	// passes the result address in DI.
+	sret bool
+	// errno is the Go result set from a negative native return, the
+	// native return is errnoSize bytes wide.
+	errno     *hdr.Var
+	errnoSize uint64
+
+	outArgs uint64 // bytes of args passed on the stack
+}
+
+// splitErrno takes the errno result off rets. The native return is
+// the first of the remaining results, or a C int if there is none.
+func (c *sysvCallAMD64) splitErrno(rets []hdr.Var) ([]hdr.Var, error) {
+	if len(rets) == 0 {
+		return nil, fmt.Errorf("//golinker:errno needs an errno result")
+	}
+	v := rets[len(rets)-1]
+	if b, ok := v.Type.Underlying().(*types.Basic); !ok || b.Info()&types.IsInteger == 0 {
+		return nil, fmt.Errorf("errno result %s must be an integer, have %s", v.Name, v.Type)
+	}
+	rets = rets[:len(rets)-1]
+	c.errno = &v
+	c.errnoSize = 4
+	if len(rets) > 0 {
+		b, ok := rets[0].Type.Underlying().(*types.Basic)
+		if !ok || b.Info()&types.IsInteger == 0 || rets[0].Size < 4 {
+			return nil, fmt.Errorf("result %s must be a 32 or 64 bit integer to carry -errno, have %s",
+				rets[0].Name, rets[0].Type)
+		}
+		c.errnoSize = rets[0].Size
+	}
+	return rets, nil
+}
+
+// writeErrno stores -AX to the errno result if AX is negative, 0
+// otherwise. R10 is clobbered, AX is left as is.
+func (c *sysvCallAMD64) writeErrno(bio *bufio.Writer) {
+	sfx := "Q"
+	if c.errnoSize == 4 {
+		sfx = "L"
+	}
+	bio.WriteString("\tXORL R10, R10\n")
+	bio.WriteString(fmt.Sprintf("\tTEST%s AX, AX\n", sfx))
+	bio.WriteString("\tJGE _errno_done\n")
+	bio.WriteString(fmt.Sprintf("\tMOV%s AX, R10\n", sfx))
+	bio.WriteString(fmt.Sprintf("\tNEG%s R10\n", sfx))
+	bio.WriteString("_errno_done:\n")
+	bio.WriteString(fmt.Sprintf("\t%s R10, %s+%d(FP)\n",
+		movFromSizeAMD64(c.errno.Size), c.errno.Name, c.errno.Offset))
+}
+
+// decomposeSysV passes string and slice args as separate (ptr, len)
+// or (ptr, len, cap) args, the way C APIs take buffers.
+func decomposeSysV(h hdr.Hdr, args []hdr.Var, opts hdr.FuncOptions) (out []hdr.Var, err error) {
+	for _, v := range args {
+		parts := 0
+		switch u := v.Type.Underlying().(type) {
+		case *types.Slice:
+			parts = opts.SliceParts
+		case *types.Basic:
+			if u.Kind() == types.String {
+				parts = 2
+			}
+		}
+		if parts == 0 {
+			out = append(out, v)
+			continue
+		}
+		var fs []hdr.Field
+		fs, err = h.Fields(v)
+		if err != nil {
+			return
+		}
+		for _, f := range fs[:parts] {
+			out = append(out, hdr.Var{
+				Offset: f.Offset,
+				Size:   f.Size,
+				Name:   f.Name,
+				Type:   f.Type,
+			})
+		}
+	}
+	return
+}
+
+func lowerSysVCallAMD64(h hdr.Hdr, fnName string, args, rets []hdr.Var, opts hdr.FuncOptions) (c sysvCallAMD64, err error) {
+	var nInt, nSSE int
+
+	args, err = decomposeSysV(h, args, opts)
+	if err != nil {
+		err = fmt.Errorf("func %s: %w", fnName, err)
+		return
+	}
+
+	if opts.Errno {
+		rets, err = c.splitErrno(rets)
+		if err != nil {
+			err = fmt.Errorf("func %s: %w", fnName, err)
+			return
+		}
+	}
+
+	if len(rets) > 0 {
+		var ret sysvValue
+		ret, err = classifySysVResults(h, rets)
+		if err != nil {
+			err = fmt.Errorf("func %s: %w", fnName, err)
+			return
+		}
+		if ret.onStack() {
+			c.sret = true
+			nInt++
+		} else {
+			var ri, rs int
+			for i := range ret.pieces {
+				p := &ret.pieces[i]
+				switch p.class {
+				case sysvInteger:
+					p.reg = sysvIntRetRegs[ri]
+					ri++
+				case sysvSSE:
+					p.reg = sysvSSERetRegs[rs]
+					rs++
+				}
+			}
+		}
+		c.ret = &ret
+	}
+
+	for _, v := range args {
+		var val sysvValue
+		val, err = classifySysV(h, v)
+		if err != nil {
+			err = fmt.Errorf("func %s: %w", fnName, err)
+			return
+		}
+
+		if !val.onStack() {
+			var wantInt, wantSSE int
+			for _, p := range val.pieces {
+				switch p.class {
+				case sysvInteger:
+					wantInt++
+				case sysvSSE:
+					wantSSE++
+				}
+			}
+			// an arg goes to the stack as a whole if any of its
+			// eightbytes does not get a register.
+			if nInt+wantInt > len(sysvIntArgRegs) ||
+				nSSE+wantSSE > len(sysvSSEArgRegs) {
+				val.class = sysvMemory
+			} else {
+				for i := range val.pieces {
+					p := &val.pieces[i]
+					switch p.class {
+					case sysvInteger:
+						p.reg = sysvIntArgRegs[nInt]
+						nInt++
+					case sysvSSE:
+						p.reg = sysvSSEArgRegs[nSSE]
+						nSSE++
+					}
+				}
+			}
+		}
+
+		if val.onStack() {
+			val.stackOff = c.outArgs
+			c.outArgs += (v.Size + 7) &^ 7
+		}
+		c.args = append(c.args, val)
+	}
+	return
+}
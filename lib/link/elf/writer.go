@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/ii64/golinker/lib/disasm2"
@@ -84,6 +85,15 @@ func (st *LinkState) writeAsmExtSymStub(writer io.Writer) (err error) {
 
 	for _, extSymOff := range st.sExtSymOffOrder {
 		extSymName := st.sExtSym[extSymOff]
+		if _, ok := st.sExport[extSymName]; ok {
+			continue
+		}
+		if _, ok := st.libcShimByName(extSymName); ok {
+			continue
+		}
+		if st.isStdioShim(extSymName) || st.isStdioStream(extSymName) {
+			continue
+		}
 
 		bio.WriteString(fmt.Sprintf("// emu off: %x (%d)\n", extSymOff, extSymOff))
 		bio.WriteString(fmt.Sprintf(
@@ -110,6 +120,28 @@ func (st *LinkState) writeOffAMD64(writer io.Writer) (err error) {
 	bio.WriteString(fileDiscHeader)
 	bio.WriteString(fmt.Sprintf("package %s\n\n", st.hdr.PackageName()))
 
+	systemStack, arena, stdio := st.usesSystemStack(), st.usesArena(), st.usesStdio()
+	var imports []string
+	if systemStack {
+		imports = append(imports, "sync", "syscall", "unsafe")
+	}
+	if arena {
+		imports = append(imports, "runtime", "sync/atomic", "unsafe")
+	}
+	if stdio {
+		imports = append(imports, "fmt", "os", "strconv", "strings", "unsafe")
+	}
+	if len(imports) > 0 {
+		sort.Strings(imports)
+		bio.WriteString("import (\n")
+		for i, pkg := range imports {
+			if i == 0 || pkg != imports[i-1] {
+				bio.WriteString(fmt.Sprintf("\t%q\n", pkg))
+			}
+		}
+		bio.WriteString(")\n\n")
+	}
+
 	bio.WriteString("//go:nosplit\n")
 	bio.WriteString("//go:noescape\n")
 	bio.WriteString("//goland:noinspection ALL\n")
@@ -117,6 +149,16 @@ func (st *LinkState) writeOffAMD64(writer io.Writer) (err error) {
 
 	bio.WriteString("\n")
 
+	if systemStack {
+		st.writeNativeStackPoolAMD64(bio)
+	}
+	if arena {
+		st.writeArenaGoAMD64(bio)
+	}
+	if stdio {
+		st.writeStdioGoAMD64(bio)
+	}
+
 	var subrVar []string
 	var stackVar []string
 
@@ -177,6 +219,9 @@ func (st *LinkState) writeOffAMD64(writer io.Writer) (err error) {
 			}
 
 			stackVar = append(stackVar, varName)
+			if why := st.sFnStackUnbounded[fnOff]; why != "" {
+				bio.WriteString(fmt.Sprintf("\t// unbounded, %s\n", why))
+			}
 			bio.WriteString(fmt.Sprintf("\t%s = %d\n", varName, fnStackSz))
 		}
 		bio.WriteString(")\n\n")
@@ -220,8 +265,10 @@ func (st *LinkState) writeAsmAMD64(writer io.Writer) (err error) {
 
 	bio.WriteRune('\n')
 
+	// no prologue, the entry code stores ret at 8(SP) and every
+	// ·entry+off the stubs call must be the native code as linked.
 	_, err = bio.WriteString(fmt.Sprintf(
-		"TEXT ·%s(SB), NOSPLIT, $0\n", st.cfg.NativeEntryName))
+		"TEXT ·%s(SB), NOSPLIT|NOFRAME, $0\n", st.cfg.NativeEntryName))
 	if err != nil {
 		return
 	}
@@ -293,6 +340,21 @@ func (st *LinkState) writeAsmAMD64(writer io.Writer) (err error) {
 		bio.WriteRune('\n')
 	}
 
+	// !! ----- write callbacks ------
+
+	err = st.writeCallbacksAMD64(bio)
+	if err != nil {
+		return
+	}
+
+	// !! ----- write libc shims ------
+
+	st.writeLibcShimsAMD64(bio)
+
+	// !! ----- write stdio shims ------
+
+	st.writeStdioAMD64(bio)
+
 	// !! ----- flush ------
 
 	bio.WriteString("\n")
@@ -311,7 +373,9 @@ func (st *LinkState) getAsmFuncStubAMD64(fnOff uint64, bio *bufio.Writer) (err e
 		return
 	}
 
-	fnName, exist := st.sFnName[fnOff]
+	_, exist := st.sFnName[fnOff]
+	fnName := fn.Name.Name
+	opts := st.sFnOpts[fnOff]
 	fnStackSz, exist2 := st.sFnStackSz[fnOff]
 	var fnArgRetSz uint64
 	if !exist {
@@ -325,7 +389,16 @@ func (st *LinkState) getAsmFuncStubAMD64(fnOff uint64, bio *bufio.Writer) (err e
 
 	var args []hdr.Var
 	var rets []hdr.Var
-	args, rets, fnArgRetSz = st.hdr.GetFuncArgRetSize(fn)
+	args, rets, fnArgRetSz, err = st.hdr.GetFuncArgRetSize(fn)
+	if err != nil {
+		return
+	}
+
+	var call sysvCallAMD64
+	call, err = lowerSysVCallAMD64(st.hdr, fnName, args, rets, opts)
+	if err != nil {
+		return
+	}
 
 	// write comment if available
 	if cmt := fn.Doc.Text(); cmt != "" {
@@ -333,10 +406,28 @@ func (st *LinkState) getAsmFuncStubAMD64(fnOff uint64, bio *bufio.Writer) (err e
 		bio.WriteString(fmt.Sprintf("// %s", strings.Replace(cmt, "\n", "\n// ", -1)))
 		bio.WriteRune('\n')
 	}
-	// func asm decl
+
+	if opts.SystemStack {
+		err = st.writeSystemStackStubAMD64(bio, fnOff, fnName, call, args, rets, fnArgRetSz)
+		if err != nil {
+			return
+		}
+		err = bio.Flush()
+		return
+	}
+
+	// the native stack is reserved in the frame, without NOSPLIT the Go
+	// assembler checks it against g.stackguard0 and calls morestack.
+	var nativeStack uint64
+	flag := " NOSPLIT,"
+	if !opts.NoStack {
+		nativeStack = fnStackSz + stubStackSlackAMD64
+		flag = ""
+	}
+	frame := newStubFrameAMD64(call.outArgs, nativeStack)
 	_, err = bio.WriteString(fmt.Sprintf(
-		"TEXT ·%s(SB), NOSPLIT | NOFRAME, $0 - %d\n",
-		fnName, fnArgRetSz))
+		"TEXT ·%s(SB),%s $%d - %d\n",
+		fnName, flag, frame.size, fnArgRetSz))
 	if err != nil {
 		return
 	}
@@ -345,86 +436,121 @@ func (st *LinkState) getAsmFuncStubAMD64(fnOff uint64, bio *bufio.Writer) (err e
 		return
 	}
 
-	// need stack grow prologue/epilogue
-	needStackGrow := fnStackSz > 0
+	bio.WriteString(fmt.Sprintf("_%s:\n", fnName))
 
-	// check stack, if it below desired address, call morestack.
-	if needStackGrow {
-		bio.WriteString("_entry:\n")
-		bio.WriteString("\tMOVQ (TLS), R14\n")
-		bio.WriteString(fmt.Sprintf("\tLEAQ %d(SP), R12\n", -int64(fnStackSz)))
-		bio.WriteString("\tJBE _more_stack\n\n")
-	}
+	// stack args are copied while FP still refers to the Go frame,
+	// the native SP is kept in R11 until the switch.
+	frame.writeAlignSP(bio, "R11")
+	st.writeNativeCallAMD64(bio, fnOff, frame, call)
+	bio.WriteString("\tRET\n")
 
-	// --- stack to regs ---
-	argsysv := []string{"DI", "SI", "DX", "CX", "R8", "R9"}
-	retsysv := []string{"AX"}
-	// todo: handle floating point register
+	bio.WriteRune('\n')
 
-	bio.WriteString(fmt.Sprintf("_%s:\n", fnName))
+	err = bio.Flush()
+	return
+}
 
-	mnFromSz := func(sz uint64) string {
-		switch sz {
-		case 4:
-			return "MOVL"
-		case 2:
-			return "MOVW"
-		case 1:
-			return "MOVB"
+// writeNativeCallAMD64 writes the call of the native function at fnOff
+// through the native SP in R11: stack args, register args, the switch,
+// the call and the results.
+func (st *LinkState) writeNativeCallAMD64(bio *bufio.Writer, fnOff uint64, frame stubFrameAMD64, call sysvCallAMD64) {
+	// --- stack to regs ---
+	for _, val := range call.args {
+		if val.onStack() {
+			writeStackCopy(bio, val, "R11")
 		}
-		return "MOVQ"
 	}
-
-	for i := range args {
-		argname := args[i]
-		if i >= len(argsysv) {
-			err = fmt.Errorf("register not available for arg: %q", argname)
-			return
+	if call.sret {
+		bio.WriteString(fmt.Sprintf("\tLEAQ %s+%d(FP), DI\n",
+			call.ret.v.Name, call.ret.v.Offset))
+	}
+	for _, val := range call.args {
+		if val.onStack() {
+			continue
 		}
-		v := args[i]
-		regDst := argsysv[i]
-		// write arg
-		mnem := mnFromSz(v.Size)
-
-		bio.WriteString(fmt.Sprintf("\t%s %s+%d(FP), %s\n",
-			mnem, v.Name, v.Offset,
-			regDst))
-	}
-	if len(rets) < 1 {
-		bio.WriteString(fmt.Sprintf("\tLEAQ ·%s+%d(SB), AX\n",
-			st.cfg.NativeEntryName, fnOff,
-		))
-		bio.WriteString("\tJMP AX\n")
-	} else {
-		bio.WriteString(fmt.Sprintf("\tCALL ·%s+%d(SB)\n",
-			st.cfg.NativeEntryName, fnOff,
-		))
-		for i := range rets {
-			v := rets[i]
-			if i >= len(retsysv) {
-				err = fmt.Errorf("register not available for ret: %q", v.Name)
-				return
-			}
-			regSrc := retsysv[i]
-			// write ret
-			mnem := mnFromSz(v.Size)
-			bio.WriteString(fmt.Sprintf("\t%s %s, %s+%d(FP)\n",
-				mnem,
-				regSrc,
-				v.Name, v.Offset))
+		for _, p := range val.pieces {
+			writeLoadPiece(bio, p, fpRef)
 		}
-		bio.WriteString("\tRET\n")
 	}
 
-	bio.WriteRune('\n')
-
-	// more stack
-	if needStackGrow {
-		bio.WriteString("_more_stack:\n")
-		bio.WriteString("\tCALL runtime·morestack_noctxt<>(SB)\n")
-		bio.WriteString("\tJMP _entry\n\n")
+	// R14, R15 and X15 are restored, no tail call.
+	frame.writeSwitchSP(bio, "R11")
+	frame.writeSaveRegs(bio)
+	bio.WriteString(fmt.Sprintf("\tCALL ·%s+%d(SB)\n",
+		st.cfg.NativeEntryName, fnOff,
+	))
+	frame.writeRestoreRegs(bio)
+	frame.writeRestoreSP(bio)
+	if call.errno != nil {
+		call.writeErrno(bio)
 	}
+	// regs to results, a memory class result is already written
+	// by the callee through DI.
+	if call.ret != nil && !call.sret {
+		for _, p := range call.ret.pieces {
+			writeStorePiece(bio, p)
+		}
+	}
+}
 
-	err = bio.Flush()
+// writeSystemStackStubAMD64 writes a stub running the native code on a
+// stack from the pool. The runtime cannot unwind through a function that
+// writes SP, so the stub that calls the pool never switches: it copies
+// its args to a leaf, fnName__native, that switches to the stack top it
+// gets in R12, and copies the results back.
+func (st *LinkState) writeSystemStackStubAMD64(bio *bufio.Writer, fnOff uint64, fnName string,
+	call sysvCallAMD64, args, rets []hdr.Var, fnArgRetSz uint64) (err error) {
+	argRetSz := (fnArgRetSz + 7) &^ 7
+	// the top is kept above the leaf args.
+	topSlot := argRetSz
+	_, err = bio.WriteString(fmt.Sprintf(
+		"TEXT ·%s(SB), $%d - %d\n", fnName, argRetSz+8, fnArgRetSz))
+	if err != nil {
+		return
+	}
+	bio.WriteString("\tNO_LOCAL_POINTERS\n\n")
+	bio.WriteString(fmt.Sprintf("_%s:\n", fnName))
+	bio.WriteString(fmt.Sprintf("\tCALL ·%s(SB)\n", st.nativeStackGetName()))
+	bio.WriteString("\tMOVQ 0(SP), AX\n")
+	bio.WriteString(fmt.Sprintf("\tMOVQ AX, %d(SP)\n", topSlot))
+
+	// the frame is copied by words, ABI0 rounds it up to 8 bytes.
+	var first hdr.Var
+	switch {
+	case len(args) > 0:
+		first = args[0]
+	case len(rets) > 0:
+		first = rets[0]
+	}
+	if argRetSz > 0 {
+		bio.WriteString(fmt.Sprintf("\tLEAQ %s+0(FP), SI\n", first.Name))
+		for off := uint64(0); off < argRetSz; off += 8 {
+			bio.WriteString(fmt.Sprintf("\tMOVQ %d(SI), AX\n", off))
+			bio.WriteString(fmt.Sprintf("\tMOVQ AX, %d(SP)\n", off))
+		}
+	}
+	bio.WriteString(fmt.Sprintf("\tMOVQ %d(SP), R12\n", topSlot))
+	bio.WriteString(fmt.Sprintf("\tCALL ·%s__native(SB)\n", fnName))
+	if len(rets) > 0 {
+		bio.WriteString(fmt.Sprintf("\tLEAQ %s+0(FP), SI\n", first.Name))
+		for off := rets[0].Offset &^ 7; off < argRetSz; off += 8 {
+			bio.WriteString(fmt.Sprintf("\tMOVQ %d(SP), AX\n", off))
+			bio.WriteString(fmt.Sprintf("\tMOVQ AX, %d(SI)\n", off))
+		}
+	}
+	bio.WriteString(fmt.Sprintf("\tMOVQ %d(SP), AX\n", topSlot))
+	bio.WriteString("\tMOVQ AX, 0(SP)\n")
+	bio.WriteString(fmt.Sprintf("\tCALL ·%s(SB)\n", st.nativeStackPutName()))
+	bio.WriteString("\tRET\n\n")
+
+	// the leaf sees the copy as its own arg frame, under the same names.
+	// Without a frame its SP is the return address a callback unwinds
+	// through.
+	frame := newPoolFrameAMD64(call.outArgs, "R12")
+	bio.WriteString(fmt.Sprintf("TEXT ·%s__native(SB), NOSPLIT|NOFRAME, $0 - %d\n", fnName, fnArgRetSz))
+	bio.WriteString("\tNO_LOCAL_POINTERS\n")
+	frame.writeAlignTop(bio, "R11")
+	st.writeNativeCallAMD64(bio, fnOff, frame, call)
+	_, err = bio.WriteString("\tRET\n\n")
 	return
 }
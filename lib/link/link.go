@@ -28,3 +28,11 @@ func Link(cfg *conf.Config, obj *obj.Object) (state *LinkState, err error) {
 	}
 	return
 }
+
+// Warnings returns the problems found that did not stop the link.
+func (s *LinkState) Warnings() []string {
+	if s.elf != nil {
+		return s.elf.Warnings
+	}
+	return nil
+}
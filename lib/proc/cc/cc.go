@@ -0,0 +1,63 @@
+package cc
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ii64/golinker/lib/proc"
+)
+
+var DEFAULT_CC = "cc"
+
+// machines maps the arch of a target triple to its ELF machine.
+var machines = map[string]elf.Machine{
+	"x86_64":  elf.EM_X86_64,
+	"aarch64": elf.EM_AARCH64,
+	"i386":    elf.EM_386,
+	"i686":    elf.EM_386,
+}
+
+// query runs the compiler with args and returns the first line it
+// prints.
+func query(args ...string) (string, error) {
+	var out bytes.Buffer
+	p := proc.New(DEFAULT_CC, args)
+	p.Stdin = nil
+	p.Stdout = &out
+	if err := p.Run(); err != nil {
+		return "", fmt.Errorf("%s %s: %w", DEFAULT_CC, strings.Join(args, " "), err)
+	}
+	line, _, _ := strings.Cut(out.String(), "\n")
+	return strings.TrimSpace(line), nil
+}
+
+// BuiltinsArchive returns the archive of the compiler runtime builtins,
+// libgcc or the compiler-rt builtins of clang. It is empty when the
+// compiler targets another machine or has no such archive.
+func BuiltinsArchive(machine elf.Machine) (file string, err error) {
+	var triple string
+	triple, err = query("-dumpmachine")
+	if err != nil {
+		return
+	}
+	arch, _, _ := strings.Cut(triple, "-")
+	if m, ok := machines[arch]; !ok || m != machine {
+		return "", nil
+	}
+	file, err = query("-print-libgcc-file-name")
+	if err != nil {
+		return
+	}
+	// a compiler without the archive prints its bare name.
+	if !filepath.IsAbs(file) {
+		return "", nil
+	}
+	if _, errx := os.Stat(file); errx != nil {
+		return "", nil
+	}
+	return
+}
@@ -0,0 +1,647 @@
+package stubgen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"github.com/ii64/golinker/lib/cdecl"
+	"github.com/ii64/golinker/lib/hdr"
+	"github.com/twitchyliquid64/golang-asm/obj/x86"
+)
+
+// Options controls the generated stub file.
+type Options struct {
+	// Package is the Go package name of the stub.
+	Package string
+	// Source names the declarations origin in the generated header.
+	Source string
+	Arch   string
+}
+
+type generator struct {
+	opts Options
+	file *cdecl.File
+
+	buf      bytes.Buffer
+	warnings []string
+
+	// Go names of the struct, union and enum types.
+	names map[cdecl.Type]string
+	// tag types that failed to convert.
+	skipped map[cdecl.Type]bool
+	// incomplete structs referenced through pointers.
+	opaque    []*cdecl.Struct
+	useUnsafe bool
+	// Go structs to check against the C layout.
+	layouts map[string]cdecl.Type
+	// where the tag types are defined.
+	tagPos map[cdecl.Type]cdecl.Pos
+}
+
+// Generate writes a golinker stub file declaring the functions and
+// types of f. Declarations that cannot be passed to native code are
+// skipped and reported in warnings.
+func Generate(f *cdecl.File, opts Options) (src []byte, warnings []string, err error) {
+	g := &generator{
+		opts:    opts,
+		file:    f,
+		names:   map[cdecl.Type]string{},
+		skipped: map[cdecl.Type]bool{},
+		layouts: map[string]cdecl.Type{},
+		tagPos:  map[cdecl.Type]cdecl.Pos{},
+	}
+	g.warnings = append(g.warnings, f.Warnings...)
+	g.nameTags()
+
+	var body bytes.Buffer
+	for _, d := range f.Decls {
+		g.buf.Reset()
+		g.decl(d)
+		body.Write(g.buf.Bytes())
+	}
+	for _, s := range g.opaque {
+		if s.Complete {
+			continue
+		}
+		fmt.Fprintf(&body, "// %s is opaque, it is only passed by pointer.\ntype %s struct{}\n\n", g.names[s], g.names[s])
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "%s%s. DO NOT EDIT.\n\n", generatedPrefix, opts.Source)
+	fmt.Fprintf(&out, "package %s\n\n", opts.Package)
+	if g.useUnsafe {
+		out.WriteString("import \"unsafe\"\n\n")
+	}
+	out.Write(body.Bytes())
+
+	src, err = format.Source(out.Bytes())
+	if err != nil {
+		err = fmt.Errorf("stubgen: generated invalid Go: %w\n%s", err, out.Bytes())
+		return
+	}
+	if err = g.checkLayouts(src); err != nil {
+		return
+	}
+	warnings = g.warnings
+	return
+}
+
+const generatedPrefix = "// Code generated by golinker stubgen from "
+
+// IsGenerated reports whether src is a stub file written by Generate.
+func IsGenerated(src []byte) bool {
+	return bytes.HasPrefix(src, []byte(generatedPrefix))
+}
+
+func (g *generator) warnf(pos cdecl.Pos, format string, args ...interface{}) {
+	g.warnings = append(g.warnings, fmt.Sprintf("%s: %s", pos, fmt.Sprintf(format, args...)))
+}
+
+// nameTags picks the Go names of the tag types. A tag keeps its C name
+// unless that name is used by a typedef or a function for something
+// else, then it gets a struct_, union_ or enum_ prefix.
+func (g *generator) nameTags() {
+	idents := map[string]cdecl.Type{}
+	for _, d := range g.file.Decls {
+		switch d := d.(type) {
+		case *cdecl.TypedefDecl:
+			idents[d.Type.Name] = d.Type.Type
+		case *cdecl.FuncDecl:
+			idents[d.Name] = d.Type
+		}
+	}
+	tagName := func(t cdecl.Type, tag, kw string) {
+		if _, ok := g.names[t]; ok || tag == "" {
+			return
+		}
+		if other, ok := idents[tag]; ok && other != t {
+			g.names[t] = kw + "_" + tag
+			return
+		}
+		g.names[t] = tag
+	}
+	var walk func(t cdecl.Type)
+	walk = func(t cdecl.Type) {
+		switch t := t.(type) {
+		case *cdecl.Struct:
+			kw := "struct"
+			if t.Union {
+				kw = "union"
+			}
+			tagName(t, t.Tag, kw)
+		case *cdecl.Enum:
+			tagName(t, t.Tag, "enum")
+		case cdecl.Pointer:
+			walk(t.Elem)
+		case cdecl.Array:
+			walk(t.Elem)
+		}
+	}
+	for _, d := range g.file.Decls {
+		switch d := d.(type) {
+		case *cdecl.TagDecl:
+			g.tagPos[d.Type] = d.Pos
+			walk(d.Type)
+		case *cdecl.TypedefDecl:
+			// an anonymous struct or enum is named by its typedef.
+			switch t := d.Type.Type.(type) {
+			case *cdecl.Struct:
+				if t.Tag == "" {
+					if _, ok := g.names[t]; !ok {
+						g.names[t] = d.Type.Name
+					}
+				}
+			case *cdecl.Enum:
+				if t.Tag == "" {
+					if _, ok := g.names[t]; !ok {
+						g.names[t] = d.Type.Name
+					}
+				}
+			}
+			walk(d.Type.Type)
+		case *cdecl.FuncDecl:
+			for _, p := range d.Type.Params {
+				walk(p.Type)
+			}
+			walk(d.Type.Result)
+		}
+	}
+}
+
+func (g *generator) writeDoc(doc []string) {
+	for _, ln := range doc {
+		if ln == "" {
+			g.buf.WriteString("//\n")
+			continue
+		}
+		fmt.Fprintf(&g.buf, "// %s\n", ln)
+	}
+}
+
+func (g *generator) decl(d cdecl.Decl) {
+	switch d := d.(type) {
+	case *cdecl.TagDecl:
+		name, ok := g.names[d.Type]
+		if isAnonymous(d.Type) {
+			// named by its typedef, or a bare enum of constants.
+			if e, isEnum := d.Type.(*cdecl.Enum); isEnum && !ok {
+				g.writeDoc(d.Doc)
+				g.enumConsts("", e)
+			}
+			return
+		}
+		g.typeDef(d.Pos, name, d.Type, d.Doc)
+	case *cdecl.TypedefDecl:
+		g.typedef(d)
+	case *cdecl.FuncDecl:
+		g.funcDecl(d)
+	}
+}
+
+// typeDef emits the definition of a struct, union or enum.
+func (g *generator) typeDef(pos cdecl.Pos, name string, t cdecl.Type, doc []string) {
+	switch t := t.(type) {
+	case *cdecl.Enum:
+		under := "uint32"
+		if t.Signed {
+			under = "int32"
+		}
+		g.writeDoc(doc)
+		fmt.Fprintf(&g.buf, "type %s %s\n\n", name, under)
+		g.enumConsts(name, t)
+	case *cdecl.Struct:
+		body, err := g.structType(t)
+		if err != nil {
+			g.skipped[t] = true
+			g.warnf(pos, "%s: %s, skipped", t, err)
+			return
+		}
+		g.writeDoc(doc)
+		fmt.Fprintf(&g.buf, "type %s %s\n\n", name, body)
+		g.layouts[name] = t
+	}
+}
+
+func (g *generator) enumConsts(typ string, e *cdecl.Enum) {
+	if len(e.Enumerators) == 0 {
+		return
+	}
+	g.buf.WriteString("const (\n")
+	for _, en := range e.Enumerators {
+		if typ == "" {
+			fmt.Fprintf(&g.buf, "%s = %d\n", en.Name, en.Value)
+			continue
+		}
+		fmt.Fprintf(&g.buf, "%s %s = %d\n", en.Name, typ, en.Value)
+	}
+	g.buf.WriteString(")\n\n")
+}
+
+func (g *generator) typedef(d *cdecl.TypedefDecl) {
+	name := d.Type.Name
+	switch t := d.Type.Type.(type) {
+	case *cdecl.Struct, *cdecl.Enum:
+		target := g.names[t]
+		if target == name {
+			// an anonymous definition is emitted here, a tagged one
+			// is emitted by its TagDecl.
+			if isAnonymous(t) {
+				g.typeDef(d.Pos, name, t, d.Doc)
+			}
+			return
+		}
+		if g.skipped[t] {
+			g.warnf(d.Pos, "typedef %s: %s is skipped, skipped", name, t)
+			return
+		}
+		if s, ok := t.(*cdecl.Struct); ok && !s.Complete {
+			g.addOpaque(s)
+		}
+		// the doc already went to the struct if both are declared at once.
+		if g.tagPos[t] != d.Pos {
+			g.writeDoc(d.Doc)
+		}
+		fmt.Fprintf(&g.buf, "type %s = %s\n\n", name, target)
+		return
+	}
+	gt, err := g.goType(d.Type.Type)
+	if err != nil {
+		g.skipped[d.Type] = true
+		g.warnf(d.Pos, "typedef %s: %s, skipped", name, err)
+		return
+	}
+	g.writeDoc(d.Doc)
+	fmt.Fprintf(&g.buf, "type %s %s\n\n", name, gt)
+	if _, ok := cdecl.Underlying(d.Type.Type).(*cdecl.Struct); ok {
+		g.layouts[name] = d.Type.Type
+	}
+}
+
+func isAnonymous(t cdecl.Type) bool {
+	switch t := t.(type) {
+	case *cdecl.Struct:
+		return t.Tag == ""
+	case *cdecl.Enum:
+		return t.Tag == ""
+	}
+	return false
+}
+
+func (g *generator) addOpaque(s *cdecl.Struct) {
+	for _, o := range g.opaque {
+		if o == s {
+			return
+		}
+	}
+	g.opaque = append(g.opaque, s)
+}
+
+func (g *generator) structType(s *cdecl.Struct) (string, error) {
+	if !s.Complete {
+		return "", fmt.Errorf("%s is incomplete", s)
+	}
+	var b strings.Builder
+	if s.Union {
+		// the Go type only has the size and alignment of the union.
+		fmt.Fprintf(&b, "struct {\n_ [0]uint%d\nBytes [%d]byte\n}", s.Align()*8, s.Size())
+		return b.String(), nil
+	}
+	b.WriteString("struct {\n")
+	fields := s.Fields
+	if n := len(fields); n > 0 {
+		if a, ok := fields[n-1].Type.(cdecl.Array); ok && a.Len == 0 {
+			// a flexible array member, Go would pad the struct for it.
+			fields = fields[:n-1]
+		}
+	}
+	// Go lays fields out naturally, packed or over aligned structs
+	// cannot be spelled.
+	var off int64
+	for _, f := range fields {
+		off = (off + f.Type.Align() - 1) / f.Type.Align() * f.Type.Align()
+		if f.Offset != off {
+			return "", fmt.Errorf("field %s: packed or aligned layout", f.Name)
+		}
+		off += f.Type.Size()
+	}
+	ns := newNamer()
+	for i, f := range fields {
+		ft, err := g.goType(f.Type)
+		if err != nil {
+			return "", fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		name := f.Name
+		if name == "" {
+			name = fmt.Sprintf("anon%d", i)
+		}
+		fmt.Fprintf(&b, "%s %s\n", ns.name(name), ft)
+	}
+	b.WriteString("}")
+	return b.String(), nil
+}
+
+var builtinGoTypes = map[string]string{
+	"size_t":    "uint64",
+	"ssize_t":   "int64",
+	"intptr_t":  "int64",
+	"uintptr_t": "uintptr",
+	"intmax_t":  "int64",
+	"uintmax_t": "uint64",
+	"ptrdiff_t": "int64",
+	"off_t":     "int64",
+	"bool":      "bool",
+}
+
+// goType is the Go spelling of a C type with the same size and layout.
+func (g *generator) goType(t cdecl.Type) (string, error) {
+	switch t := t.(type) {
+	case *cdecl.Named:
+		if t.Builtin {
+			if gt, ok := builtinGoTypes[t.Name]; ok {
+				return gt, nil
+			}
+			return g.goType(t.Type)
+		}
+		if g.skipped[t] {
+			return "", fmt.Errorf("%s is skipped", t.Name)
+		}
+		return t.Name, nil
+	case cdecl.Void:
+		return "", fmt.Errorf("void value")
+	case cdecl.Bool:
+		return "bool", nil
+	case cdecl.Int:
+		if t.Signed {
+			return fmt.Sprintf("int%d", t.Bytes*8), nil
+		}
+		return fmt.Sprintf("uint%d", t.Bytes*8), nil
+	case cdecl.Float:
+		return fmt.Sprintf("float%d", t.Bytes*8), nil
+	case cdecl.Pointer:
+		return g.pointerType(t)
+	case cdecl.Array:
+		et, err := g.goType(t.Elem)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("[%d]%s", t.Len, et), nil
+	case *cdecl.Struct:
+		if g.skipped[t] {
+			return "", fmt.Errorf("%s is skipped", t)
+		}
+		if name, ok := g.names[t]; ok {
+			if !t.Complete {
+				return "", fmt.Errorf("%s is incomplete", t)
+			}
+			return name, nil
+		}
+		// an anonymous struct inside a struct.
+		return g.structType(t)
+	case *cdecl.Enum:
+		if name, ok := g.names[t]; ok {
+			return name, nil
+		}
+		if t.Signed {
+			return "int32", nil
+		}
+		return "uint32", nil
+	case *cdecl.Func:
+		return "", fmt.Errorf("function value")
+	}
+	return "", fmt.Errorf("%s is not supported", t)
+}
+
+func (g *generator) pointerType(t cdecl.Pointer) (string, error) {
+	switch e := cdecl.Underlying(t.Elem).(type) {
+	case cdecl.Void:
+		g.useUnsafe = true
+		return "unsafe.Pointer", nil
+	case *cdecl.Func:
+		return "uintptr", nil
+	case cdecl.Int:
+		if e.Char {
+			return "*byte", nil
+		}
+	case *cdecl.Struct:
+		if !e.Complete {
+			if _, ok := g.names[e]; !ok {
+				break
+			}
+			g.addOpaque(e)
+			if n, ok := t.Elem.(*cdecl.Named); ok {
+				return "*" + n.Name, nil
+			}
+			return "*" + g.names[e], nil
+		}
+	}
+	et, err := g.goType(t.Elem)
+	if err != nil {
+		// still a pointer, the pointee is just not spelled out.
+		g.useUnsafe = true
+		return "unsafe.Pointer", nil
+	}
+	return "*" + et, nil
+}
+
+func (g *generator) funcDecl(d *cdecl.FuncDecl) {
+	if d.Type.Variadic {
+		g.warnf(d.Pos, "%s: variadic functions are not supported, skipped", d.Name)
+		return
+	}
+	ns := newNamer()
+	var params []string
+	for i, p := range d.Type.Params {
+		gt, err := g.goType(p.Type)
+		if err == nil {
+			err = checkUnions(p.Type)
+		}
+		if err != nil {
+			g.warnf(d.Pos, "%s: param %d: %s, skipped", d.Name, i, err)
+			return
+		}
+		name := p.Name
+		if name == "" {
+			name = fmt.Sprintf("a%d", i)
+		}
+		// the asm refers to params as name+off(FP).
+		if asmRegisters[name] {
+			name += "_"
+		}
+		params = append(params, fmt.Sprintf("%s %s", ns.name(name), gt))
+	}
+	var result string
+	if _, void := cdecl.Underlying(d.Type.Result).(cdecl.Void); !void {
+		gt, err := g.goType(d.Type.Result)
+		if err == nil {
+			err = checkUnions(d.Type.Result)
+		}
+		if err != nil {
+			g.warnf(d.Pos, "%s: result: %s, skipped", d.Name, err)
+			return
+		}
+		result = fmt.Sprintf(" (%s %s)", ns.name("ret"), gt)
+	}
+	g.writeDoc(d.Doc)
+	name := d.Name
+	if token.IsKeyword(name) || name == "init" || name == "_" {
+		for name += "_"; g.declared(name); name += "_" {
+		}
+		if len(d.Doc) > 0 {
+			g.buf.WriteString("//\n")
+		}
+		fmt.Fprintf(&g.buf, "//golinker:symbol %s\n", d.Name)
+	}
+	fmt.Fprintf(&g.buf, "func %s(%s)%s\n\n", name, strings.Join(params, ", "), result)
+}
+
+// declared tells whether name is the name of a C function or typedef.
+func (g *generator) declared(name string) bool {
+	for _, d := range g.file.Decls {
+		switch d := d.(type) {
+		case *cdecl.TypedefDecl:
+			if d.Type.Name == name {
+				return true
+			}
+		case *cdecl.FuncDecl:
+			if d.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// asmRegisters are the register names of Go assembly.
+var asmRegisters = func() map[string]bool {
+	regs := map[string]bool{"SB": true, "FP": true, "PC": true, "g": true}
+	for _, r := range x86.Register {
+		regs[r] = true
+	}
+	return regs
+}()
+
+// SysV classes of an eightbyte, an eightbyte takes the greater class of
+// its fields.
+const (
+	classNone = iota
+	classSSE
+	classInteger
+	classMemory
+)
+
+// classify merges the classes of the scalars of t at off into the
+// eightbytes of cls. unionBytes classifies unions the way the stub
+// passes them, as a byte array.
+func classify(cls []int, t cdecl.Type, off int64, unionBytes bool) {
+	mark := func(c int) {
+		if i := off / 8; i < int64(len(cls)) && cls[i] < c {
+			cls[i] = c
+		}
+	}
+	switch t := cdecl.Underlying(t).(type) {
+	case cdecl.Float:
+		if t.Bytes > 8 {
+			// long double is x87, which goes to memory in an aggregate.
+			mark(classMemory)
+			return
+		}
+		mark(classSSE)
+	case cdecl.Array:
+		for i := int64(0); i < t.Len; i++ {
+			classify(cls, t.Elem, off+i*t.Elem.Size(), unionBytes)
+		}
+	case *cdecl.Struct:
+		if t.Union && unionBytes {
+			for i := int64(0); i < t.Size(); i += 8 {
+				classify(cls, cdecl.Int{Bytes: 1}, off+i, false)
+			}
+			return
+		}
+		for _, f := range t.Fields {
+			classify(cls, f.Type, off+f.Offset, unionBytes)
+		}
+	default:
+		mark(classInteger)
+	}
+}
+
+// checkUnions tells when a union in a value of type t changes the
+// registers it is passed in. The Go type of a union is a byte array,
+// which is passed in general purpose registers, while C classifies a
+// union from its members.
+func checkUnions(t cdecl.Type) error {
+	if t.Size() > 16 {
+		// passed in memory either way.
+		return nil
+	}
+	c, goc := make([]int, 2), make([]int, 2)
+	classify(c, t, 0, false)
+	classify(goc, t, 0, true)
+	for i := range c {
+		if c[i] != goc[i] {
+			return fmt.Errorf("%s holds a union not passed in general purpose registers", t)
+		}
+	}
+	return nil
+}
+
+// checkLayouts type-checks the stub and compares the Go struct layouts
+// against the C ones.
+func (g *generator) checkLayouts(src []byte) error {
+	h, err := hdr.ParseFile(g.opts.Source+".go", string(src), g.opts.Arch)
+	if err != nil {
+		return fmt.Errorf("stubgen: %w", err)
+	}
+	for name, ct := range g.layouts {
+		obj := h.Pkg.Scope().Lookup(name)
+		if obj == nil {
+			continue
+		}
+		st, ok := obj.Type().Underlying().(*types.Struct)
+		if !ok {
+			continue
+		}
+		if sz := h.Sizes.Sizeof(st); sz != ct.Size() {
+			return fmt.Errorf("stubgen: %s is %d bytes in Go but %d bytes in C", name, sz, ct.Size())
+		}
+		cs, ok := cdecl.Underlying(ct).(*cdecl.Struct)
+		if !ok || cs.Union {
+			continue
+		}
+		var vars []*types.Var
+		for i := 0; i < st.NumFields(); i++ {
+			vars = append(vars, st.Field(i))
+		}
+		offs := h.Sizes.Offsetsof(vars)
+		for i := range vars {
+			if offs[i] != cs.Fields[i].Offset {
+				return fmt.Errorf("stubgen: %s.%s is at offset %d in Go but %d in C",
+					name, vars[i].Name(), offs[i], cs.Fields[i].Offset)
+			}
+		}
+	}
+	return nil
+}
+
+// namer makes C names valid and unique Go identifiers.
+type namer map[string]bool
+
+func newNamer() namer {
+	return namer{}
+}
+
+func (n namer) name(s string) string {
+	// g names the g register in Go assembly.
+	if token.IsKeyword(s) || s == "g" || s == "_" {
+		s += "_"
+	}
+	for n[s] {
+		s += "_"
+	}
+	n[s] = true
+	return s
+}
@@ -0,0 +1,135 @@
+package stubgen
+
+import (
+	"testing"
+
+	"github.com/ii64/golinker/lib/cdecl"
+	"github.com/stretchr/testify/assert"
+)
+
+func generate(t *testing.T, src string) (string, []string) {
+	f, err := cdecl.Parse("x.h", src, "amd64")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	out, warnings, err := Generate(f, Options{Package: "native", Source: "x.h", Arch: "amd64"})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return string(out), warnings
+}
+
+func TestGenerate(t *testing.T) {
+	out, warnings := generate(t, `#include <stdint.h>
+#include <stdbool.h>
+
+/* A point. */
+typedef struct point { double x, y; } point_t;
+typedef struct ring ring;
+typedef enum { OFF, ON = 4 } state_t;
+typedef void (*cb_t)(void *);
+
+// move moves p by d.
+//
+// p must not be NULL.
+bool move(point_t *p, point_t d, state_t s);
+uint64_t ring_submit(ring *r, const char *name, void *data, cb_t cb);
+void kw(int type, int g, uint8_t b);
+int logf(const char *fmt, ...);
+`)
+	assert.Equal(t, `// Code generated by golinker stubgen from x.h. DO NOT EDIT.
+
+package native
+
+import "unsafe"
+
+// A point.
+type point struct {
+	x float64
+	y float64
+}
+
+type point_t = point
+
+type state_t uint32
+
+const (
+	OFF state_t = 0
+	ON  state_t = 4
+)
+
+type cb_t uintptr
+
+// move moves p by d.
+//
+// p must not be NULL.
+func move(p *point_t, d point_t, s state_t) (ret bool)
+
+func ring_submit(r *ring, name *byte, data unsafe.Pointer, cb cb_t) (ret uint64)
+
+func kw(type_ int32, g_ int32, b uint8)
+
+// ring is opaque, it is only passed by pointer.
+type ring struct{}
+`, out)
+	assert.Equal(t, []string{"x.h:16:1: logf: variadic functions are not supported, skipped"}, warnings)
+	assert.True(t, IsGenerated([]byte(out)))
+	assert.False(t, IsGenerated([]byte("package native\n\nfunc move(p *point_t) bool\n")))
+}
+
+func TestGenerateLayout(t *testing.T) {
+	out, warnings := generate(t, `
+struct in { short a; long b; };
+struct msg {
+	char kind;
+	struct in in;
+	union { int i; double d; } u;
+	struct { unsigned char r, g, b; } rgb;
+	unsigned flags : 3;
+};
+struct hdr { int len; char data[]; };
+int send(struct msg *m, struct hdr h);
+`)
+	assert.Contains(t, out, "type in struct {\n\ta int16\n\tb int64\n}\n")
+	assert.NotContains(t, out, "type msg")
+	// the flexible array member is dropped.
+	assert.Contains(t, out, "type hdr struct {\n\tlen int32\n}\n")
+	assert.Contains(t, out, "func send(m unsafe.Pointer, h hdr) (ret int32)\n")
+	assert.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "struct msg: field flags: bit-field flags is not supported, skipped")
+}
+
+func TestGenerateNames(t *testing.T) {
+	out, _ := generate(t, `
+// select picks one.
+int select(int AX, int SP, int g);
+void type(void);
+void type_(void);
+`)
+	assert.Contains(t, out, "// select picks one.\n//\n//golinker:symbol select\nfunc select_(AX_ int32, SP_ int32, g_ int32) (ret int32)\n")
+	assert.Contains(t, out, "//golinker:symbol type\nfunc type__()\n")
+	assert.Contains(t, out, "\nfunc type_()\n")
+}
+
+func TestGenerateUnion(t *testing.T) {
+	out, warnings := generate(t, `
+typedef union { long l; double d; } num_t;
+typedef union { double d; float f; } real_t;
+typedef union { char c[24]; double d; } big_t;
+struct pair { real_t r; int i; };
+num_t num(num_t n);
+real_t real(real_t r);
+big_t big(big_t b);
+int pair(struct pair p);
+real_t *ptr(real_t *r);
+`)
+	assert.Contains(t, out, "func num(n num_t) (ret num_t)\n")
+	assert.Contains(t, out, "func big(b big_t) (ret big_t)\n")
+	assert.Contains(t, out, "func ptr(r *real_t) (ret *real_t)\n")
+	assert.NotContains(t, out, "func real(")
+	assert.NotContains(t, out, "func pair(")
+	assert.Equal(t, []string{
+		"x.h:7:1: real: param 0: real_t holds a union not passed in general purpose registers, skipped",
+		"x.h:9:1: pair: param 0: struct pair holds a union not passed in general purpose registers, skipped",
+	}, warnings)
+}
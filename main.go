@@ -9,27 +9,24 @@ import (
 	"github.com/ii64/golinker/conf"
 )
 
-func _main(args []string) {
+// run parses args into fs and runs fn once validate passes. An error is
+// printed to stderr with the usage, and exits with status 1.
+func run(fs *flag.FlagSet, args []string, validate, fn func() error) {
 	var err error
-	var exitCode int
-	cfg := conf.Default()
-	fs := cfg.FlagSet("golinker", flag.ExitOnError)
 	oldUsage := fs.Usage
 	fs.Usage = func() {
 		oldUsage()
 		fs.PrintDefaults()
-		exitCode = 0
-		os.Exit(exitCode)
 	}
 	err = fs.Parse(args)
 	if err != nil {
 		goto Exit
 	}
-	err = cfg.Vaildate()
+	err = validate()
 	if err != nil {
 		goto Exit
 	}
-	err = cmd.Main(cfg)
+	err = fn()
 	if err != nil {
 		goto Exit
 	}
@@ -37,12 +34,31 @@ Exit:
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %s\n\n", err)
 		fs.Usage()
-		exitCode = 1
+		os.Exit(1)
 	}
-	os.Exit(exitCode)
+}
+
+func _main(args []string) {
+	cfg := conf.Default()
+	fs := cfg.FlagSet("golinker", flag.ExitOnError)
+	run(fs, args, cfg.Vaildate, func() error {
+		return cmd.Main(cfg)
+	})
+}
+
+func _stubgen(args []string) {
+	cfg := conf.DefaultStubgen()
+	fs := cfg.FlagSet("golinker stubgen", flag.ExitOnError)
+	run(fs, args, cfg.Vaildate, func() error {
+		return cmd.Stubgen(cfg)
+	})
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "stubgen" {
+		_stubgen(os.Args[2:])
+		return
+	}
 	_main(os.Args[1:])
 	// _main([]string{
 	// 	// "-extld=ld",